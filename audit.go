@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// AuditEntry is one row of the append-only audit log. Entity and EntityID name
+// what was changed, Changes holds the fields that differ before and after.
+type AuditEntry struct {
+	ID        int64        `json:"id" db:"id"`
+	ActorID   *int64       `json:"actor_id" db:"actor_id"`
+	Actor     string       `json:"actor" db:"actor"`
+	Action    string       `json:"action" db:"action"`
+	Entity    string       `json:"entity" db:"entity"`
+	EntityID  *int64       `json:"entity_id" db:"entity_id"`
+	Changes   AuditChanges `json:"changes" db:"changes"`
+	IP        string       `json:"ip" db:"ip"`
+	RequestID string       `json:"request_id" db:"request_id"`
+	CreatedAt time.Time    `json:"created_at" db:"created_at"`
+}
+
+// AuditChange is the value of a field before and after an operation, Before is
+// missing for created entities and After for removed ones
+type AuditChange struct {
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// AuditChanges maps the JSON name of each changed field to its change
+type AuditChanges map[string]AuditChange
+
+func (c *AuditChanges) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*c = AuditChanges{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("unsupported type %T for audit changes", src)
+	}
+}
+
+func (c AuditChanges) Value() (driver.Value, error) {
+	if c == nil {
+		return []byte(`{}`), nil
+	}
+	return json.Marshal(c)
+}
+
+// AuditFilter narrows down the audit log, zero values match everything
+type AuditFilter struct {
+	ActorID  int64
+	Entity   string
+	EntityID int64
+	From     time.Time
+	To       time.Time
+	BeforeID int64 // entries older than this id, to page back through the log
+	Limit    int64
+}
+
+// auditRedacted are fields never written to the audit log, only whether they changed
+var auditRedacted = map[string]bool{"password": true}
+
+const auditRedactedValue = "[redacted]"
+
+// auditDiff compares the JSON forms of before and after field by field. Either
+// may be nil for entities that are created or removed.
+func auditDiff(before, after interface{}) (AuditChanges, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := AuditChanges{}
+	for field, value := range beforeFields {
+		if afterValue, ok := afterFields[field]; !ok || !reflect.DeepEqual(value, afterValue) {
+			changes[field] = AuditChange{Before: value, After: afterValue}
+		}
+	}
+	for field, value := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			changes[field] = AuditChange{After: value}
+		}
+	}
+	for field, change := range changes {
+		if !auditRedacted[field] {
+			continue
+		}
+		if change.Before != nil {
+			change.Before = auditRedactedValue
+		}
+		if change.After != nil {
+			change.After = auditRedactedValue
+		}
+		changes[field] = change
+	}
+	return changes, nil
+}
+
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if v == nil {
+		return fields, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		// not an object, like the ids of an import
+		var value interface{}
+		if err := json.Unmarshal(b, &value); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"value": value}, nil
+	}
+	return fields, nil
+}
+
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only
+// believed behind a proxy that sets it, see TRUST_PROXY_HEADERS.
+func clientIP(r *http.Request, trustProxyHeaders bool) string {
+	if trustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder remembers the status code a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func isMutating(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// AuditMiddleware gives every request an ID, taken from X-Request-ID when the
+// client sent a sane one and echoed back in it. Every successful POST, PUT and
+// DELETE is written to the audit log: handlers describe what they changed with
+// audit, the rest are logged by method and route.
+func (h *Handler) AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		if !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry := &AuditEntry{IP: clientIP(r, h.trustProxyHeaders), RequestID: requestID}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), "audit", entry)))
+		if recorder.status >= http.StatusMultipleChoices {
+			return
+		}
+		if entry.Action == "" {
+			entry.Action = r.Method + " " + r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					entry.Action = r.Method + " " + template
+				}
+			}
+		}
+		if err := h.AuditStore.RecordAudit(*entry); err != nil {
+			logrus.WithFields(logrus.Fields{"route": r.RequestURI, "request_id": requestID}).
+				WithError(err).Error("record audit entry")
+		}
+	})
+}
+
+// auditEntry is the audit entry of a mutating request, nil for other requests
+func auditEntry(r *http.Request) *AuditEntry {
+	entry, _ := r.Context().Value("audit").(*AuditEntry)
+	return entry
+}
+
+// setAuditActor records who made a request, the auth middleware and login call it
+func setAuditActor(r *http.Request, userID int64, username string) {
+	if entry := auditEntry(r); entry != nil {
+		entry.ActorID = &userID
+		entry.Actor = username
+	}
+}
+
+// audit describes what a request changed, action is `entity.verb` and id is 0
+// when the request touched more than one entity. The entry is only written if
+// the request succeeds.
+func (h *Handler) audit(r *http.Request, action, entity string, id int64, before, after interface{}) {
+	entry := auditEntry(r)
+	if entry == nil {
+		return
+	}
+	entry.Action = action
+	entry.Entity = entity
+	entry.EntityID = nil
+	if id != 0 {
+		entry.EntityID = &id
+	}
+	changes, err := auditDiff(before, after)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"route": r.RequestURI}).WithError(err).Error("diff audited entity")
+		changes = AuditChanges{}
+	}
+	entry.Changes = changes
+}
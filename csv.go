@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvRow is a data row of an imported CSV file, keyed by field name. Err is set
+// when the row itself could not be read.
+type csvRow struct {
+	Line   int
+	Values map[string]string
+	Err    error
+}
+
+// readCSV reads a CSV file whose first row names the columns. mapping renames
+// columns, matched case-insensitively, to fields. Every column must end up as
+// one of known and every field of required must have a column.
+func readCSV(r io.Reader, mapping map[string]string, known, required []string) ([]csvRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty file, expect a header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	renames := make(map[string]string, len(mapping))
+	for column, field := range mapping {
+		renames[strings.ToLower(strings.TrimSpace(column))] = field
+	}
+	fields := make([]string, len(header))
+	seen := make(map[string]bool, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		field := column
+		if renamed, ok := renames[column]; ok {
+			field = renamed
+		}
+		if !contains(known, field) {
+			return nil, fmt.Errorf("unknown column %q, expect one of %s", column, strings.Join(known, ", "))
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("more than one column for %s", field)
+		}
+		seen[field] = true
+		fields[i] = field
+	}
+	for _, field := range required {
+		if !seen[field] {
+			return nil, fmt.Errorf("missing column %s", field)
+		}
+	}
+	var rows []csvRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		line, _ := reader.FieldPos(0)
+		row := csvRow{Line: line, Values: make(map[string]string, len(fields))}
+		if errors.Is(err, csv.ErrFieldCount) {
+			row.Err = fmt.Errorf("expect %d fields, got %d", len(fields), len(record))
+			rows = append(rows, row)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		for i, value := range record {
+			row.Values[fields[i]] = unguardCSVCell(strings.TrimSpace(value))
+		}
+		rows = append(rows, row)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// guardCSVCell stops spreadsheets from running exported values as formulas,
+// unguardCSVCell undoes it when the file is imported back
+func guardCSVCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func unguardCSVCell(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(value[1])) {
+		return value[1:]
+	}
+	return value
+}
+
+func guardCSVRecord(record []string) []string {
+	for i, value := range record {
+		record[i] = guardCSVCell(value)
+	}
+	return record
+}
+
+// The import columns of books and users. The extra columns of an export, like
+// id, are accepted on import and ignored so an exported file can be imported
+// into another catalog as is.
+var (
+	bookCSVHeader = []string{"id", "title", "author", "type", "cover", "isbn", "publisher", "publication_year",
+		"edition", "language", "page_count", "description", "subjects", "categories", "total_copies", "available_copies"}
+	bookCSVRequired        = []string{"title"}
+	userCSVHeader          = []string{"id", "email", "username", "password", "type"}
+	userCSVRequired        = []string{"email", "username", "password", "type"}
+	userCSVExportHeader    = []string{"id", "email", "username", "type"}
+	borrowHistoryCSVHeader = []string{"id", "user_id", "username", "book_id", "title", "copy_id", "barcode",
+		"borrowed_at", "due_at", "returned_at", "returned", "renewal_count", "overdue"}
+)
+
+// csvListSeparator separates the subjects or categories of a book in a single CSV field
+const csvListSeparator = ";"
+
+func splitCSVList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, csvListSeparator) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// bookFromCSV returns the book of a row along with everything wrong with it.
+// Categories are given by slug in `categories`, or in the legacy `type`.
+func bookFromCSV(values map[string]string, knownCategories map[string]bool) (Book, []string) {
+	book := Book{
+		Title:       values["title"],
+		Author:      values["author"],
+		Type:        values["type"],
+		CoverUrl:    values["cover"],
+		ISBN:        values["isbn"],
+		Publisher:   values["publisher"],
+		Edition:     values["edition"],
+		Language:    values["language"],
+		Description: values["description"],
+		Subjects:    splitCSVList(values["subjects"]),
+	}
+	if book.Subjects == nil {
+		book.Subjects = []string{}
+	}
+	for _, slug := range splitCSVList(values["categories"]) {
+		book.Categories = append(book.Categories, BookCategory{Slug: slug})
+	}
+	var problems []string
+	if book.Title == "" {
+		problems = append(problems, "title is required")
+	}
+	for field, value := range map[string]*int{"publication_year": &book.PublicationYear, "page_count": &book.PageCount} {
+		if values[field] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(values[field])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be a number", field))
+			continue
+		}
+		*value = n
+	}
+	if err := validateBook(&book); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, category := range book.Categories {
+		if !knownCategories[category.Slug] {
+			problems = append(problems, fmt.Sprintf("unknown category %q", category.Slug))
+		}
+	}
+	return book, problems
+}
+
+// userFromCSV returns the user of a row along with everything wrong with it,
+// the type has to be one of knownRoles
+func userFromCSV(values map[string]string, knownRoles map[string]bool) (User, []string) {
+	user := User{
+		Email:    values["email"],
+		UserName: values["username"],
+		Password: values["password"],
+		Type:     strings.ToLower(values["type"]),
+	}
+	var problems []string
+	if !strings.Contains(user.Email, "@") {
+		problems = append(problems, "invalid email")
+	}
+	if user.UserName == "" {
+		problems = append(problems, "username is required")
+	}
+	if user.Password == "" {
+		problems = append(problems, "password is required")
+	}
+	if !knownRoles[user.Type] {
+		problems = append(problems, fmt.Sprintf("unknown role %q", values["type"]))
+	}
+	return user, problems
+}
+
+func bookCSVRecord(book Book) []string {
+	year, pages := "", ""
+	var categories []string
+	for _, category := range book.Categories {
+		categories = append(categories, category.Slug)
+	}
+	if book.PublicationYear > 0 {
+		year = strconv.Itoa(book.PublicationYear)
+	}
+	if book.PageCount > 0 {
+		pages = strconv.Itoa(book.PageCount)
+	}
+	return guardCSVRecord([]string{
+		strconv.FormatInt(book.ID, 10), book.Title, book.Author, book.Type, book.CoverUrl, book.ISBN, book.Publisher,
+		year, book.Edition, book.Language, pages, book.Description, strings.Join(book.Subjects, csvListSeparator),
+		strings.Join(categories, csvListSeparator), strconv.Itoa(book.TotalCopies), strconv.Itoa(book.AvailableCopies),
+	})
+}
+
+func userCSVRecord(user User) []string {
+	return guardCSVRecord([]string{strconv.FormatInt(user.ID, 10), user.Email, user.UserName, user.Type})
+}
+
+func borrowHistoryCSVRecord(bh GetBorrowHistoryDetailResponse) []string {
+	returnedAt := ""
+	if bh.ReturnedAt != nil {
+		returnedAt = bh.ReturnedAt.Format(time.RFC3339)
+	}
+	return guardCSVRecord([]string{
+		strconv.FormatInt(bh.ID, 10), strconv.FormatInt(bh.UserID, 10), bh.Username, strconv.FormatInt(bh.BookID, 10),
+		bh.BookTitle, strconv.FormatInt(bh.CopyID, 10), bh.Barcode, bh.Borrowed_at.Format(time.RFC3339),
+		bh.DueAt.Format(time.RFC3339), returnedAt, strconv.FormatBool(bh.Returned), strconv.Itoa(bh.RenewalCount),
+		strconv.FormatBool(bh.Overdue),
+	})
+}
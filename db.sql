@@ -7,53 +7,285 @@ BEGIN
 END;
 $$ language 'plpgsql';
 -- create table users, books, sessions, borrow_history
+-- create table roles, the type of a user names their role, see rbac.go
+ CREATE TABLE IF NOT EXISTS roles (
+    name text PRIMARY KEY,
+    description text NOT NULL DEFAULT '',
+    builtin boolean NOT NULL DEFAULT false, -- built-in roles can't be removed
+    require_totp boolean NOT NULL DEFAULT false, -- users of the role must set up TOTP before anything else
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+create trigger update_roles_updated_at before UPDATE on roles for each row execute procedure update_updated_at_column();
+ CREATE TABLE IF NOT EXISTS role_permissions (
+    role text NOT NULL REFERENCES roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission text NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+insert into roles(name, description, builtin) values
+('admin', 'runs the library system', true),
+('librarian', 'runs the catalog, loans and borrowers', true),
+('borrower', 'borrows books', true);
+insert into role_permissions(role, permission) values
+('admin', 'account:self'), ('admin', 'book:read'), ('admin', 'book:write'), ('admin', 'category:write'),
+('admin', 'loan:own'), ('admin', 'loan:create'), ('admin', 'loan:read'), ('admin', 'fine:manage'),
+('admin', 'user:read:*'), ('admin', 'user:manage:*'), ('admin', 'audit:read'), ('admin', 'role:manage'),
+('librarian', 'account:self'), ('librarian', 'book:read'), ('librarian', 'book:write'), ('librarian', 'category:write'),
+('librarian', 'loan:own'), ('librarian', 'loan:create'), ('librarian', 'loan:read'), ('librarian', 'fine:manage'),
+('librarian', 'user:read:librarian'), ('librarian', 'user:read:borrower'), ('librarian', 'user:manage:borrower'),
+('borrower', 'account:self'), ('borrower', 'book:read'), ('borrower', 'loan:own');
+
 -- create table users
  CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
-    email  text NOT NULL UNIQUE,
-    username  text NOT NULL UNIQUE,
+    email  text NOT NULL,
+    username  text NOT NULL,
     password  text NOT NULL,
-    type  text NOT NULL,
+    type  text NOT NULL REFERENCES roles(name) ON UPDATE CASCADE ON DELETE RESTRICT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    constraint validate_user_type CHECK (type IN ('admin','librarian','borrower'))
+    deleted_at TIMESTAMP -- set while the user is in the trash, purged after DELETED_RETENTION_IN_DAYS
 );
 create trigger update_users_updated_at before UPDATE on users for each row execute procedure update_updated_at_column();
+-- users in the trash don't hold on to their email and username
+create unique index users_email on users(email) where deleted_at is null;
+create unique index users_username on users(username) where deleted_at is null;
+-- password is `admin`, hashed with HashPassword in password.go
 insert into users(email, username, password, type) values
-('admin@stu.ptit.edu.vn','admin','admin','admin');
+('admin@stu.ptit.edu.vn','admin','$lms-v1$$2a$12$6FJ2yy.7bInyIcpjcCxIfuH5.fe1Hv6EvxDYTdQheS7T7qErYLgV2','admin');
 
 -- create table books
  CREATE TABLE IF NOT EXISTS books (
     id SERIAL PRIMARY KEY,
     title  text NOT NULL,
     author  text DEFAULT '',
-    type  text DEFAULT '',
-    count INT NOT NULL,
+    type  text, -- slug of the first category of the book, see book_categories
     cover  text DEFAULT '',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    constraint unique_book_per_author UNIQUE(title, author),
-    constraint positive_count CHECK (count >= 0)
+    isbn  text, -- normalized ISBN-13, see NormalizeISBN
+    publisher  text NOT NULL DEFAULT '',
+    publication_year INT,
+    edition  text NOT NULL DEFAULT '',
+    language  text NOT NULL DEFAULT '',
+    page_count INT,
+    description  text NOT NULL DEFAULT '',
+    subjects  text[] NOT NULL DEFAULT '{}',
+    deleted_at TIMESTAMP, -- set while the book is in the trash, purged after DELETED_RETENTION_IN_DAYS
+    -- full-text index of the catalog, title matches rank above author matches above type matches
+    search_vector tsvector GENERATED ALWAYS AS (
+        setweight(to_tsvector('simple', title), 'A') ||
+        setweight(to_tsvector('simple', coalesce(author, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(type, '')), 'C')
+    ) STORED,
+    constraint validate_book_isbn CHECK (isbn ~ '^97[89][0-9]{10}$'),
+    constraint validate_book_page_count CHECK (page_count > 0)
 );
 create trigger update_books_updated_at before UPDATE on books for each row execute procedure update_updated_at_column();
+-- books in the trash don't block adding the same book again
+create unique index books_isbn on books(isbn) where deleted_at is null;
+create unique index books_unique_edition on books(title, author, edition) where deleted_at is null;
+create index books_search_vector on books using gin(search_vector);
 
--- create table sessions
- CREATE TABLE IF NOT EXISTS sessions (
+-- create table categories, a tree of categories books are shelved under
+ CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    parent_id INT REFERENCES categories(id) ON DELETE RESTRICT,
+    slug  text NOT NULL UNIQUE,
+    name  text NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    constraint validate_category_slug CHECK (slug ~ '^[a-z0-9][a-z0-9._-]*$')
+);
+create trigger update_categories_updated_at before UPDATE on categories for each row execute procedure update_updated_at_column();
+create index categories_parent_id on categories(parent_id);
+insert into categories(slug, name) values
+('fiction', 'Fiction'), ('non-fiction', 'Non-fiction'), ('spiritual', 'Spiritual'), ('others', 'Others');
+alter table books add constraint book_type_category FOREIGN KEY (type) REFERENCES categories(slug) ON UPDATE CASCADE ON DELETE RESTRICT;
+
+-- create table book_categories, the categories of a book in order
+ CREATE TABLE IF NOT EXISTS book_categories (
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    category_id INT NOT NULL REFERENCES categories(id) ON DELETE RESTRICT,
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, category_id)
+);
+create index book_categories_category_id on book_categories(category_id);
+
+-- create table authors, books.author keeps the names of the authors of a book for display and search
+ CREATE TABLE IF NOT EXISTS authors (
     id SERIAL PRIMARY KEY,
-    user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
-    session_id  text NOT NULL,
+    name  text NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
-create trigger update_sessions_updated_at before UPDATE on sessions for each row execute procedure update_updated_at_column();
+create trigger update_authors_updated_at before UPDATE on authors for each row execute procedure update_updated_at_column();
+create unique index authors_name on authors((lower(name)));
+
+-- create table book_authors, the credits of a book in order
+ CREATE TABLE IF NOT EXISTS book_authors (
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    author_id INT NOT NULL REFERENCES authors(id) ON DELETE CASCADE,
+    role  text NOT NULL DEFAULT 'author',
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, author_id, role),
+    constraint validate_author_role CHECK (role IN ('author','editor','translator'))
+);
+create index book_authors_author_id on book_authors(author_id);
+
+-- create table book_copies, one row per physical copy of a book
+ CREATE TABLE IF NOT EXISTS book_copies (
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    barcode  text NOT NULL UNIQUE,
+    shelf_location  text NOT NULL DEFAULT '',
+    condition  text NOT NULL DEFAULT 'good',
+    status  text NOT NULL DEFAULT 'available',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    constraint validate_copy_condition CHECK (condition IN ('new','good','fair','poor','damaged')),
+    constraint validate_copy_status CHECK (status IN ('available','borrowed','on_hold','lost','retired'))
+);
+create index book_copies_book_id_status on book_copies(book_id, status);
+create trigger update_book_copies_updated_at before UPDATE on book_copies for each row execute procedure update_updated_at_column();
+
+-- create table sessions, one per device a user is logged in on
+ CREATE TABLE IF NOT EXISTS sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash  text NOT NULL UNIQUE, -- SHA-256 of the token in the cookie, see HashToken
+    user_agent  text NOT NULL DEFAULT '',
+    ip  text NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    mfa_pending boolean NOT NULL DEFAULT false, -- logged in with a password, still waiting for the TOTP code
+    constraint validate_session_token_hash CHECK (token_hash ~ '^[0-9a-f]{64}$')
+);
+create index sessions_user_id on sessions(user_id);
+
+-- create table password_resets, one-time tokens staff issue to reset a password
+ CREATE TABLE IF NOT EXISTS password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash  text NOT NULL UNIQUE, -- SHA-256 of the token, see HashToken
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    constraint validate_password_reset_token_hash CHECK (token_hash ~ '^[0-9a-f]{64}$')
+);
+create index password_resets_user_id on password_resets(user_id);
+
+-- create table user_totp, the authenticator of a user, enabled once confirmed_at is set
+ CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret  text NOT NULL, -- base32, see NewTOTPSecret
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    confirmed_at TIMESTAMP,
+    last_step BIGINT -- time step of the last code used, so a code works only once
+);
+
+-- create table recovery_codes, one-time codes for when the authenticator is lost
+ CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash  text NOT NULL, -- bcrypt of the code, see hashRecoveryCode
+    used_at TIMESTAMP
+);
+create index recovery_codes_user_id on recovery_codes(user_id);
+
+-- create table login_attempts, the failed logins per username and IP when
+-- LOGIN_ATTEMPT_STORE is sql, see LoginPolicy
+ CREATE TABLE IF NOT EXISTS login_attempts (
+    key text PRIMARY KEY, -- `user:<username>` or `ip:<address>`
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    blocked_until TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
 
 -- create table borrow_history
  CREATE TABLE IF NOT EXISTS borrow_history (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    copy_id INT NOT NULL REFERENCES book_copies(id) ON DELETE CASCADE,
     borrowed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    due_at TIMESTAMPTZ NOT NULL,
+    returned_at TIMESTAMPTZ,
     returned BOOLEAN NOT NULL DEFAULT FALSE, 
-    constraint unique_book_per_borrower UNIQUE(book_id, user_id)
+    renewal_count INT NOT NULL DEFAULT 0
+);
+-- a borrower can borrow the same book again after returning it, but not twice at the same time
+create unique index borrow_history_one_active_loan on borrow_history(book_id, user_id) where not returned;
+create index borrow_history_user_book on borrow_history(user_id, book_id);
+create index borrow_history_overdue on borrow_history(due_at) where not returned;
+
+-- create table loan_renewals, one row per due date extension
+ CREATE TABLE IF NOT EXISTS loan_renewals (
+    id SERIAL PRIMARY KEY,
+    borrow_history_id INT NOT NULL REFERENCES borrow_history(id) ON DELETE CASCADE,
+    renewed_by INT REFERENCES users(id) ON DELETE SET NULL,
+    previous_due_at TIMESTAMPTZ NOT NULL,
+    new_due_at TIMESTAMPTZ NOT NULL,
+    renewed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+-- create table holds, the FIFO reservation queue of each book
+ CREATE TABLE IF NOT EXISTS holds (
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    copy_id INT REFERENCES book_copies(id) ON DELETE SET NULL,
+    status  text NOT NULL DEFAULT 'waiting',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ready_at TIMESTAMPTZ,
+    pickup_by TIMESTAMPTZ,
+    closed_at TIMESTAMPTZ,
+    constraint validate_hold_status CHECK (status IN ('waiting','ready','fulfilled','cancelled','expired'))
+);
+create unique index holds_one_active_per_user on holds(book_id, user_id) where status in ('waiting','ready');
+create index holds_queue on holds(book_id, id) where status = 'waiting';
+
+-- create table fines, the fee ledger of each user. amounts are in the smallest currency unit,
+-- charges are positive, payments and waivers negative, the balance is their sum
+ CREATE TABLE IF NOT EXISTS fines (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    borrow_history_id INT REFERENCES borrow_history(id) ON DELETE SET NULL,
+    kind  text NOT NULL,
+    amount BIGINT NOT NULL,
+    note  text NOT NULL DEFAULT '',
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    constraint validate_fine_kind CHECK (kind IN ('charge','payment','waiver')),
+    constraint validate_fine_amount CHECK ((kind = 'charge' AND amount > 0) OR (kind <> 'charge' AND amount < 0))
+);
+create index fines_user_id on fines(user_id, id);
+
+-- create table audit_log, who changed what. actor_id has no foreign key so the
+-- entries of removed users are kept, actor is their username at the time
+ CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INT,
+    actor  text NOT NULL DEFAULT '',
+    action  text NOT NULL,
+    entity  text NOT NULL DEFAULT '',
+    entity_id BIGINT,
+    changes jsonb NOT NULL DEFAULT '{}',
+    ip  text NOT NULL DEFAULT '',
+    request_id  text NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+create index audit_log_actor_id on audit_log(actor_id, id);
+create index audit_log_entity on audit_log(entity, entity_id, id);
+create index audit_log_created_at on audit_log(created_at);
+CREATE OR REPLACE FUNCTION forbid_audit_log_change()
+RETURNS TRIGGER AS $$
+BEGIN
+   RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ language 'plpgsql';
+create trigger audit_log_append_only before UPDATE OR DELETE on audit_log for each statement execute procedure forbid_audit_log_change();
+create trigger audit_log_no_truncate before TRUNCATE on audit_log for each statement execute procedure forbid_audit_log_change();
+
 commit ;
\ No newline at end of file
@@ -11,6 +11,7 @@ require (
 	github.com/minio/minio-go/v7 v7.0.69
 	github.com/rs/cors v1.10.1
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.19.0
 )
 
 require (
@@ -24,7 +25,6 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/rs/xid v1.5.0 // indirect
-	golang.org/x/crypto v0.19.0 // indirect
 	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
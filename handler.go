@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,41 +22,74 @@ import (
 type Handler struct {
 	*BaseHandler
 	BookStore
+	CopyStore
 	UserStore
 	SessionStore
 	BorrowHistoryStore
-	LoginDurationInSecond     int64
-	maxRequestBodySize        int64
-	maxBooksEachUserCanBorrow int64
+	HoldStore
+	FineStore
+	AuthorStore
+	CategoryStore
+	AuditStore
+	RoleStore
+	TOTPStore
+	LoginAttemptStore
+	SessionPolicy      SessionPolicy
+	PasswordPolicy     PasswordPolicy
+	LoginPolicy        LoginPolicy
+	maxRequestBodySize int64
+	trustProxyHeaders  bool
+	totpIssuer         string
 	ImageStore
 }
 
-func NewHandler(sessionStore SessionStore, book BookStore, user UserStore, bh BorrowHistoryStore, imageStore ImageStore, loginDurationInSecond, maxBooksEachUserCanBorrow int64) *Handler {
+func NewHandler(sessionStore SessionStore, book BookStore, copyStore CopyStore, user UserStore, bh BorrowHistoryStore, holdStore HoldStore, fineStore FineStore, authorStore AuthorStore, categoryStore CategoryStore, auditStore AuditStore, roleStore RoleStore, totpStore TOTPStore, loginAttemptStore LoginAttemptStore, imageStore ImageStore, sessionPolicy SessionPolicy, passwordPolicy PasswordPolicy, loginPolicy LoginPolicy) *Handler {
 	return &Handler{
-		BookStore:                 book,
-		UserStore:                 user,
-		SessionStore:              sessionStore,
-		BorrowHistoryStore:        bh,
-		BaseHandler:               NewBaseHandler(),
-		LoginDurationInSecond:     loginDurationInSecond,
-		ImageStore:                imageStore,
-		maxRequestBodySize:        getMaxRequestBodySize(),
-		maxBooksEachUserCanBorrow: maxBooksEachUserCanBorrow,
+		BookStore:          book,
+		CopyStore:          copyStore,
+		UserStore:          user,
+		SessionStore:       sessionStore,
+		BorrowHistoryStore: bh,
+		HoldStore:          holdStore,
+		FineStore:          fineStore,
+		AuthorStore:        authorStore,
+		CategoryStore:      categoryStore,
+		AuditStore:         auditStore,
+		RoleStore:          roleStore,
+		TOTPStore:          totpStore,
+		LoginAttemptStore:  loginAttemptStore,
+		BaseHandler:        NewBaseHandler(),
+		SessionPolicy:      sessionPolicy,
+		PasswordPolicy:     passwordPolicy,
+		LoginPolicy:        loginPolicy,
+		ImageStore:         imageStore,
+		maxRequestBodySize: getMaxRequestBodySize(),
+		trustProxyHeaders:  os.Getenv("TRUST_PROXY_HEADERS") == "true",
+		totpIssuer:         getTOTPIssuer(),
 	}
 }
 
 const cookieName = "session"
 
+// maxUserAgentLength caps the user agent kept with a session
+const maxUserAgentLength = 512
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+// LoginResponse is the session logged in with. With MFARequired the session
+// is only good for POST /login/totp until the user enters a code, with
+// TOTPSetupRequired only for setting up TOTP, which the role of the user requires.
 type LoginResponse struct {
-	SessionID string    `json:"session_id"`
-	UserID    int64     `json:"user_id"`
-	ExpiredAt time.Time `json:"expired_at"`
-	UserType  string    `json:"user_type"`
+	SessionID         string      `json:"session_id"`
+	UserID            int64       `json:"user_id"`
+	ExpiredAt         time.Time   `json:"expired_at"`
+	UserType          string      `json:"user_type"`
+	Permissions       Permissions `json:"permissions"`
+	MFARequired       bool        `json:"mfa_required"`
+	TOTPSetupRequired bool        `json:"totp_setup_required"`
 }
 
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
@@ -63,23 +102,78 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	user, err := h.UserStore.GetUserByCreds(req.Username, req.Password)
+	keys := []string{userLoginKey(req.Username), "ip:" + clientIP(r, h.trustProxyHeaders)}
+	if retryAfter := h.loginRetryAfter(logger, keys); retryAfter > 0 {
+		logger.WithField("retry_after", retryAfter).Info("login blocked")
+		h.JSONTooManyRequests(w, retryAfter)
+		return
+	}
+	user, err := h.UserStore.GetUserByUsername(req.Username)
 	if err != nil {
-		logger.WithError(err).Info("get user by creds")
+		logger.WithError(err).Info("get user by username")
+		VerifyPassword(dummyPasswordHash, req.Password)
+		h.recordLoginFailure(logger, keys)
 		h.JSONUnauthorized(w, "wrong username/ password")
 		return
 	}
-	sessionID := fmt.Sprintf("session-%d-%d-%s", user.ID, time.Now().Unix(), randomString(10))
+	ok, needsRehash := VerifyPassword(user.Password, req.Password)
+	if !ok {
+		logger.Info("wrong password")
+		h.recordLoginFailure(logger, keys)
+		h.JSONUnauthorized(w, "wrong username/ password")
+		return
+	}
+	// the IP keeps its failures, a valid account must not clear them for guesses at others
+	if err := h.LoginAttemptStore.ResetAttempts(keys[0]); err != nil {
+		logger.WithError(err).Error("reset login attempts")
+	}
+	if needsRehash {
+		if err := h.UserStore.UpdatePassword(user.ID, req.Password); err != nil {
+			logger.WithError(err).Error("upgrade password hash")
+		}
+	}
+	role, err := h.RoleStore.GetRole(user.Type)
+	if err != nil {
+		logger.WithError(err).Info("get role")
+		h.JSONInternalServerError(w, "create session failed")
+		return
+	}
+	totp, err := h.TOTPStore.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get totp")
+		h.JSONInternalServerError(w, "create session failed")
+		return
+	}
+	mfaRequired := totp.Enabled()
+	sessionID, err := NewToken()
+	if err != nil {
+		logger.WithError(err).Error("generate session token")
+		h.JSONInternalServerError(w, "create session failed")
+		return
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
 	err = h.SessionStore.CreateSession(Session{
-		UserID:    user.ID,
-		SessionID: sessionID,
+		UserID:     user.ID,
+		TokenHash:  HashToken(sessionID),
+		UserAgent:  userAgent,
+		IP:         clientIP(r, h.trustProxyHeaders),
+		MFAPending: mfaRequired,
 	})
 	if err != nil {
 		logger.WithError(err).Info("create session")
 		h.JSONInternalServerError(w, "create session failed")
 		return
 	}
-	expiredAt := time.Now().Add(time.Duration(h.LoginDurationInSecond) * time.Second)
+	setAuditActor(r, user.ID, user.UserName)
+	if mfaRequired {
+		h.audit(r, "session.login_password", "user", user.ID, nil, nil)
+	} else {
+		h.audit(r, "session.login", "user", user.ID, nil, nil)
+	}
+	expiredAt := h.SessionPolicy.ExpiresAt(time.Now())
 	http.SetCookie(w, &http.Cookie{
 		Name:     cookieName,
 		Value:    sessionID,
@@ -88,230 +182,322 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 		Secure:   true,
 	})
+	permissions := role.Permissions
+	setupRequired := role.RequireTOTP && !mfaRequired
+	if mfaRequired {
+		permissions = Permissions{}
+	} else if setupRequired {
+		permissions = Permissions{PermAccount}
+	}
 	h.JSONOK(w, LoginResponse{
-		SessionID: sessionID,
-		UserID:    user.ID,
-		ExpiredAt: expiredAt,
-		UserType:  user.Type,
+		SessionID:         sessionID,
+		UserID:            user.ID,
+		ExpiredAt:         expiredAt,
+		UserType:          user.Type,
+		Permissions:       permissions,
+		MFARequired:       mfaRequired,
+		TOTPSetupRequired: setupRequired,
 	})
 }
 
-func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
-	var logger = logrus.WithFields(logrus.Fields{"route": "/logout"})
+// TOTPCodeRequest carries a code of the authenticator app, or a recovery code
+// when the app is lost
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// VerifyLoginTOTP finishes a login of a user with TOTP, the session of the
+// cookie works once the code is right
+func (h *Handler) VerifyLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "invalid request")
+		return
+	}
+	defer r.Body.Close()
 	cookie, err := r.Cookie(cookieName)
 	if err != nil {
 		logger.WithError(err).Info("get cookie")
-		h.JSONBadRequest(w, "get cookie failed")
+		h.JSONUnauthorized(w, "unauthorized")
+		return
+	}
+	usersession, err := h.SessionStore.GetUserBySession(cookie.Value)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("session expired")
+		h.JSONUnauthorized(w, "session expired, login again")
 		return
 	}
-	err = h.SessionStore.DeleteSession(cookie.Value)
 	if err != nil {
-		logger.WithError(err).Info("logout failed")
-		h.JSONBadRequest(w, "logout failed")
+		logger.WithError(err).Info("get user by session")
+		h.JSONInternalServerError(w, "verify code failed")
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:   cookieName,
-		Value:  "deleted",
-		MaxAge: -1,
+	if !usersession.MFAPending {
+		logger.Info("session already verified")
+		h.JSONStatusConflict(w, "the session is verified already")
+		return
+	}
+	if !h.verifySecondFactor(logger, w, usersession.UserID, req) {
+		return
+	}
+	err = h.SessionStore.VerifySession(usersession.SessionID)
+	if err != nil {
+		logger.WithError(err).Info("verify session")
+		h.JSONInternalServerError(w, "verify code failed")
+		return
+	}
+	setAuditActor(r, usersession.UserID, usersession.UserName)
+	h.audit(r, "session.login", "user", usersession.UserID, nil, map[string]bool{"recovery_code": req.RecoveryCode != ""})
+	h.JSONOK(w, LoginResponse{
+		SessionID:   cookie.Value,
+		UserID:      usersession.UserID,
+		ExpiredAt:   h.SessionPolicy.ExpiresAt(usersession.SessionCreatedAt),
+		UserType:    usersession.UserType,
+		Permissions: usersession.Permissions,
 	})
-	h.JSONOK(w, struct{}{})
 }
 
-func (h *Handler) GenerateAuthMiddleware(userType string) mux.MiddlewareFunc {
-	return func(next http.Handler) http.Handler {
-		return h.AuthMiddleware(next, userType)
-	}
+// totpAttemptKey is the key wrong codes of a user are counted under, they are
+// throttled like failed logins
+func totpAttemptKey(userID int64) string {
+	return "totp:" + strconv.FormatInt(userID, 10)
 }
 
-func (h *Handler) AuthMiddleware(next http.Handler, userType string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var logger = logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-		cookie, err := r.Cookie(cookieName)
-		if err != nil {
-			logger.WithError(err).Info("get cookie")
-			h.JSONUnauthorized(w, "unauthorized")
-			return
+// verifySecondFactor checks the TOTP or recovery code of the request for the
+// user, each code works only once. It writes the error response when it fails.
+func (h *Handler) verifySecondFactor(logger *logrus.Entry, w http.ResponseWriter, userID int64, req TOTPCodeRequest) bool {
+	keys := []string{totpAttemptKey(userID)}
+	if retryAfter := h.loginRetryAfter(logger, keys); retryAfter > 0 {
+		logger.WithField("retry_after", retryAfter).Info("totp blocked")
+		h.JSONTooManyRequests(w, retryAfter)
+		return false
+	}
+	totp, err := h.TOTPStore.GetTOTP(userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !totp.Enabled()) {
+		logger.Info("totp not enabled")
+		h.JSONStatusConflict(w, "two-factor authentication is not enabled")
+		return false
+	}
+	if err != nil {
+		logger.WithError(err).Info("get totp")
+		h.JSONInternalServerError(w, "verify code failed")
+		return false
+	}
+	if req.RecoveryCode != "" {
+		err = h.TOTPStore.UseRecoveryCode(userID, req.RecoveryCode)
+	} else if step, ok := verifyTOTP(totp.Secret, req.Code, time.Now()); ok {
+		err = h.TOTPStore.UseTOTPStep(userID, step)
+	} else {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrTOTPCodeUsed) {
+		logger.WithError(err).Info("wrong code")
+		h.recordLoginFailure(logger, keys)
+		if errors.Is(err, ErrTOTPCodeUsed) {
+			h.JSONUnauthorized(w, err.Error())
+		} else {
+			h.JSONUnauthorized(w, "wrong code")
 		}
-		usersession, err := h.SessionStore.GetUserBySession(cookie.Value)
+		return false
+	}
+	if err != nil {
+		logger.WithError(err).Info("use code")
+		h.JSONInternalServerError(w, "verify code failed")
+		return false
+	}
+	if err := h.LoginAttemptStore.ResetAttempts(keys[0]); err != nil {
+		logger.WithError(err).Error("reset totp attempts")
+	}
+	return true
+}
+
+// userLoginKey is the key failed logins of a username are counted under
+func userLoginKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// loginRetryAfter is how long the longest blocked of keys stays blocked. Logins
+// are let through when the attempts can't be read.
+func (h *Handler) loginRetryAfter(logger *logrus.Entry, keys []string) time.Duration {
+	var longest time.Duration
+	for _, key := range keys {
+		retryAfter, err := h.LoginAttemptStore.RetryAfter(key)
 		if err != nil {
-			logger.WithError(err).Info("get user by session")
-			h.JSONUnauthorized(w, "session expired")
-			return
+			logger.WithError(err).Error("read login attempts")
+			continue
 		}
-		if usersession.SessionCreatedAt.Add(time.Duration(h.LoginDurationInSecond) * time.Second).Before(time.Now()) {
-			logger.Info("session expired")
-			http.SetCookie(w, &http.Cookie{
-				Name:   cookieName,
-				Value:  "deleted",
-				MaxAge: -1,
-			})
-			h.JSONUnauthorized(w, "session expired")
-			return
+		if retryAfter > longest {
+			longest = retryAfter
 		}
-		if usersession.UserType == Librarian && userType == Admin ||
-			usersession.UserType == Borrower && userType != Borrower {
-			logger.Info("unauthorized")
-			h.JSONUnauthorized(w, "unauthorized")
-			return
+	}
+	return longest
+}
 
+func (h *Handler) recordLoginFailure(logger *logrus.Entry, keys []string) {
+	for _, key := range keys {
+		blocked, err := h.LoginAttemptStore.RecordFailure(key)
+		if err != nil {
+			logger.WithError(err).Error("record failed login")
+			continue
 		}
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user", usersession)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+		if blocked >= h.LoginPolicy.Lockout {
+			logger.WithField("key", key).Warn("locked out after too many failed logins")
+		}
+	}
 }
 
-func (h *Handler) AddBook(w http.ResponseWriter, r *http.Request) {
+// UnlockUser lets a user locked out by failed logins try again right away
+func (h *Handler) UnlockUser(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	var req Book
-	err := json.NewDecoder(r.Body).Decode(&req)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		logger.WithError(err).Info("failed to decode request body")
-		h.JSONBadRequest(w, "invalid request")
-		return
-	}
-	defer r.Body.Close()
-	id, iErr := h.BookStore.AddBook(req)
-	if iErr != nil {
-		logger.WithError(iErr).Info("add book failed")
-		h.JSONInternalServerError(w, "add book failed")
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
 		return
 	}
-	book, bErr := h.BookStore.GetBookDetails(id)
-	if bErr != nil {
-		logger.WithError(bErr).Info("get book details failed")
-		h.JSONInternalServerError(w, "get book details failed")
+	user, err := h.UserStore.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONNotFound(w, "user not found")
 		return
 	}
-	h.JSONOK(w, book)
-}
-
-func (h *Handler) UpdateBook(w http.ResponseWriter, r *http.Request) {
-	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	var req Book
-	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		logger.WithError(err).Info("failed to decode request body")
-		h.JSONBadRequest(w, "decode json failed")
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
 		return
 	}
-	defer r.Body.Close()
-	iErr := h.BookStore.UpdateBook(req)
-	if iErr != nil {
-		logger.WithError(iErr).Info("update book failed")
-		h.JSONInternalServerError(w, "update book failed")
+	if err := h.authorizeUserOperations(user, logger, "unlock", w, r); err != nil {
+		logger.Info("unauthorized")
 		return
 	}
-	book, bErr := h.BookStore.GetBookDetails(req.ID)
-	if bErr != nil {
-		logger.WithError(bErr).Info("get book details failed")
-		h.JSONInternalServerError(w, "get book details failed")
+	if err := h.LoginAttemptStore.ResetAttempts(userLoginKey(user.UserName)); err != nil {
+		logger.WithError(err).Info("unlock user failed")
+		h.JSONInternalServerError(w, "unlock user failed")
 		return
 	}
-	h.JSONOK(w, book)
+	h.audit(r, "user.unlock", "user", id, nil, nil)
+	h.JSONOK(w, map[string]int64{"id": id})
 }
 
-func (h *Handler) RemoveBook(w http.ResponseWriter, r *http.Request) {
-	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	bookID := mux.Vars(r)["id"]
-	id, err := strconv.ParseInt(bookID, 10, 64)
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	var logger = logrus.WithFields(logrus.Fields{"route": "/logout"})
+	cookie, err := r.Cookie(cookieName)
 	if err != nil {
-		logger.WithError(err).Info("failed to parse book id")
-		h.JSONBadRequest(w, "invalid request")
+		logger.WithError(err).Info("get cookie")
+		h.JSONBadRequest(w, "get cookie failed")
 		return
 	}
-	err = h.BookStore.RemoveBook(id)
+	err = h.SessionStore.DeleteSession(cookie.Value)
 	if err != nil {
-		logger.WithError(err).Info("remove book failed")
-		h.JSONInternalServerError(w, "remove book failed")
+		logger.WithError(err).Info("logout failed")
+		h.JSONBadRequest(w, "logout failed")
 		return
 	}
-	h.JSONOK(w, map[string]int64{"id": id})
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieName,
+		Value:  "deleted",
+		MaxAge: -1,
+	})
+	h.JSONOK(w, struct{}{})
 }
 
-func (h *Handler) GetBookDetails(w http.ResponseWriter, r *http.Request) {
+// ListMySessions lists the devices the requestor is logged in on
+func (h *Handler) ListMySessions(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	bookID := mux.Vars(r)["id"]
-	id, err := strconv.ParseInt(bookID, 10, 64)
+	user := r.Context().Value("user").(GetSessionResponse)
+	sessions, err := h.SessionStore.ListSessions(user.UserID)
 	if err != nil {
-		logger.WithError(err).Info("failed to parse book id")
-		h.JSONBadRequest(w, "parse book id failed")
+		logger.WithError(err).Info("list sessions failed")
+		h.JSONInternalServerError(w, "list sessions failed")
 		return
 	}
-	book, err := h.BookStore.GetBookDetails(id)
-	if err != nil {
-		logger.WithError(err).Info("get book failed")
-		h.JSONInternalServerError(w, "remove book failed")
-		return
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == user.SessionID
 	}
-	h.JSONOK(w, book)
+	h.JSONOK(w, sessions)
 }
 
-func (h *Handler) ListMyBooks(w http.ResponseWriter, r *http.Request) {
+// RevokeMySession logs the requestor out of one of their sessions, revoking the
+// current one is the same as logging out
+func (h *Handler) RevokeMySession(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse session id")
+		h.JSONBadRequest(w, "parse session id failed")
+		return
+	}
 	user := r.Context().Value("user").(GetSessionResponse)
-	lastID, limit := parseLastIDLimit(r, logger)
-	books, err := h.BorrowHistoryStore.ListAllBorrowHistoryByUserID(user.UserID, lastID, limit)
+	err = h.SessionStore.RevokeSession(user.UserID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("revoke session failed")
+		h.JSONNotFound(w, "session not found")
+		return
+	}
 	if err != nil {
-		logger.WithError(err).Info("list borrowing list failed")
-		h.JSONInternalServerError(w, "list borrowing list failed")
+		logger.WithError(err).Info("revoke session failed")
+		h.JSONInternalServerError(w, "revoke session failed")
 		return
 	}
-	h.JSONOK(w, books)
+	if id == user.SessionID {
+		http.SetCookie(w, &http.Cookie{
+			Name:   cookieName,
+			Value:  "deleted",
+			MaxAge: -1,
+		})
+	}
+	h.audit(r, "session.revoke", "session", id, nil, nil)
+	h.JSONOK(w, map[string]int64{"id": id})
 }
 
-func (h *Handler) ListAllBooks(w http.ResponseWriter, r *http.Request) {
+// RevokeUserSessions logs a user out of every device
+func (h *Handler) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	lastID, limit := parseLastIDLimit(r, logger)
-	order := "desc"
-	if r.URL.Query().Get("ord") == "asc" {
-		order = "asc"
-	}
-	books, err := h.BookStore.ListBooks(lastID, limit, order)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		logger.WithError(err).Info("list books failed")
-		h.JSONInternalServerError(w, "list books failed")
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	user, err := h.UserStore.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONNotFound(w, "user not found")
 		return
 	}
-	h.JSONOK(w, books)
-}
-
-func parseLastIDLimit(r *http.Request, logger *logrus.Entry) (int64, int64) {
-	lastID, err := strconv.ParseInt(r.URL.Query().Get("lastID"), 10, 64)
 	if err != nil {
-		logger.Debugf("failed to parse lastID, use default 0 lastID")
-		lastID = 0
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
 	}
-	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err := h.authorizeUserOperations(user, logger, "log out", w, r); err != nil {
+		logger.Info("unauthorized")
+		return
+	}
+	revoked, err := h.SessionStore.RevokeUserSessions(id)
 	if err != nil {
-		logger.Debugf("failed to parse lastID, use default 10 limit")
-		limit = 10
+		logger.WithError(err).Info("revoke sessions failed")
+		h.JSONInternalServerError(w, "revoke sessions failed")
+		return
 	}
-	return lastID, limit
+	h.audit(r, "session.revoke_all", "user", id, nil, map[string]int64{"revoked": revoked})
+	h.JSONOK(w, map[string]int64{"revoked": revoked})
 }
 
-func (h *Handler) authorizeUserOperations(req User,
-	logger *logrus.Entry,
-	operation string,
-	w http.ResponseWriter,
-	r *http.Request) error {
-	user := r.Context().Value("user").(GetSessionResponse)
-	if user.UserType == Borrower {
-		h.JSONUnauthorized(w, fmt.Sprintf("borrower can't %s another user", operation))
-		return fmt.Errorf("unauthorized")
-	}
-	if user.UserType != Admin && (req.Type == Librarian || req.Type == Admin) {
-		logger.Info("unauthorized")
-		h.JSONUnauthorized(w, fmt.Sprintf("only admin can %s another admin or librarian", operation))
-		return fmt.Errorf("unauthorized")
-	}
-	return nil
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
 }
 
-func (h *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
+// ChangeMyPassword sets a new password for the requestor after checking the
+// current one, their other sessions are signed out
+func (h *Handler) ChangeMyPassword(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	var req User
+	var req ChangePasswordRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		logger.WithError(err).Info("failed to decode request body")
@@ -319,273 +505,2616 @@ func (h *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	if err := h.authorizeUserOperations(req, logger, "add", w, r); err != nil {
-		logger.Info("unauthorized")
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	user, err := h.UserStore.GetUserByUsername(requestor.UserName)
+	if err != nil {
+		logger.WithError(err).Info("get user failed")
+		h.JSONInternalServerError(w, "change password failed")
 		return
 	}
-	id, iErr := h.UserStore.AddUser(req)
-	if iErr != nil {
-		logger.WithError(iErr).Info("add user failed")
-		h.JSONInternalServerError(w, "add user failed")
+	if ok, _ := VerifyPassword(user.Password, req.CurrentPassword); !ok {
+		logger.Info("wrong current password")
+		h.JSONUnauthorized(w, "wrong current password")
 		return
 	}
-	user, bErr := h.UserStore.GetUserByID(id)
-	if bErr != nil {
-		logger.WithError(bErr).Info("get user details failed")
-		h.JSONInternalServerError(w, "get user details failed")
+	if err := h.PasswordPolicy.Check(req.NewPassword, user.UserName); err != nil {
+		logger.WithError(err).Info("weak password")
+		h.JSONBadRequest(w, err.Error())
 		return
 	}
-	h.JSONOK(w, user)
-}
-
-func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
-	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	var req User
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err = h.UserStore.ChangePassword(user.ID, req.NewPassword, requestor.SessionID)
 	if err != nil {
-		logger.WithError(err).Info("failed to decode request body")
-		h.JSONBadRequest(w, "decode json failed")
+		logger.WithError(err).Info("change password failed")
+		h.JSONInternalServerError(w, "change password failed")
 		return
 	}
-	defer r.Body.Close()
-	if err := h.authorizeUserOperations(req, logger, "update", w, r); err != nil {
-		logger.Info("unauthorized")
-		return
-	}
-	iErr := h.UserStore.UpdateUser(req)
-	if iErr != nil {
-		logger.WithError(iErr).Info("update user failed")
-		h.JSONInternalServerError(w, "add user failed")
-		return
-	}
-	user, bErr := h.UserStore.GetUserByID(req.ID)
-	if bErr != nil {
-		logger.WithError(bErr).Info("get user details failed")
-		h.JSONInternalServerError(w, "get user details failed")
-		return
-	}
-	h.JSONOK(w, user)
+	h.audit(r, "user.password_change", "user", user.ID, nil, nil)
+	h.JSONOK(w, "ok")
 }
 
-func (h *Handler) RemoveUser(w http.ResponseWriter, r *http.Request) {
+type PasswordResetResponse struct {
+	UserID    int64     `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssuePasswordReset creates a one-time token for the user to set a new
+// password with. The token is only shown in this response, staff hand it over.
+func (h *Handler) IssuePasswordReset(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	userID := mux.Vars(r)["id"]
-	id, err := strconv.ParseInt(userID, 10, 64)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		logger.WithError(err).Info("failed to parse user id")
 		h.JSONBadRequest(w, "parse user id failed")
 		return
 	}
 	user, err := h.UserStore.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONNotFound(w, "user not found")
+		return
+	}
 	if err != nil {
 		logger.WithError(err).Info("get user details failed")
 		h.JSONInternalServerError(w, "get user details failed")
 		return
 	}
-	if err := h.authorizeUserOperations(user, logger, "remove", w, r); err != nil {
+	if err := h.authorizeUserOperations(user, logger, "reset the password of", w, r); err != nil {
 		logger.Info("unauthorized")
 		return
 	}
-	err = h.UserStore.RemoveUser(id)
+	token, err := NewToken()
 	if err != nil {
-		logger.WithError(err).Info("remove user failed")
-		h.JSONInternalServerError(w, "remove user failed")
+		logger.WithError(err).Error("generate reset token")
+		h.JSONInternalServerError(w, "issue password reset failed")
 		return
 	}
-	h.JSONOK(w, map[string]int64{"id": id})
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	reset := PasswordReset{
+		UserID:    id,
+		TokenHash: HashToken(token),
+		CreatedBy: &requestor.UserID,
+		ExpiresAt: time.Now().Add(h.PasswordPolicy.ResetTokenTTL),
+	}
+	if err := h.UserStore.CreatePasswordReset(reset); err != nil {
+		logger.WithError(err).Info("issue password reset failed")
+		h.JSONInternalServerError(w, "issue password reset failed")
+		return
+	}
+	h.audit(r, "user.password_reset_issue", "user", id, nil, map[string]time.Time{"expires_at": reset.ExpiresAt})
+	h.JSONOK(w, PasswordResetResponse{UserID: id, Token: token, ExpiresAt: reset.ExpiresAt})
 }
 
-func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ResetPassword sets a new password with a reset token, the user is signed
+// out everywhere and logs in again with it
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	lastID, err := strconv.ParseInt(r.URL.Query().Get("lastID"), 10, 64)
+	var req ResetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		logger.WithError(err).Info("failed to parse lastID")
-		h.JSONBadRequest(w, "parse lastID failed")
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	reset, err := h.UserStore.GetPasswordReset(req.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get password reset failed")
+		h.JSONUnauthorized(w, ErrInvalidResetToken.Error())
 		return
 	}
-	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
 	if err != nil {
-		logger.WithError(err).Info("failed to parse limit")
-		h.JSONBadRequest(w, "parse limit failed")
+		logger.WithError(err).Info("get password reset failed")
+		h.JSONInternalServerError(w, "reset password failed")
 		return
 	}
-	user := r.Context().Value("user").(GetSessionResponse)
-	if user.UserType == Borrower {
-		logger.Info("unauthorized")
-		h.JSONUnauthorized(w, "borrower can't see other users")
+	user, err := h.UserStore.GetUserByID(reset.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONUnauthorized(w, ErrInvalidResetToken.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "reset password failed")
+		return
+	}
+	if err := h.PasswordPolicy.Check(req.NewPassword, user.UserName); err != nil {
+		logger.WithError(err).Info("weak password")
+		h.JSONBadRequest(w, err.Error())
 		return
 	}
-	var types []string = []string{Librarian, Borrower}
-	if user.UserType == Admin {
-		types = []string{Admin, Librarian, Borrower} // only admin can see all users
+	_, err = h.UserStore.ResetPassword(req.Token, req.NewPassword)
+	if errors.Is(err, ErrInvalidResetToken) {
+		logger.WithError(err).Info("reset password failed")
+		h.JSONUnauthorized(w, err.Error())
+		return
 	}
-	users, err := h.UserStore.ListUsers(lastID, limit, "desc", types)
 	if err != nil {
-		logger.WithError(err).Info("list users failed")
-		h.JSONInternalServerError(w, "list users failed")
+		logger.WithError(err).Info("reset password failed")
+		h.JSONInternalServerError(w, "reset password failed")
 		return
 	}
-	h.JSONOK(w, users)
+	setAuditActor(r, user.ID, user.UserName)
+	h.audit(r, "user.password_reset", "user", user.ID, nil, nil)
+	h.JSONOK(w, "ok")
 }
 
-func (h *Handler) GetUserByID(w http.ResponseWriter, r *http.Request) {
+type StartTOTPResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth URI to show as a QR code
+}
+
+// StartMyTOTP gives the requestor a new TOTP secret to add to their
+// authenticator app, TOTP is enabled once they confirm it with a code
+func (h *Handler) StartMyTOTP(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	userID := mux.Vars(r)["id"]
-	id, err := strconv.ParseInt(userID, 10, 64)
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	secret, err := NewTOTPSecret()
 	if err != nil {
-		logger.WithError(err).Info("failed to parse user id")
-		h.JSONBadRequest(w, "parse user id failed")
+		logger.WithError(err).Error("generate totp secret")
+		h.JSONInternalServerError(w, "start two-factor authentication failed")
+		return
+	}
+	err = h.TOTPStore.StartTOTP(requestor.UserID, secret)
+	if errors.Is(err, ErrTOTPEnabled) {
+		logger.WithError(err).Info("start totp failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("start totp failed")
+		h.JSONInternalServerError(w, "start two-factor authentication failed")
 		return
 	}
+	h.JSONOK(w, StartTOTPResponse{Secret: secret, URI: totpURI(h.totpIssuer, requestor.UserName, secret)})
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"` // only shown this once
+}
+
+// ConfirmMyTOTP enables TOTP for the requestor with the first code of their
+// authenticator app and hands out their recovery codes
+func (h *Handler) ConfirmMyTOTP(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
 	requestor := r.Context().Value("user").(GetSessionResponse)
-	if requestor.UserType == Borrower && requestor.UserID != id {
-		logger.Info("unauthorized")
-		h.JSONUnauthorized(w, "borrower can't see other users")
+	keys := []string{totpAttemptKey(requestor.UserID)}
+	if retryAfter := h.loginRetryAfter(logger, keys); retryAfter > 0 {
+		logger.WithField("retry_after", retryAfter).Info("totp blocked")
+		h.JSONTooManyRequests(w, retryAfter)
+		return
+	}
+	totp, err := h.TOTPStore.GetTOTP(requestor.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get totp failed")
+		h.JSONNotFound(w, "start setting up two-factor authentication first")
 		return
 	}
-	user, err := h.UserStore.GetUserByID(id)
 	if err != nil {
-		logger.WithError(err).Info("get user details failed")
-		h.JSONInternalServerError(w, "get user details failed")
+		logger.WithError(err).Info("get totp failed")
+		h.JSONInternalServerError(w, "confirm two-factor authentication failed")
 		return
 	}
-	if requestor.UserType == Librarian && user.Type == Admin {
-		logger.Info("user does not exist")
-		h.JSONNotFound(w, "user does not exist")
+	if totp.Enabled() {
+		logger.Info("totp enabled already")
+		h.JSONStatusConflict(w, ErrTOTPEnabled.Error())
 		return
 	}
-	h.JSONOK(w, user)
-}
-
-type PreviewRequestToBorrowBookResponse struct {
-	BookID                 int64  `json:"book_id"`
-	BookTitle              string `json:"book_title"`
-	BookCount              int    `json:"book_count"`
-	UserID                 int64  `json:"user_id"`
-	UserName               string `json:"username"`
-	UserBorrowedBooksCount int64  `json:"user_borrowed_books_count"`
+	step, ok := verifyTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		logger.Info("wrong code")
+		h.recordLoginFailure(logger, keys)
+		h.JSONUnauthorized(w, "wrong code")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		logger.WithError(err).Error("generate recovery codes")
+		h.JSONInternalServerError(w, "confirm two-factor authentication failed")
+		return
+	}
+	err = h.TOTPStore.ConfirmTOTP(requestor.UserID, step, hashes)
+	if errors.Is(err, ErrTOTPEnabled) {
+		logger.WithError(err).Info("confirm totp failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("confirm totp failed")
+		h.JSONInternalServerError(w, "confirm two-factor authentication failed")
+		return
+	}
+	if err := h.LoginAttemptStore.ResetAttempts(keys[0]); err != nil {
+		logger.WithError(err).Error("reset totp attempts")
+	}
+	h.audit(r, "user.totp_enable", "user", requestor.UserID, nil, nil)
+	h.JSONOK(w, RecoveryCodesResponse{RecoveryCodes: codes})
 }
 
-func (h *Handler) CountBorrowedBooksByUserID(w http.ResponseWriter, r *http.Request) {
+// DisableMyTOTP turns TOTP off for the requestor after a last code, unless
+// their role requires it
+func (h *Handler) DisableMyTOTP(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	userID := mux.Vars(r)["user_id"]
-	id, err := strconv.ParseInt(userID, 10, 64)
+	var req TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		logger.WithError(err).Info("failed to parse user id")
-		h.JSONBadRequest(w, "parse user id failed")
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
 		return
 	}
-	cnt, err := h.BorrowHistoryStore.CountActiveBorrowedBooksByUserID(id)
+	defer r.Body.Close()
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	if requestor.TOTPRequired {
+		logger.Info("totp required by role")
+		h.JSONStatusConflict(w, "your role requires two-factor authentication")
+		return
+	}
+	if !h.verifySecondFactor(logger, w, requestor.UserID, req) {
+		return
+	}
+	err = h.TOTPStore.DisableTOTP(requestor.UserID)
 	if err != nil {
-		logger.WithError(err).Info("count borrowed books")
-		h.JSONInternalServerError(w, "count borrowed books failed")
+		logger.WithError(err).Info("disable totp failed")
+		h.JSONInternalServerError(w, "disable two-factor authentication failed")
 		return
 	}
-	h.JSONOK(w, map[string]int64{"count": cnt})
+	h.audit(r, "user.totp_disable", "user", requestor.UserID, nil, nil)
+	h.JSONOK(w, "ok")
 }
 
-func (h *Handler) ListBorrowHistoryPerUser(w http.ResponseWriter, r *http.Request) {
+// RegenerateMyRecoveryCodes replaces the recovery codes of the requestor, the
+// old ones stop working
+func (h *Handler) RegenerateMyRecoveryCodes(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	lastID, limit := parseLastIDLimit(r, logger)
+	var req TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
 	requestor := r.Context().Value("user").(GetSessionResponse)
-	requestedUserIDStr := r.URL.Query().Get("userid")
-	requestedUserID, _ := strconv.ParseInt(requestedUserIDStr, 10, 64)
-	var borrowHistory []GetBorrowHistoryDetailResponse
-	var err error
-	if requestedUserID == 0 {
-		if requestor.UserType != Borrower {
-			borrowHistory, err = h.BorrowHistoryStore.ListAllBorrowHistory(lastID, limit)
-		} else {
-			borrowHistory, err = h.BorrowHistoryStore.ListAllBorrowHistoryByUserID(requestor.UserID, lastID, limit)
-		}
-	} else {
-		borrowHistory, err = h.BorrowHistoryStore.ListAllBorrowHistoryByUserID(requestedUserID, lastID, limit)
+	if !h.verifySecondFactor(logger, w, requestor.UserID, req) {
+		return
 	}
+	codes, hashes, err := newRecoveryCodes()
 	if err != nil {
-		logger.WithError(err).Info("list borrow history failed")
-		h.JSONInternalServerError(w, "list borrow history failed")
+		logger.WithError(err).Error("generate recovery codes")
+		h.JSONInternalServerError(w, "generate recovery codes failed")
 		return
 	}
-	h.JSONOK(w, borrowHistory)
+	err = h.TOTPStore.ReplaceRecoveryCodes(requestor.UserID, hashes)
+	if err != nil {
+		logger.WithError(err).Info("replace recovery codes failed")
+		h.JSONInternalServerError(w, "generate recovery codes failed")
+		return
+	}
+	h.audit(r, "user.recovery_codes_regenerate", "user", requestor.UserID, nil, nil)
+	h.JSONOK(w, RecoveryCodesResponse{RecoveryCodes: codes})
 }
 
-func (h *Handler) GetBorrowRecord(w http.ResponseWriter, r *http.Request) {
+// ResetUserTOTP turns TOTP off for a user who lost their authenticator and
+// recovery codes, they set it up again on their next login if their role requires it
+func (h *Handler) ResetUserTOTP(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	userIDStr := r.URL.Query().Get("user_id")
-	userID, err := strconv.ParseInt(userIDStr, 10, 64)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		logger.WithError(err).Info("failed to parse user id")
 		h.JSONBadRequest(w, "parse user id failed")
 		return
 	}
-	bookIDStr := r.URL.Query().Get("book_id")
-	bookID, err := strconv.ParseInt(bookIDStr, 10, 64)
+	user, err := h.UserStore.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONNotFound(w, "user not found")
+		return
+	}
 	if err != nil {
-		logger.WithError(err).Info("failed to parse book id")
-		h.JSONBadRequest(w, "parse user id failed")
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
 		return
 	}
-	requestor := r.Context().Value("user").(GetSessionResponse)
-	if requestor.UserType == Borrower {
+	if err := h.authorizeUserOperations(user, logger, "reset two-factor authentication of", w, r); err != nil {
 		logger.Info("unauthorized")
-		h.JSONUnauthorized(w, "borrower can't see borrow history")
 		return
 	}
-	borrowRecord, err := h.BorrowHistoryStore.GetBorrowHistory(userID, bookID)
+	err = h.TOTPStore.DisableTOTP(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("reset totp failed")
+		h.JSONNotFound(w, "two-factor authentication is not set up")
+		return
+	}
 	if err != nil {
-		logger.WithError(err).Info("get borrow record failed")
-		h.JSONInternalServerError(w, "get borrow record failed")
+		logger.WithError(err).Info("reset totp failed")
+		h.JSONInternalServerError(w, "reset two-factor authentication failed")
 		return
 	}
-	h.JSONOK(w, borrowRecord)
+	h.audit(r, "user.totp_reset", "user", id, nil, nil)
+	h.JSONOK(w, map[string]int64{"id": id})
+}
+
+// AuthMiddleware puts the user of the session in the context, what they may do
+// is checked per route with Authorize. A session still waiting for a TOTP code
+// is turned away, and a user whose role requires TOTP may only set it up until
+// they have.
+func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var logger = logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+		cookie, err := r.Cookie(cookieName)
+		if err != nil {
+			logger.WithError(err).Info("get cookie")
+			h.JSONUnauthorized(w, "unauthorized")
+			return
+		}
+		usersession, err := h.SessionStore.GetUserBySession(cookie.Value)
+		if errors.Is(err, sql.ErrNoRows) {
+			logger.WithError(err).Info("session expired")
+			http.SetCookie(w, &http.Cookie{
+				Name:   cookieName,
+				Value:  "deleted",
+				MaxAge: -1,
+			})
+			h.JSONUnauthorized(w, "session expired")
+			return
+		}
+		if err != nil {
+			logger.WithError(err).Info("get user by session")
+			h.JSONUnauthorized(w, "session expired")
+			return
+		}
+		if usersession.MFAPending {
+			logger.Info("two-factor code required")
+			h.JSONUnauthorized(w, "two-factor code required")
+			return
+		}
+		if usersession.TOTPRequired && !usersession.TOTPEnabled {
+			usersession.Permissions = Permissions{PermAccount}
+		}
+		setAuditActor(r, usersession.UserID, usersession.UserName)
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, "user", usersession)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
+// maxCopiesPerBook caps the copies AddBook creates in one request, more can be
+// added one by one
+const maxCopiesPerBook = 500
+
+type AddBookRequest struct {
+	Book
+	Copies int `json:"copies"` // number of copies to create with generated barcodes
 }
 
-func (h *Handler) BorrowBook(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) AddBook(w http.ResponseWriter, r *http.Request) {
 	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	var req BorrowHistory
+	var req AddBookRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		logger.WithError(err).Info("failed to decode request body")
-		h.JSONBadRequest(w, "decode json failed")
+		h.JSONBadRequest(w, "invalid request")
 		return
 	}
-	cnt, err := h.BorrowHistoryStore.CountActiveBorrowedBooksByUserID(req.UserID)
-	if err != nil {
-		logger.WithError(err).Info("count borrowed books")
-		h.JSONInternalServerError(w, "count borrowed books failed")
+	defer r.Body.Close()
+	if req.Copies < 0 || req.Copies > maxCopiesPerBook {
+		logger.WithField("copies", req.Copies).Info("invalid number of copies")
+		h.JSONBadRequest(w, fmt.Sprintf("copies must be between 0 and %d", maxCopiesPerBook))
 		return
 	}
-	if cnt >= h.maxBooksEachUserCanBorrow {
-		logger.Info("user has borrowed too many books")
-		h.JSONBadRequest(w, "user has borrowed too many books")
+	if vErr := validateBook(&req.Book); vErr != nil {
+		logger.WithError(vErr).Info("invalid book")
+		h.JSONBadRequest(w, vErr.Error())
 		return
 	}
-	err = h.BorrowHistoryStore.BorrowBook(req.UserID, req.BookID)
-	if err != nil {
-		logger.WithError(err).Info("borrow book failed")
-		h.JSONInternalServerError(w, "borrow book failed")
+	id, iErr := h.BookStore.AddBook(req.Book, req.Copies)
+	if isUniqueViolation(iErr) {
+		logger.WithError(iErr).Info("add book failed")
+		h.JSONStatusConflict(w, "a book with the same ISBN or title, author and edition already exists")
 		return
 	}
-	h.JSONOK(w, "ok")
-}
-
-func (h *Handler) ReturnBook(w http.ResponseWriter, r *http.Request) {
-	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
-	idstr := mux.Vars(r)["id"]
-	id, err := strconv.ParseInt(idstr, 10, 64)
-	if err != nil {
-		logger.WithError(err).Info("failed to parse borrow record id")
-		h.JSONBadRequest(w, "parse borrow record failed")
+	if errors.Is(iErr, ErrUnknownCategory) {
+		logger.WithError(iErr).Info("add book failed")
+		h.JSONUnprocessableEntity(w, iErr.Error())
 		return
 	}
-	err = h.BorrowHistoryStore.ReturnBook(id)
-	if err != nil {
-		logger.WithError(err).Info("update book failed")
-		h.JSONInternalServerError(w, "update book failed")
+	if iErr != nil {
+		logger.WithError(iErr).Info("add book failed")
+		h.JSONInternalServerError(w, "add book failed")
 		return
 	}
-	h.JSONOK(w, "ok")
+	book, bErr := h.BookStore.GetBookDetails(id)
+	if bErr != nil {
+		logger.WithError(bErr).Info("get book details failed")
+		h.JSONInternalServerError(w, "get book details failed")
+		return
+	}
+	h.audit(r, "book.create", "book", id, nil, book)
+	h.JSONOK(w, book)
+}
+
+func (h *Handler) UpdateBook(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req Book
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	if vErr := validateBook(&req); vErr != nil {
+		logger.WithError(vErr).Info("invalid book")
+		h.JSONBadRequest(w, vErr.Error())
+		return
+	}
+	before, bErr := h.BookStore.GetBookDetails(req.ID)
+	if errors.Is(bErr, sql.ErrNoRows) {
+		logger.WithError(bErr).Info("get book details failed")
+		h.JSONNotFound(w, "book not found")
+		return
+	}
+	if bErr != nil {
+		logger.WithError(bErr).Info("get book details failed")
+		h.JSONInternalServerError(w, "get book details failed")
+		return
+	}
+	iErr := h.BookStore.UpdateBook(req)
+	if isUniqueViolation(iErr) {
+		logger.WithError(iErr).Info("update book failed")
+		h.JSONStatusConflict(w, "a book with the same ISBN or title, author and edition already exists")
+		return
+	}
+	if errors.Is(iErr, ErrUnknownCategory) {
+		logger.WithError(iErr).Info("update book failed")
+		h.JSONUnprocessableEntity(w, iErr.Error())
+		return
+	}
+	if iErr != nil {
+		logger.WithError(iErr).Info("update book failed")
+		h.JSONInternalServerError(w, "update book failed")
+		return
+	}
+	book, bErr := h.BookStore.GetBookDetails(req.ID)
+	if bErr != nil {
+		logger.WithError(bErr).Info("get book details failed")
+		h.JSONInternalServerError(w, "get book details failed")
+		return
+	}
+	h.audit(r, "book.update", "book", book.ID, before, book)
+	h.JSONOK(w, book)
+}
+
+// validateBook normalizes the ISBN, the authors and the categories and checks
+// the bibliographic fields. A book without authors takes them from the legacy
+// author string, in which names are separated by semicolons, and a book without
+// categories takes the one named by the legacy type.
+func validateBook(book *Book) error {
+	if len(book.Categories) == 0 && book.Type != "" {
+		book.Categories = BookCategories{{Slug: book.Type}}
+	}
+	categories := BookCategories{}
+	seenCategories := make(map[string]bool)
+	for _, category := range book.Categories {
+		category.Slug = strings.ToLower(strings.TrimSpace(category.Slug))
+		key := fmt.Sprintf("%d/%s", category.ID, category.Slug)
+		if category.ID == 0 && category.Slug == "" || seenCategories[key] {
+			continue
+		}
+		seenCategories[key] = true
+		categories = append(categories, BookCategory{ID: category.ID, Slug: category.Slug})
+	}
+	book.Categories = categories
+	book.Type = ""
+	if len(categories) > 0 {
+		book.Type = categories[0].Slug
+	}
+	if len(book.Authors) == 0 && book.Author != "" {
+		for _, name := range strings.Split(book.Author, ";") {
+			book.Authors = append(book.Authors, BookAuthor{Name: name})
+		}
+	}
+	authors := BookAuthors{}
+	seen := make(map[string]bool)
+	for _, author := range book.Authors {
+		author.ID = 0
+		author.Name = strings.Join(strings.Fields(author.Name), " ")
+		if author.Role == "" {
+			author.Role = AuthorRoleAuthor
+		}
+		if author.Role != AuthorRoleAuthor && author.Role != AuthorRoleEditor && author.Role != AuthorRoleTranslator {
+			return fmt.Errorf("invalid author role %q, expect author, editor or translator", author.Role)
+		}
+		key := strings.ToLower(author.Name) + "\x00" + author.Role
+		if author.Name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		authors = append(authors, author)
+	}
+	book.Authors = authors
+	book.Author = authors.DisplayName()
+	if book.ISBN != "" {
+		isbn, err := NormalizeISBN(book.ISBN)
+		if err != nil {
+			return err
+		}
+		book.ISBN = isbn
+	}
+	if book.PublicationYear < 0 || book.PublicationYear > time.Now().Year()+1 {
+		return fmt.Errorf("invalid publication year: %d", book.PublicationYear)
+	}
+	if book.PageCount < 0 {
+		return fmt.Errorf("invalid page count: %d", book.PageCount)
+	}
+	return nil
+}
+
+func (h *Handler) RemoveBook(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	bookID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(bookID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse book id")
+		h.JSONBadRequest(w, "invalid request")
+		return
+	}
+	book, err := h.BookStore.GetBookDetails(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get book details failed")
+		h.JSONNotFound(w, "book not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get book details failed")
+		h.JSONInternalServerError(w, "get book details failed")
+		return
+	}
+	err = h.BookStore.RemoveBook(id)
+	if errors.Is(err, ErrActiveLoans) {
+		logger.WithError(err).Info("remove book failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("remove book failed")
+		h.JSONInternalServerError(w, "remove book failed")
+		return
+	}
+	h.audit(r, "book.remove", "book", id, book, nil)
+	h.JSONOK(w, map[string]int64{"id": id})
+}
+
+func (h *Handler) GetBookDetails(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	bookID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(bookID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse book id")
+		h.JSONBadRequest(w, "parse book id failed")
+		return
+	}
+	book, err := h.BookStore.GetBookDetails(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get book failed")
+		h.JSONNotFound(w, "book not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get book failed")
+		h.JSONInternalServerError(w, "get book failed")
+		return
+	}
+	h.JSONOK(w, book)
+}
+
+// GetBookByISBN accepts an ISBN-10 or ISBN-13, with or without hyphens
+func (h *Handler) GetBookByISBN(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	isbn, err := NormalizeISBN(mux.Vars(r)["isbn"])
+	if err != nil {
+		logger.WithError(err).Info("failed to parse isbn")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	book, err := h.BookStore.GetBookByISBN(isbn)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get book failed")
+		h.JSONNotFound(w, "no book with this ISBN")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get book failed")
+		h.JSONInternalServerError(w, "get book failed")
+		return
+	}
+	h.JSONOK(w, book)
+}
+
+func (h *Handler) ListMyBooks(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	user := r.Context().Value("user").(GetSessionResponse)
+	lastID, limit := parseLastIDLimit(r, logger)
+	books, err := h.BorrowHistoryStore.ListAllBorrowHistoryByUserID(user.UserID, lastID, limit)
+	if err != nil {
+		logger.WithError(err).Info("list borrowing list failed")
+		h.JSONInternalServerError(w, "list borrowing list failed")
+		return
+	}
+	h.JSONOK(w, books)
+}
+
+// ListAllBooks sorts by `sort` (id, title, author, type, created_at, updated_at
+// or available) in `ord` order, optionally filtered by `category` (or the legacy
+// `type`), including its subcategories, and `author`. The
+// cursor for the next page, if any, is returned in the X-Next-Cursor header and
+// goes back in as `cursor`.
+func (h *Handler) ListAllBooks(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	params := r.URL.Query()
+	opts := ListBooksOptions{
+		Sort:     params.Get("sort"),
+		Order:    params.Get("ord"),
+		Category: categoryParam(params),
+		Author:   params.Get("author"),
+		Cursor:   params.Get("cursor"),
+		Limit:    limit,
+		LastID:   lastID,
+	}
+	if opts.Sort == "" {
+		opts.Sort = "id"
+	}
+	if opts.Order == "" {
+		opts.Order = "desc"
+	}
+	books, nextCursor, err := h.BookStore.ListBooks(opts)
+	if errors.Is(err, ErrInvalidSort) || errors.Is(err, ErrInvalidCursor) {
+		logger.WithError(err).Info("list books failed")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("list books failed")
+		h.JSONInternalServerError(w, "list books failed")
+		return
+	}
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
+	h.JSONOK(w, books)
+}
+
+// SearchBooks matches `q` against title, author and type, optionally filtered by
+// `category` (or the legacy `type`), `author` and `available=true`. The cursor for the next page, if any,
+// is returned in the X-Next-Cursor header and goes back in as `cursor`.
+func (h *Handler) SearchBooks(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	_, limit := parseLastIDLimit(r, logger)
+	params := r.URL.Query()
+	search := BookSearch{
+		Query:     strings.TrimSpace(params.Get("q")),
+		Category:  categoryParam(params),
+		Author:    params.Get("author"),
+		Available: params.Get("available") == "true",
+		Cursor:    params.Get("cursor"),
+		Limit:     limit,
+	}
+	books, nextCursor, err := h.BookStore.SearchBooks(search)
+	if errors.Is(err, ErrInvalidCursor) {
+		logger.WithError(err).Info("search books failed")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("search books failed")
+		h.JSONInternalServerError(w, "search books failed")
+		return
+	}
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
+	h.JSONOK(w, books)
+}
+
+// categoryParam reads the category filter, `type` is its name from before categories
+func categoryParam(params url.Values) string {
+	if category := params.Get("category"); category != "" {
+		return category
+	}
+	return params.Get("type")
+}
+
+func parseLastIDLimit(r *http.Request, logger *logrus.Entry) (int64, int64) {
+	lastID, err := strconv.ParseInt(r.URL.Query().Get("lastID"), 10, 64)
+	if err != nil {
+		logger.Debugf("failed to parse lastID, use default 0 lastID")
+		lastID = 0
+	}
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil {
+		logger.Debugf("failed to parse lastID, use default 10 limit")
+		limit = 10
+	}
+	return lastID, limit
+}
+
+// accountScope limits the user routes of a resource to accounts of some roles,
+// the route table puts it in the request context
+type accountScope struct {
+	name        string
+	defaultRole string // for users added without a type
+	allows      func(role string) bool
+}
+
+var (
+	allAccounts      = accountScope{name: "user", allows: func(string) bool { return true }}
+	borrowerAccounts = accountScope{name: "borrower", defaultRole: Borrower, allows: func(role string) bool { return role == Borrower }}
+	staffAccounts    = accountScope{name: "staff", allows: func(role string) bool { return role != Borrower }}
+)
+
+// accountScopeOf is the scope of the route of r, every account when it has none
+func accountScopeOf(r *http.Request) accountScope {
+	if scope, ok := r.Context().Value("accounts").(accountScope); ok {
+		return scope
+	}
+	return allAccounts
+}
+
+// authorizeUserOperations checks that req is in the account scope of the route
+// and that the requestor may manage users of its role
+func (h *Handler) authorizeUserOperations(req User,
+	logger *logrus.Entry,
+	operation string,
+	w http.ResponseWriter,
+	r *http.Request) error {
+	if scope := accountScopeOf(r); !scope.allows(req.Type) {
+		logger.Info("out of account scope")
+		h.JSONUnprocessableEntity(w, fmt.Sprintf("%s accounts can't have the role %s", scope.name, req.Type))
+		return fmt.Errorf("out of account scope")
+	}
+	user := r.Context().Value("user").(GetSessionResponse)
+	if !user.Permissions.CanOnRole(PermUserManage, req.Type) {
+		logger.Info("unauthorized")
+		h.JSONUnauthorized(w, fmt.Sprintf("you can't %s a user with the role %s", operation, req.Type))
+		return fmt.Errorf("unauthorized")
+	}
+	return nil
+}
+
+func (h *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req User
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	if req.Type == "" {
+		req.Type = accountScopeOf(r).defaultRole
+	}
+	if err := h.authorizeUserOperations(req, logger, "add", w, r); err != nil {
+		logger.Info("unauthorized")
+		return
+	}
+	if err := h.PasswordPolicy.Check(req.Password, req.UserName); err != nil {
+		logger.WithError(err).Info("weak password")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	id, iErr := h.UserStore.AddUser(req)
+	if errors.Is(iErr, ErrUnknownRole) {
+		logger.WithError(iErr).Info("add user failed")
+		h.JSONUnprocessableEntity(w, fmt.Sprintf("unknown role %s", req.Type))
+		return
+	}
+	if iErr != nil {
+		logger.WithError(iErr).Info("add user failed")
+		h.JSONInternalServerError(w, "add user failed")
+		return
+	}
+	user, bErr := h.UserStore.GetUserByID(id)
+	if bErr != nil {
+		logger.WithError(bErr).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
+	}
+	h.audit(r, "user.create", "user", id, nil, user)
+	h.JSONOK(w, user)
+}
+
+func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req User
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	if userID, ok := mux.Vars(r)["id"]; ok {
+		req.ID, err = strconv.ParseInt(userID, 10, 64)
+		if err != nil {
+			logger.WithError(err).Info("failed to parse user id")
+			h.JSONBadRequest(w, "parse user id failed")
+			return
+		}
+	}
+	before, bErr := h.UserStore.GetUserByID(req.ID)
+	if errors.Is(bErr, sql.ErrNoRows) {
+		logger.WithError(bErr).Info("get user details failed")
+		h.JSONNotFound(w, "user not found")
+		return
+	}
+	if bErr != nil {
+		logger.WithError(bErr).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
+	}
+	// the fields left out are kept, the password too
+	if req.Email == "" {
+		req.Email = before.Email
+	}
+	if req.UserName == "" {
+		req.UserName = before.UserName
+	}
+	if req.Type == "" {
+		req.Type = before.Type
+	}
+	if req.Password != "" {
+		if err := h.PasswordPolicy.Check(req.Password, req.UserName); err != nil {
+			logger.WithError(err).Info("weak password")
+			h.JSONBadRequest(w, err.Error())
+			return
+		}
+	}
+	// changing the role needs the permission on the old one as well
+	if err := h.authorizeUserOperations(before, logger, "update", w, r); err != nil {
+		logger.Info("unauthorized")
+		return
+	}
+	if err := h.authorizeUserOperations(req, logger, "update", w, r); err != nil {
+		logger.Info("unauthorized")
+		return
+	}
+	iErr := h.UserStore.UpdateUser(req)
+	if errors.Is(iErr, ErrUnknownRole) {
+		logger.WithError(iErr).Info("update user failed")
+		h.JSONUnprocessableEntity(w, fmt.Sprintf("unknown role %s", req.Type))
+		return
+	}
+	if errors.Is(iErr, sql.ErrNoRows) {
+		logger.WithError(iErr).Info("update user failed")
+		h.JSONNotFound(w, "user not found")
+		return
+	}
+	if iErr != nil {
+		logger.WithError(iErr).Info("update user failed")
+		h.JSONInternalServerError(w, "update user failed")
+		return
+	}
+	user, bErr := h.UserStore.GetUserByID(req.ID)
+	if bErr != nil {
+		logger.WithError(bErr).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
+	}
+	h.audit(r, "user.update", "user", user.ID, before, user)
+	h.JSONOK(w, user)
+}
+
+func (h *Handler) RemoveUser(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	userID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	user, err := h.UserStore.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONNotFound(w, "user not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
+	}
+	if err := h.authorizeUserOperations(user, logger, "remove", w, r); err != nil {
+		logger.Info("unauthorized")
+		return
+	}
+	err = h.UserStore.RemoveUser(id)
+	if errors.Is(err, ErrActiveLoans) || errors.Is(err, ErrOutstandingBalance) {
+		logger.WithError(err).Info("remove user failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("remove user failed")
+		h.JSONInternalServerError(w, "remove user failed")
+		return
+	}
+	h.audit(r, "user.remove", "user", id, user, nil)
+	h.JSONOK(w, map[string]int64{"id": id})
+}
+
+// RestoreUser takes a removed user out of the trash
+func (h *Handler) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	deleted, err := h.UserStore.GetDeletedUser(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get deleted user failed")
+		h.JSONNotFound(w, "user not found in the trash")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get deleted user failed")
+		h.JSONInternalServerError(w, "get deleted user failed")
+		return
+	}
+	if err := h.authorizeUserOperations(deleted, logger, "restore", w, r); err != nil {
+		logger.Info("unauthorized")
+		return
+	}
+	err = h.UserStore.RestoreUser(id)
+	switch {
+	case isUniqueViolation(err):
+		logger.WithError(err).Info("restore user failed")
+		h.JSONStatusConflict(w, "another user has taken the email or username")
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("restore user failed")
+		h.JSONNotFound(w, "user not found in the trash")
+		return
+	case err != nil:
+		logger.WithError(err).Info("restore user failed")
+		h.JSONInternalServerError(w, "restore user failed")
+		return
+	}
+	user, err := h.UserStore.GetUserByID(id)
+	if err != nil {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
+	}
+	h.audit(r, "user.restore", "user", id, deleted, user)
+	h.JSONOK(w, user)
+}
+
+// ListDeletedUsers lists the users in the trash
+func (h *Handler) ListDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	users, err := h.UserStore.ListDeletedUsers(lastID, limit)
+	if err != nil {
+		logger.WithError(err).Info("list deleted users failed")
+		h.JSONInternalServerError(w, "list deleted users failed")
+		return
+	}
+	h.JSONOK(w, users)
+}
+
+// RestoreBook takes a removed book out of the trash
+func (h *Handler) RestoreBook(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse book id")
+		h.JSONBadRequest(w, "parse book id failed")
+		return
+	}
+	err = h.BookStore.RestoreBook(id)
+	switch {
+	case isUniqueViolation(err):
+		logger.WithError(err).Info("restore book failed")
+		h.JSONStatusConflict(w, "a book with the same ISBN or title, author and edition was added since")
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("restore book failed")
+		h.JSONNotFound(w, "book not found in the trash")
+		return
+	case err != nil:
+		logger.WithError(err).Info("restore book failed")
+		h.JSONInternalServerError(w, "restore book failed")
+		return
+	}
+	book, err := h.BookStore.GetBookDetails(id)
+	if err != nil {
+		logger.WithError(err).Info("get book details failed")
+		h.JSONInternalServerError(w, "get book details failed")
+		return
+	}
+	h.audit(r, "book.restore", "book", id, nil, book)
+	h.JSONOK(w, book)
+}
+
+// ListDeletedBooks lists the books in the trash
+func (h *Handler) ListDeletedBooks(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	books, err := h.BookStore.ListDeletedBooks(lastID, limit)
+	if err != nil {
+		logger.WithError(err).Info("list deleted books failed")
+		h.JSONInternalServerError(w, "list deleted books failed")
+		return
+	}
+	h.JSONOK(w, books)
+}
+
+func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, err := strconv.ParseInt(r.URL.Query().Get("lastID"), 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse lastID")
+		h.JSONBadRequest(w, "parse lastID failed")
+		return
+	}
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse limit")
+		h.JSONBadRequest(w, "parse limit failed")
+		return
+	}
+	user := r.Context().Value("user").(GetSessionResponse)
+	allowed, err := h.rolesAllowed(user, PermUserRead)
+	if err != nil {
+		logger.WithError(err).Info("list roles failed")
+		h.JSONInternalServerError(w, "list users failed")
+		return
+	}
+	var types []string
+	for _, role := range allowed {
+		if accountScopeOf(r).allows(role) {
+			types = append(types, role)
+		}
+	}
+	if len(types) == 0 {
+		h.JSONOK(w, []User{})
+		return
+	}
+	users, err := h.UserStore.ListUsers(lastID, limit, "desc", types)
+	if err != nil {
+		logger.WithError(err).Info("list users failed")
+		h.JSONInternalServerError(w, "list users failed")
+		return
+	}
+	h.JSONOK(w, users)
+}
+
+func (h *Handler) GetUserByID(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	userID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	if requestor.UserID != id && !requestor.Permissions.Can(PermUserRead) {
+		logger.Info("unauthorized")
+		h.JSONUnauthorized(w, "you can't see other users")
+		return
+	}
+	user, err := h.UserStore.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONNotFound(w, "user does not exist")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get user details failed")
+		h.JSONInternalServerError(w, "get user details failed")
+		return
+	}
+	if requestor.UserID != id && !requestor.Permissions.CanOnRole(PermUserRead, user.Type) || !accountScopeOf(r).allows(user.Type) {
+		logger.Info("user does not exist")
+		h.JSONNotFound(w, "user does not exist")
+		return
+	}
+	h.JSONOK(w, user)
+}
+
+type PreviewRequestToBorrowBookResponse struct {
+	BookID                 int64  `json:"book_id"`
+	BookTitle              string `json:"book_title"`
+	BookCount              int    `json:"book_count"`
+	UserID                 int64  `json:"user_id"`
+	UserName               string `json:"username"`
+	UserBorrowedBooksCount int64  `json:"user_borrowed_books_count"`
+}
+
+func (h *Handler) CountBorrowedBooksByUserID(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	userID := mux.Vars(r)["user_id"]
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	cnt, err := h.BorrowHistoryStore.CountActiveBorrowedBooksByUserID(id)
+	if err != nil {
+		logger.WithError(err).Info("count borrowed books")
+		h.JSONInternalServerError(w, "count borrowed books failed")
+		return
+	}
+	h.JSONOK(w, map[string]int64{"count": cnt})
+}
+
+func (h *Handler) ListBorrowHistoryPerUser(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	requestedUserIDStr := r.URL.Query().Get("userid")
+	requestedUserID, _ := strconv.ParseInt(requestedUserIDStr, 10, 64)
+	if requestedUserID != 0 && requestedUserID != requestor.UserID && !requestor.Permissions.Can(PermLoanRead) {
+		logger.Info("unauthorized")
+		h.JSONUnauthorized(w, "you can't see the borrow history of other users")
+		return
+	}
+	var borrowHistory []GetBorrowHistoryDetailResponse
+	var err error
+	if requestedUserID == 0 {
+		if requestor.Permissions.Can(PermLoanRead) {
+			borrowHistory, err = h.BorrowHistoryStore.ListAllBorrowHistory(lastID, limit)
+		} else {
+			borrowHistory, err = h.BorrowHistoryStore.ListAllBorrowHistoryByUserID(requestor.UserID, lastID, limit)
+		}
+	} else {
+		borrowHistory, err = h.BorrowHistoryStore.ListAllBorrowHistoryByUserID(requestedUserID, lastID, limit)
+	}
+	if err != nil {
+		logger.WithError(err).Info("list borrow history failed")
+		h.JSONInternalServerError(w, "list borrow history failed")
+		return
+	}
+	h.JSONOK(w, borrowHistory)
+}
+
+func (h *Handler) ListOverdue(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	overdue, err := h.BorrowHistoryStore.ListOverdue(lastID, limit)
+	if err != nil {
+		logger.WithError(err).Info("list overdue failed")
+		h.JSONInternalServerError(w, "list overdue failed")
+		return
+	}
+	h.JSONOK(w, overdue)
+}
+
+func (h *Handler) GetBorrowRecord(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	userIDStr := r.URL.Query().Get("user_id")
+	userID, err := strconv.ParseInt(userIDStr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	bookIDStr := r.URL.Query().Get("book_id")
+	bookID, err := strconv.ParseInt(bookIDStr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse book id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	borrowRecords, err := h.BorrowHistoryStore.GetBorrowHistory(userID, bookID)
+	if err != nil {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONInternalServerError(w, "get borrow record failed")
+		return
+	}
+	h.JSONOK(w, borrowRecords)
+
+}
+
+type BorrowBookRequest struct {
+	UserID  int64  `json:"user_id"`
+	BookID  int64  `json:"book_id"`
+	CopyID  int64  `json:"copy_id"`
+	Barcode string `json:"barcode"`
+}
+
+func (h *Handler) BorrowBook(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req BorrowBookRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	if req.CopyID == 0 && req.Barcode != "" {
+		bookCopy, err := h.CopyStore.GetCopyByBarcode(req.Barcode)
+		if err != nil {
+			logger.WithError(err).Info("get copy by barcode")
+			h.JSONNotFound(w, "copy not found")
+			return
+		}
+		req.CopyID = bookCopy.ID
+	}
+	if req.CopyID == 0 && req.BookID == 0 {
+		logger.Info("missing copy and book")
+		h.JSONBadRequest(w, "one of copy_id, barcode or book_id is required")
+		return
+	}
+	err = h.BorrowHistoryStore.BorrowBook(req.UserID, req.BookID, req.CopyID)
+	switch {
+	case errors.Is(err, ErrNoCopiesAvailable), errors.Is(err, ErrAlreadyBorrowing):
+		logger.WithError(err).Info("borrow book failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	case errors.Is(err, ErrBorrowLimitReached), errors.Is(err, ErrOutstandingFines), errors.Is(err, ErrCopyOfOtherBook):
+		logger.WithError(err).Info("borrow book failed")
+		h.JSONUnprocessableEntity(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("borrow book failed")
+		h.JSONNotFound(w, "user or copy not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("borrow book failed")
+		h.JSONInternalServerError(w, "borrow book failed")
+		return
+	}
+	h.audit(r, "loan.create", "user", req.UserID, nil, req)
+	h.JSONOK(w, "ok")
+}
+
+func (h *Handler) ReturnBook(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	idstr := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse borrow record id")
+		h.JSONBadRequest(w, "parse borrow record failed")
+		return
+	}
+	before, err := h.BorrowHistoryStore.GetBorrowHistoryByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONNotFound(w, "no active borrow record")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONInternalServerError(w, "get borrow record failed")
+		return
+	}
+	fee, err := h.BorrowHistoryStore.ReturnBook(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("return book failed")
+		h.JSONNotFound(w, "no active borrow record")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("update book failed")
+		h.JSONInternalServerError(w, "update book failed")
+		return
+	}
+	after, err := h.BorrowHistoryStore.GetBorrowHistoryByID(id)
+	if err != nil {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONInternalServerError(w, "get borrow record failed")
+		return
+	}
+	h.audit(r, "loan.return", "borrow_history", id, before, after)
+	h.JSONOK(w, map[string]int64{"id": id, "late_fee": fee})
+}
+
+func (h *Handler) ListCopies(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	bookID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(bookID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse book id")
+		h.JSONBadRequest(w, "parse book id failed")
+		return
+	}
+	copies, err := h.CopyStore.ListCopiesByBookID(id)
+	if err != nil {
+		logger.WithError(err).Info("list copies failed")
+		h.JSONInternalServerError(w, "list copies failed")
+		return
+	}
+	h.JSONOK(w, copies)
+}
+
+func (h *Handler) AddCopy(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	bookID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(bookID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse book id")
+		h.JSONBadRequest(w, "parse book id failed")
+		return
+	}
+	var req BookCopy
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	req.BookID = id
+	copyID, err := h.CopyStore.AddCopy(req)
+	if err != nil {
+		logger.WithError(err).Info("add copy failed")
+		h.JSONInternalServerError(w, "add copy failed")
+		return
+	}
+	bookCopy, err := h.CopyStore.GetCopy(copyID)
+	if err != nil {
+		logger.WithError(err).Info("get copy failed")
+		h.JSONInternalServerError(w, "get copy failed")
+		return
+	}
+	h.audit(r, "copy.create", "copy", copyID, nil, bookCopy)
+	h.JSONOK(w, bookCopy)
+}
+
+func (h *Handler) UpdateCopy(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req BookCopy
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	before, err := h.CopyStore.GetCopy(req.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get copy failed")
+		h.JSONNotFound(w, "copy not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get copy failed")
+		h.JSONInternalServerError(w, "get copy failed")
+		return
+	}
+	// fields left out of the request keep their value
+	if req.Barcode == "" {
+		req.Barcode = before.Barcode
+	}
+	if req.ShelfLocation == "" {
+		req.ShelfLocation = before.ShelfLocation
+	}
+	if req.Condition == "" {
+		req.Condition = before.Condition
+	}
+	err = h.CopyStore.UpdateCopy(req)
+	switch {
+	case errors.Is(err, ErrInvalidCopyStatus):
+		logger.WithError(err).Info("update copy failed")
+		h.JSONBadRequest(w, err.Error())
+		return
+	case errors.Is(err, ErrCopyBorrowed):
+		logger.WithError(err).Info("update copy failed")
+		h.JSONStatusConflict(w, ErrCopyBorrowed.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("update copy failed")
+		h.JSONNotFound(w, "copy not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("update copy failed")
+		h.JSONInternalServerError(w, "update copy failed")
+		return
+	}
+	bookCopy, err := h.CopyStore.GetCopy(req.ID)
+	if err != nil {
+		logger.WithError(err).Info("get copy failed")
+		h.JSONInternalServerError(w, "get copy failed")
+		return
+	}
+	h.audit(r, "copy.update", "copy", bookCopy.ID, before, bookCopy)
+	h.JSONOK(w, bookCopy)
+}
+
+// RetireCopy takes a damaged or withdrawn copy out of circulation, its loan history is kept
+func (h *Handler) RetireCopy(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	copyID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(copyID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse copy id")
+		h.JSONBadRequest(w, "parse copy id failed")
+		return
+	}
+	before, err := h.CopyStore.GetCopy(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get copy failed")
+		h.JSONNotFound(w, "copy not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get copy failed")
+		h.JSONInternalServerError(w, "get copy failed")
+		return
+	}
+	err = h.CopyStore.SetCopyStatus(id, CopyRetired)
+	if errors.Is(err, ErrCopyBorrowed) {
+		logger.WithError(err).Info("retire copy failed")
+		h.JSONStatusConflict(w, ErrCopyBorrowed.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("retire copy failed")
+		h.JSONInternalServerError(w, "retire copy failed")
+		return
+	}
+	after := before
+	after.Status = CopyRetired
+	h.audit(r, "copy.retire", "copy", id, before, after)
+	h.JSONOK(w, map[string]int64{"id": id})
+}
+
+func (h *Handler) RenewLoan(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	idstr := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse borrow record id")
+		h.JSONBadRequest(w, "parse borrow record failed")
+		return
+	}
+	h.renewLoan(w, r, logger, id)
+}
+
+// RenewMyLoan lets borrowers renew their own loans
+func (h *Handler) RenewMyLoan(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	idstr := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse borrow record id")
+		h.JSONBadRequest(w, "parse borrow record failed")
+		return
+	}
+	user := r.Context().Value("user").(GetSessionResponse)
+	loan, err := h.BorrowHistoryStore.GetBorrowHistoryByID(id)
+	if err != nil || loan.UserID != user.UserID {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONNotFound(w, "borrow record not found")
+		return
+	}
+	h.renewLoan(w, r, logger, id)
+}
+
+func (h *Handler) renewLoan(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, id int64) {
+	user := r.Context().Value("user").(GetSessionResponse)
+	before, err := h.BorrowHistoryStore.GetBorrowHistoryByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONNotFound(w, "borrow record not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get borrow record failed")
+		h.JSONInternalServerError(w, "get borrow record failed")
+		return
+	}
+	loan, err := h.BorrowHistoryStore.RenewLoan(id, user.UserID)
+	switch {
+	case errors.Is(err, ErrLoanAlreadyReturned):
+		logger.WithError(err).Info("renew loan failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	case errors.Is(err, ErrRenewalLimitReached), errors.Is(err, ErrBookHasPendingHolds):
+		logger.WithError(err).Info("renew loan failed")
+		h.JSONUnprocessableEntity(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("renew loan failed")
+		h.JSONNotFound(w, "borrow record not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("renew loan failed")
+		h.JSONInternalServerError(w, "renew loan failed")
+		return
+	}
+	h.audit(r, "loan.renew", "borrow_history", id, before, loan)
+	h.JSONOK(w, loan)
+}
+
+func (h *Handler) ListRenewals(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	idstr := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse borrow record id")
+		h.JSONBadRequest(w, "parse borrow record failed")
+		return
+	}
+	renewals, err := h.BorrowHistoryStore.ListRenewals(id)
+	if err != nil {
+		logger.WithError(err).Info("list renewals failed")
+		h.JSONInternalServerError(w, "list renewals failed")
+		return
+	}
+	h.JSONOK(w, renewals)
+}
+
+type PlaceHoldRequest struct {
+	UserID int64 `json:"user_id"`
+	BookID int64 `json:"book_id"`
+}
+
+// PlaceMyHold puts the requestor in the holds queue of a book
+func (h *Handler) PlaceMyHold(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req PlaceHoldRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	user := r.Context().Value("user").(GetSessionResponse)
+	h.placeHold(w, r, logger, user.UserID, req.BookID)
+}
+
+// PlaceHold puts any user in the holds queue of a book
+func (h *Handler) PlaceHold(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req PlaceHoldRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	h.placeHold(w, r, logger, req.UserID, req.BookID)
+}
+
+func (h *Handler) placeHold(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, userID, bookID int64) {
+	hold, err := h.HoldStore.PlaceHold(userID, bookID)
+	switch {
+	case errors.Is(err, ErrCopiesAvailable), errors.Is(err, ErrHoldExists), errors.Is(err, ErrAlreadyBorrowing):
+		logger.WithError(err).Info("place hold failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("place hold failed")
+		h.JSONNotFound(w, "user or book not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("place hold failed")
+		h.JSONInternalServerError(w, "place hold failed")
+		return
+	}
+	h.audit(r, "hold.create", "hold", hold.ID, nil, hold)
+	h.JSONOK(w, hold)
+}
+
+func (h *Handler) ListMyHolds(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	user := r.Context().Value("user").(GetSessionResponse)
+	holds, err := h.HoldStore.ListHoldsByUserID(user.UserID)
+	if err != nil {
+		logger.WithError(err).Info("list holds failed")
+		h.JSONInternalServerError(w, "list holds failed")
+		return
+	}
+	h.JSONOK(w, holds)
+}
+
+func (h *Handler) ListHolds(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	bookID, _ := strconv.ParseInt(r.URL.Query().Get("book_id"), 10, 64)
+	holds, err := h.HoldStore.ListHolds(bookID, lastID, limit)
+	if err != nil {
+		logger.WithError(err).Info("list holds failed")
+		h.JSONInternalServerError(w, "list holds failed")
+		return
+	}
+	h.JSONOK(w, holds)
+}
+
+func (h *Handler) CancelMyHold(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	idstr := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse hold id")
+		h.JSONBadRequest(w, "parse hold id failed")
+		return
+	}
+	user := r.Context().Value("user").(GetSessionResponse)
+	hold, err := h.HoldStore.GetHold(id)
+	if err != nil || hold.UserID != user.UserID {
+		logger.WithError(err).Info("get hold failed")
+		h.JSONNotFound(w, "hold not found")
+		return
+	}
+	h.cancelHold(w, r, logger, id)
+}
+
+func (h *Handler) CancelHold(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	idstr := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse hold id")
+		h.JSONBadRequest(w, "parse hold id failed")
+		return
+	}
+	h.cancelHold(w, r, logger, id)
+}
+
+func (h *Handler) cancelHold(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, id int64) {
+	before, err := h.HoldStore.GetHold(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get hold failed")
+		h.JSONNotFound(w, "hold not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get hold failed")
+		h.JSONInternalServerError(w, "get hold failed")
+		return
+	}
+	err = h.HoldStore.CancelHold(id)
+	if errors.Is(err, ErrHoldNotActive) {
+		logger.WithError(err).Info("cancel hold failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("cancel hold failed")
+		h.JSONInternalServerError(w, "cancel hold failed")
+		return
+	}
+	after, err := h.HoldStore.GetHold(id)
+	if err != nil {
+		logger.WithError(err).Info("get hold failed")
+		h.JSONInternalServerError(w, "get hold failed")
+		return
+	}
+	h.audit(r, "hold.cancel", "hold", id, before, after)
+	h.JSONOK(w, map[string]int64{"id": id})
+}
+
+type FineLedgerResponse struct {
+	Balance int64  `json:"balance"`
+	Entries []Fine `json:"entries"`
+}
+
+func (h *Handler) ListMyFines(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	user := r.Context().Value("user").(GetSessionResponse)
+	h.fineLedger(w, r, logger, user.UserID)
+}
+
+func (h *Handler) ListFines(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	userID := mux.Vars(r)["user_id"]
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	h.fineLedger(w, r, logger, id)
+}
+
+func (h *Handler) fineLedger(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, userID int64) {
+	lastID, limit := parseLastIDLimit(r, logger)
+	balance, err := h.FineStore.GetFineBalance(userID)
+	if err != nil {
+		logger.WithError(err).Info("get fine balance failed")
+		h.JSONInternalServerError(w, "get fine balance failed")
+		return
+	}
+	entries, err := h.FineStore.ListFinesByUserID(userID, lastID, limit)
+	if err != nil {
+		logger.WithError(err).Info("list fines failed")
+		h.JSONInternalServerError(w, "list fines failed")
+		return
+	}
+	h.JSONOK(w, FineLedgerResponse{Balance: balance, Entries: entries})
+}
+
+type FineCreditRequest struct {
+	Amount          int64  `json:"amount"`
+	Note            string `json:"note"`
+	BorrowHistoryID int64  `json:"borrow_history_id"` // waivers only
+}
+
+func (h *Handler) RecordFinePayment(w http.ResponseWriter, r *http.Request) {
+	h.creditFine(w, r, FinePayment)
+}
+
+func (h *Handler) WaiveFine(w http.ResponseWriter, r *http.Request) {
+	h.creditFine(w, r, FineWaiver)
+}
+
+func (h *Handler) creditFine(w http.ResponseWriter, r *http.Request, kind string) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	userID := mux.Vars(r)["user_id"]
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse user id")
+		h.JSONBadRequest(w, "parse user id failed")
+		return
+	}
+	var req FineCreditRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	if req.Amount <= 0 {
+		logger.Info("non positive amount")
+		h.JSONBadRequest(w, "amount must be positive")
+		return
+	}
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	var entry Fine
+	if kind == FinePayment {
+		entry, err = h.FineStore.RecordPayment(id, req.Amount, req.Note, requestor.UserID)
+	} else {
+		entry, err = h.FineStore.WaiveFine(id, req.BorrowHistoryID, req.Amount, req.Note, requestor.UserID)
+	}
+	if errors.Is(err, ErrExceedsBalance) {
+		logger.WithError(err).Info("credit fine failed")
+		h.JSONUnprocessableEntity(w, err.Error())
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Infof("record %s failed", kind)
+		h.JSONInternalServerError(w, fmt.Sprintf("record %s failed", kind))
+		return
+	}
+	h.audit(r, "fine."+kind, "user", id, nil, entry)
+	h.JSONOK(w, entry)
+}
+
+const (
+	ImportImported  string = "imported"
+	ImportDuplicate        = "duplicate"
+	ImportInvalid          = "invalid"
+)
+
+// ImportResult tells what happened to one record of an import file
+type ImportResult struct {
+	Record int    `json:"record"` // position in the file, from 1
+	Title  string `json:"title,omitempty"`
+	ISBN   string `json:"isbn,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	BookID int64  `json:"book_id,omitempty"`
+}
+
+type ImportReport struct {
+	Imported   int            `json:"imported"`
+	Duplicates int            `json:"duplicates"`
+	Invalid    int            `json:"invalid"`
+	Records    []ImportResult `json:"records"`
+}
+
+// ImportMARC adds the records of an uploaded binary MARC21 or MARCXML `file` to
+// the catalog. Invalid records and books already in the catalog are reported and
+// skipped, the rest are added together or not at all.
+func (h *Handler) ImportMARC(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	err := r.ParseMultipartForm(h.maxRequestBodySize)
+	if err != nil {
+		logger.WithError(err).Info("parse multipart form failed")
+		h.JSONBadRequest(w, "expect a multipart form with a MARC file")
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		logger.WithError(err).Info("retrieving file")
+		h.JSONBadRequest(w, "retrieving file failed")
+		return
+	}
+	defer file.Close()
+	report := ImportReport{Records: []ImportResult{}}
+	var books []Book
+	var pending []int // index in report.Records of each book
+	err = parseMARC(file, func(record marcRecord, rErr error) {
+		result := ImportResult{Record: len(report.Records) + 1, Status: ImportInvalid}
+		var book Book
+		if rErr == nil {
+			book, rErr = record.Book()
+			result.Title, result.ISBN = book.Title, book.ISBN
+		}
+		if rErr != nil {
+			result.Error = rErr.Error()
+			report.Invalid++
+		} else {
+			books = append(books, book)
+			pending = append(pending, len(report.Records))
+		}
+		report.Records = append(report.Records, result)
+	})
+	if err != nil {
+		logger.WithError(err).Info("parse MARC file failed")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	if len(books) > 0 {
+		ids, iErr := h.BookStore.ImportBooks(books, ImportSkipDuplicates)
+		if iErr != nil {
+			logger.WithError(iErr).Info("import books failed")
+			h.JSONInternalServerError(w, "import books failed")
+			return
+		}
+		for i, id := range ids {
+			result := &report.Records[pending[i]]
+			if id == 0 {
+				result.Status = ImportDuplicate
+				report.Duplicates++
+				continue
+			}
+			result.Status, result.BookID = ImportImported, id
+			report.Imported++
+		}
+	}
+	imported := []int64{}
+	for _, result := range report.Records {
+		if result.Status == ImportImported {
+			imported = append(imported, result.BookID)
+		}
+	}
+	h.audit(r, "book.import", "book", 0, nil, map[string][]int64{"ids": imported})
+	h.JSONOK(w, report)
+}
+
+var categorySlug = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+func validateCategory(category *Category) error {
+	category.Slug = strings.ToLower(strings.TrimSpace(category.Slug))
+	category.Name = strings.TrimSpace(category.Name)
+	if !categorySlug.MatchString(category.Slug) {
+		return fmt.Errorf("invalid slug %q, expect lowercase letters, digits, dots, dashes and underscores", category.Slug)
+	}
+	if category.Name == "" {
+		return errors.New("name is required")
+	}
+	if category.ParentID != nil && *category.ParentID == category.ID {
+		return ErrCategoryCycle
+	}
+	return nil
+}
+
+// ListCategories returns the whole category tree, every category after its parent
+func (h *Handler) ListCategories(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	categories, err := h.CategoryStore.ListCategories()
+	if err != nil {
+		logger.WithError(err).Info("list categories failed")
+		h.JSONInternalServerError(w, "list categories failed")
+		return
+	}
+	h.JSONOK(w, categories)
+}
+
+func (h *Handler) AddCategory(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req Category
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	if err := validateCategory(&req); err != nil {
+		logger.WithError(err).Info("invalid category")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	id, err := h.CategoryStore.AddCategory(req)
+	h.respondCategory(w, r, logger, id, nil, err, "add")
+}
+
+// UpdateCategory renames a category or moves it under another parent
+func (h *Handler) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var req Category
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	if err := validateCategory(&req); err != nil {
+		logger.WithError(err).Info("invalid category")
+		h.JSONBadRequest(w, err.Error())
+		return
+	}
+	before, err := h.CategoryStore.GetCategory(req.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get category failed")
+		h.JSONNotFound(w, "category not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get category failed")
+		h.JSONInternalServerError(w, "get category failed")
+		return
+	}
+	err = h.CategoryStore.UpdateCategory(req)
+	h.respondCategory(w, r, logger, req.ID, &before, err, "update")
+}
+
+// respondCategory answers an add or update of a category with the category,
+// before is the category as it was before an update
+func (h *Handler) respondCategory(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, id int64, before *Category, err error, operation string) {
+	switch {
+	case isUniqueViolation(err):
+		logger.WithError(err).Infof("%s category failed", operation)
+		h.JSONStatusConflict(w, "a category with this slug already exists")
+		return
+	case errors.Is(err, ErrUnknownCategory):
+		logger.WithError(err).Infof("%s category failed", operation)
+		h.JSONUnprocessableEntity(w, "unknown parent category")
+		return
+	case errors.Is(err, ErrCategoryCycle):
+		logger.WithError(err).Infof("%s category failed", operation)
+		h.JSONUnprocessableEntity(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Infof("%s category failed", operation)
+		h.JSONNotFound(w, "category not found")
+		return
+	case err != nil:
+		logger.WithError(err).Infof("%s category failed", operation)
+		h.JSONInternalServerError(w, fmt.Sprintf("%s category failed", operation))
+		return
+	}
+	category, err := h.CategoryStore.GetCategory(id)
+	if err != nil {
+		logger.WithError(err).Info("get category failed")
+		h.JSONInternalServerError(w, "get category failed")
+		return
+	}
+	if before == nil {
+		h.audit(r, "category.create", "category", id, nil, category)
+	} else {
+		h.audit(r, "category.update", "category", id, *before, category)
+	}
+	h.JSONOK(w, category)
+}
+
+// RemoveCategory removes a category without subcategories or books
+func (h *Handler) RemoveCategory(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	categoryID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(categoryID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse category id")
+		h.JSONBadRequest(w, "parse category id failed")
+		return
+	}
+	before, err := h.CategoryStore.GetCategory(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get category failed")
+		h.JSONNotFound(w, "category not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get category failed")
+		h.JSONInternalServerError(w, "get category failed")
+		return
+	}
+	err = h.CategoryStore.RemoveCategory(id)
+	switch {
+	case errors.Is(err, ErrCategoryInUse):
+		logger.WithError(err).Info("remove category failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("remove category failed")
+		h.JSONNotFound(w, "category not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("remove category failed")
+		h.JSONInternalServerError(w, "remove category failed")
+		return
+	}
+	h.audit(r, "category.remove", "category", id, before, nil)
+	h.JSONOK(w, "ok")
+}
+
+// ListPermissions lists the permissions roles can be given
+func (h *Handler) ListPermissions(w http.ResponseWriter, r *http.Request) {
+	h.JSONOK(w, permissionInfos)
+}
+
+func (h *Handler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	roles, err := h.RoleStore.ListRoles()
+	if err != nil {
+		logger.WithError(err).Info("list roles failed")
+		h.JSONInternalServerError(w, "list roles failed")
+		return
+	}
+	h.JSONOK(w, roles)
+}
+
+// decodeRole reads and validates the role of the request body, it answers the
+// request itself when that fails
+func (h *Handler) decodeRole(w http.ResponseWriter, r *http.Request, logger *logrus.Entry) (Role, bool) {
+	var req Role
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return req, false
+	}
+	defer r.Body.Close()
+	knownRoles, err := h.knownRoles()
+	if err != nil {
+		logger.WithError(err).Info("list roles failed")
+		h.JSONInternalServerError(w, "list roles failed")
+		return req, false
+	}
+	if err := validateRole(&req, knownRoles); err != nil {
+		logger.WithError(err).Info("invalid role")
+		h.JSONBadRequest(w, err.Error())
+		return req, false
+	}
+	return req, true
+}
+
+// AddRole adds a custom role, like a volunteer who can only lend and return books
+func (h *Handler) AddRole(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	req, ok := h.decodeRole(w, r, logger)
+	if !ok {
+		return
+	}
+	err := h.RoleStore.AddRole(req)
+	if isUniqueViolation(err) {
+		logger.WithError(err).Info("add role failed")
+		h.JSONStatusConflict(w, "a role with this name already exists")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("add role failed")
+		h.JSONInternalServerError(w, "add role failed")
+		return
+	}
+	h.respondRole(w, r, logger, req.Name, nil)
+}
+
+// UpdateRole replaces the description and permissions of a role, its users get
+// the new permissions with their next request
+func (h *Handler) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	req, ok := h.decodeRole(w, r, logger)
+	if !ok {
+		return
+	}
+	before, err := h.RoleStore.GetRole(req.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get role failed")
+		h.JSONNotFound(w, "role not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get role failed")
+		h.JSONInternalServerError(w, "get role failed")
+		return
+	}
+	err = h.RoleStore.UpdateRole(req)
+	switch {
+	case errors.Is(err, ErrAdminRole):
+		logger.WithError(err).Info("update role failed")
+		h.JSONUnprocessableEntity(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("update role failed")
+		h.JSONNotFound(w, "role not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("update role failed")
+		h.JSONInternalServerError(w, "update role failed")
+		return
+	}
+	h.respondRole(w, r, logger, req.Name, &before)
+}
+
+// respondRole answers an add or update of a role with the role, before is the
+// role as it was before an update
+func (h *Handler) respondRole(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, name string, before *Role) {
+	role, err := h.RoleStore.GetRole(name)
+	if err != nil {
+		logger.WithError(err).Info("get role failed")
+		h.JSONInternalServerError(w, "get role failed")
+		return
+	}
+	if before == nil {
+		h.audit(r, "role.create", "role", 0, nil, role)
+	} else {
+		h.audit(r, "role.update", "role", 0, *before, role)
+	}
+	h.JSONOK(w, role)
+}
+
+// RemoveRole removes a custom role no user has
+func (h *Handler) RemoveRole(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	name := mux.Vars(r)["name"]
+	before, err := h.RoleStore.GetRole(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.WithError(err).Info("get role failed")
+		h.JSONNotFound(w, "role not found")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Info("get role failed")
+		h.JSONInternalServerError(w, "get role failed")
+		return
+	}
+	err = h.RoleStore.RemoveRole(name)
+	switch {
+	case errors.Is(err, ErrRoleInUse), errors.Is(err, ErrBuiltinRole):
+		logger.WithError(err).Info("remove role failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("remove role failed")
+		h.JSONNotFound(w, "role not found")
+		return
+	case err != nil:
+		logger.WithError(err).Info("remove role failed")
+		h.JSONInternalServerError(w, "remove role failed")
+		return
+	}
+	h.audit(r, "role.remove", "role", 0, before, nil)
+	h.JSONOK(w, "ok")
+}
+
+type MergeAuthorsRequest struct {
+	AuthorIDs []int64 `json:"author_ids"`
+}
+
+// ListAuthors lists authors by id, `q` filters them by name
+func (h *Handler) ListAuthors(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	lastID, limit := parseLastIDLimit(r, logger)
+	authors, err := h.AuthorStore.ListAuthors(lastID, limit, strings.TrimSpace(r.URL.Query().Get("q")))
+	if err != nil {
+		logger.WithError(err).Info("list authors failed")
+		h.JSONInternalServerError(w, "list authors failed")
+		return
+	}
+	h.JSONOK(w, authors)
+}
+
+// MergeAuthors folds the authors of the request into the author of the path,
+// for the same person catalogued under different spellings
+func (h *Handler) MergeAuthors(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	authorID := mux.Vars(r)["id"]
+	id, err := strconv.ParseInt(authorID, 10, 64)
+	if err != nil {
+		logger.WithError(err).Info("failed to parse author id")
+		h.JSONBadRequest(w, "parse author id failed")
+		return
+	}
+	var req MergeAuthorsRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.WithError(err).Info("failed to decode request body")
+		h.JSONBadRequest(w, "decode json failed")
+		return
+	}
+	defer r.Body.Close()
+	var sourceIDs []int64
+	seen := map[int64]bool{id: true}
+	for _, sourceID := range req.AuthorIDs {
+		if !seen[sourceID] {
+			seen[sourceID] = true
+			sourceIDs = append(sourceIDs, sourceID)
+		}
+	}
+	if len(sourceIDs) == 0 {
+		logger.Info("no author to merge")
+		h.JSONBadRequest(w, "author_ids must list other authors to merge")
+		return
+	}
+	err = h.AuthorStore.MergeAuthors(id, sourceIDs)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		logger.WithError(err).Info("merge authors failed")
+		h.JSONNotFound(w, "author not found")
+		return
+	case errors.Is(err, ErrDuplicateBook):
+		logger.WithError(err).Info("merge authors failed")
+		h.JSONStatusConflict(w, err.Error())
+		return
+	case err != nil:
+		logger.WithError(err).Info("merge authors failed")
+		h.JSONInternalServerError(w, "merge authors failed")
+		return
+	}
+	h.audit(r, "author.merge", "author", id, nil, map[string][]int64{"merged_author_ids": sourceIDs})
+	h.JSONOK(w, map[string]int64{"id": id})
+}
+
+const ImportValid string = "valid" // a row that would be imported, reported on dry runs
+
+// CSVRowResult tells what happened to one row of an imported CSV file
+type CSVRowResult struct {
+	Line   int      `json:"line"` // line in the file, the header is line 1
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+	ID     int64    `json:"id,omitempty"`
+}
+
+type CSVImportReport struct {
+	DryRun    bool           `json:"dry_run"`
+	Committed bool           `json:"committed"`
+	Rows      []CSVRowResult `json:"rows"`
+}
+
+// readCSVImport reads the uploaded CSV `file` along with the optional `mapping`,
+// a JSON object renaming its columns, and the `dry_run` flag
+func (h *Handler) readCSVImport(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, known, required []string) ([]csvRow, bool, bool) {
+	err := r.ParseMultipartForm(h.maxRequestBodySize)
+	if err != nil {
+		logger.WithError(err).Info("parse multipart form failed")
+		h.JSONBadRequest(w, "expect a multipart form with a CSV file")
+		return nil, false, false
+	}
+	var mapping map[string]string
+	if m := r.FormValue("mapping"); m != "" {
+		if err := json.Unmarshal([]byte(m), &mapping); err != nil {
+			logger.WithError(err).Info("failed to decode mapping")
+			h.JSONBadRequest(w, "mapping must be a JSON object of column to field")
+			return nil, false, false
+		}
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		logger.WithError(err).Info("retrieving file")
+		h.JSONBadRequest(w, "retrieving file failed")
+		return nil, false, false
+	}
+	defer file.Close()
+	rows, err := readCSV(file, mapping, known, required)
+	if err != nil {
+		logger.WithError(err).Info("read CSV failed")
+		h.JSONBadRequest(w, err.Error())
+		return nil, false, false
+	}
+	return rows, r.FormValue("dry_run") == "true", true
+}
+
+// finishCSVImport runs importRows, which imports the valid rows listed in
+// pending, and reports the outcome. Nothing is kept on a dry run or when any
+// row is invalid or clashes with existing data, the rows are still checked for
+// clashes so the report is complete.
+func (h *Handler) finishCSVImport(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, entity string, report CSVImportReport, pending []int, importRows func(ImportMode) ([]int64, error)) {
+	mode := ImportAllOrNothing
+	if report.DryRun || len(pending) < len(report.Rows) {
+		mode = ImportDryRun
+	}
+	var ids []int64
+	if len(pending) > 0 {
+		var err error
+		ids, err = importRows(mode)
+		if err != nil {
+			logger.WithError(err).Info("import failed")
+			h.JSONInternalServerError(w, "import failed")
+			return
+		}
+	}
+	report.Committed = mode == ImportAllOrNothing && keepImport(mode, ids)
+	for i, id := range ids {
+		row := &report.Rows[pending[i]]
+		switch {
+		case id == 0:
+			row.Status, row.Errors = ImportDuplicate, []string{"already exists"}
+		case report.Committed:
+			row.Status, row.ID = ImportImported, id
+		default:
+			row.Status = ImportValid
+		}
+	}
+	if !report.DryRun && !report.Committed {
+		h.JSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+	imported := []int64{}
+	for _, row := range report.Rows {
+		if row.Status == ImportImported {
+			imported = append(imported, row.ID)
+		}
+	}
+	h.audit(r, entity+".import", entity, 0, nil, map[string]interface{}{"dry_run": report.DryRun, "ids": imported})
+	h.JSONOK(w, report)
+}
+
+// ImportBooksCSV adds the books of an uploaded CSV file, see bookCSVHeader for
+// the columns. Subjects are separated by semicolons.
+func (h *Handler) ImportBooksCSV(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	rows, dryRun, ok := h.readCSVImport(w, r, logger, bookCSVHeader, bookCSVRequired)
+	if !ok {
+		return
+	}
+	categories, err := h.CategoryStore.ListCategories()
+	if err != nil {
+		logger.WithError(err).Info("list categories failed")
+		h.JSONInternalServerError(w, "list categories failed")
+		return
+	}
+	knownCategories := make(map[string]bool, len(categories))
+	for _, category := range categories {
+		knownCategories[category.Slug] = true
+	}
+	report := CSVImportReport{DryRun: dryRun, Rows: make([]CSVRowResult, len(rows))}
+	var books []Book
+	var pending []int
+	for i, row := range rows {
+		result := CSVRowResult{Line: row.Line, Status: ImportInvalid}
+		if row.Err != nil {
+			result.Errors = []string{row.Err.Error()}
+		} else if book, problems := bookFromCSV(row.Values, knownCategories); len(problems) > 0 {
+			result.Errors = problems
+		} else {
+			books = append(books, book)
+			pending = append(pending, i)
+		}
+		report.Rows[i] = result
+	}
+	h.finishCSVImport(w, r, logger, "book", report, pending, func(mode ImportMode) ([]int64, error) {
+		return h.BookStore.ImportBooks(books, mode)
+	})
+}
+
+// ImportUsersCSV adds the users of an uploaded CSV file with the columns email,
+// username, password and type, the name of a role the requestor can manage.
+func (h *Handler) ImportUsersCSV(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	rows, dryRun, ok := h.readCSVImport(w, r, logger, userCSVHeader, userCSVRequired)
+	if !ok {
+		return
+	}
+	requestor := r.Context().Value("user").(GetSessionResponse)
+	knownRoles, err := h.knownRoles()
+	if err != nil {
+		logger.WithError(err).Info("list roles failed")
+		h.JSONInternalServerError(w, "import failed")
+		return
+	}
+	report := CSVImportReport{DryRun: dryRun, Rows: make([]CSVRowResult, len(rows))}
+	var users []User
+	var pending []int
+	for i, row := range rows {
+		result := CSVRowResult{Line: row.Line, Status: ImportInvalid}
+		if row.Err != nil {
+			result.Errors = []string{row.Err.Error()}
+		} else if user, problems := userFromCSV(row.Values, knownRoles); len(problems) > 0 {
+			result.Errors = problems
+		} else if !requestor.Permissions.CanOnRole(PermUserManage, user.Type) {
+			result.Errors = []string{fmt.Sprintf("you can't add a user with the role %s", user.Type)}
+		} else if err := h.PasswordPolicy.Check(user.Password, user.UserName); err != nil {
+			result.Errors = []string{err.Error()}
+		} else {
+			users = append(users, user)
+			pending = append(pending, i)
+		}
+		report.Rows[i] = result
+	}
+	h.finishCSVImport(w, r, logger, "user", report, pending, func(mode ImportMode) ([]int64, error) {
+		return h.UserStore.ImportUsers(users, mode)
+	})
+}
+
+// streamCSV writes header and then the pages nextPage returns until one is
+// empty. The first page is read before anything is written so a failing store
+// still gets a proper error response.
+func (h *Handler) streamCSV(w http.ResponseWriter, logger *logrus.Entry, filename string, header []string, nextPage func() ([][]string, error)) {
+	page, err := nextPage()
+	if err != nil {
+		logger.WithError(err).Info("export failed")
+		h.JSONInternalServerError(w, "export failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	writer := csv.NewWriter(w)
+	err = writer.Write(header)
+	for err == nil && len(page) > 0 {
+		if err = writer.WriteAll(page); err == nil {
+			page, err = nextPage()
+		}
+	}
+	if err == nil {
+		writer.Flush()
+		err = writer.Error()
+	}
+	if err != nil {
+		logger.WithError(err).Error("export failed")
+	}
+}
+
+func (h *Handler) ExportBooksCSV(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	opts := ListBooksOptions{Sort: "id", Order: "asc", Limit: exportPageSize}
+	done := false
+	h.streamCSV(w, logger, "books.csv", bookCSVHeader, func() ([][]string, error) {
+		if done {
+			return nil, nil
+		}
+		books, nextCursor, err := h.BookStore.ListBooks(opts)
+		opts.Cursor, done = nextCursor, nextCursor == ""
+		records := make([][]string, 0, len(books))
+		for _, book := range books {
+			records = append(records, bookCSVRecord(book))
+		}
+		return records, err
+	})
+}
+
+// ExportUsersCSV exports the users the requestor can see, without passwords
+func (h *Handler) ExportUsersCSV(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	user := r.Context().Value("user").(GetSessionResponse)
+	types, err := h.rolesAllowed(user, PermUserRead)
+	if err != nil {
+		logger.WithError(err).Info("list roles failed")
+		h.JSONInternalServerError(w, "export failed")
+		return
+	}
+	var lastID int64
+	h.streamCSV(w, logger, "users.csv", userCSVExportHeader, func() ([][]string, error) {
+		if len(types) == 0 {
+			return nil, nil
+		}
+		users, err := h.UserStore.ListUsers(lastID, exportPageSize, "asc", types)
+		records := make([][]string, 0, len(users))
+		for _, user := range users {
+			records = append(records, userCSVRecord(user))
+			lastID = user.ID
+		}
+		return records, err
+	})
+}
+
+func (h *Handler) ExportBorrowHistoryCSV(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	var lastID int64
+	h.streamCSV(w, logger, "borrow_history.csv", borrowHistoryCSVHeader, func() ([][]string, error) {
+		loans, err := h.BorrowHistoryStore.ListBorrowHistorySince(lastID, exportPageSize)
+		records := make([][]string, 0, len(loans))
+		for _, loan := range loans {
+			records = append(records, borrowHistoryCSVRecord(loan))
+			lastID = loan.ID
+		}
+		return records, err
+	})
+}
+
+// exportPageSize is how many rows are read from the store at a time while exporting
+const exportPageSize = 200
+
+// ExportMARC streams the whole catalog as a MARCXML collection
+func (h *Handler) ExportMARC(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	opts := ListBooksOptions{Sort: "id", Order: "asc", Limit: exportPageSize}
+	books, nextCursor, err := h.BookStore.ListBooks(opts)
+	if err != nil {
+		logger.WithError(err).Info("list books failed")
+		h.JSONInternalServerError(w, "list books failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/marcxml+xml")
+	w.Header().Set("Content-Disposition", `attachment; filename="catalog.xml"`)
+	// the status is sent with the first byte, failures past this point can only be logged
+	writer, err := newMARCXMLWriter(w)
+	for err == nil {
+		for _, book := range books {
+			if err = writer.Write(marcRecordFromBook(book)); err != nil {
+				break
+			}
+		}
+		if err != nil || nextCursor == "" {
+			break
+		}
+		opts.Cursor = nextCursor
+		books, nextCursor, err = h.BookStore.ListBooks(opts)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		logger.WithError(err).Error("export MARC failed")
+	}
+}
+
+// ListAuditLog lists the audit log newest first, optionally filtered by
+// `actor_id`, `entity`, `entity_id` and a `from`/`to` time range given as RFC 3339
+// or dates. Older entries are paged in with `before_id`.
+func (h *Handler) ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI})
+	params := r.URL.Query()
+	_, limit := parseLastIDLimit(r, logger)
+	filter := AuditFilter{Entity: params.Get("entity"), Limit: limit}
+	for name, value := range map[string]*int64{"actor_id": &filter.ActorID, "entity_id": &filter.EntityID, "before_id": &filter.BeforeID} {
+		if params.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(params.Get(name), 10, 64)
+		if err != nil {
+			logger.WithError(err).Infof("failed to parse %s", name)
+			h.JSONBadRequest(w, fmt.Sprintf("parse %s failed", name))
+			return
+		}
+		*value = n
+	}
+	for name, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if params.Get(name) == "" {
+			continue
+		}
+		t, err := parseAuditTime(params.Get(name))
+		if err != nil {
+			logger.WithError(err).Infof("failed to parse %s", name)
+			h.JSONBadRequest(w, fmt.Sprintf("invalid %s, expect RFC 3339 time or YYYY-MM-DD", name))
+			return
+		}
+		*value = t
+	}
+	entries, err := h.AuditStore.ListAuditLog(filter)
+	if err != nil {
+		logger.WithError(err).Info("list audit log failed")
+		h.JSONInternalServerError(w, "list audit log failed")
+		return
+	}
+	h.JSONOK(w, entries)
+}
+
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
 }
 
 func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
@@ -604,5 +3133,6 @@ func (h *Handler) UploadImage(w http.ResponseWriter, r *http.Request) {
 		h.JSONInternalServerError(w, "upload image failed")
 		return
 	}
+	h.audit(r, "image.upload", "image", 0, nil, map[string]string{"path": filePath})
 	h.JSONOK(w, map[string]string{"path": fmt.Sprintf("http://%s/%s", os.Getenv("MINIO_ENDPOINT"), filePath)})
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		name    string
+		isbn    string
+		want    string
+		wantErr error
+	}{
+		{"isbn-10", "0306406152", "9780306406157", nil},
+		{"isbn-10 with X check digit", "080442957X", "9780804429573", nil},
+		{"isbn-10 with lowercase x", "080442957x", "9780804429573", nil},
+		{"hyphenated isbn-10", "0-8044-2957-X", "9780804429573", nil},
+		{"isbn-13", "9780306406157", "9780306406157", nil},
+		{"hyphenated isbn-13", "978-0-306-40615-7", "9780306406157", nil},
+		{"spaced isbn-13", "978 0 306 40615 7", "9780306406157", nil},
+		{"979 prefix", "9791090636071", "9791090636071", nil},
+		{"bad isbn-10 checksum", "0306406153", "", ErrInvalidISBN},
+		{"bad isbn-13 checksum", "9780306406158", "", ErrInvalidISBN},
+		{"13 digits without 978 or 979", "1230306406157", "", ErrInvalidISBN},
+		{"X before the check digit", "03064061X2", "", ErrInvalidISBN},
+		{"letters in isbn-10", "03064O6152", "", ErrInvalidISBN},
+		{"letters in isbn-13", "97803064061A7", "", ErrInvalidISBN},
+		{"too short", "030640615", "", ErrInvalidISBN},
+		{"empty", "", "", ErrInvalidISBN},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeISBN(tt.isbn)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("%s: NormalizeISBN(%q) = %q, %v, want %q, %v", tt.name, tt.isbn, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
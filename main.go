@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
@@ -23,10 +29,47 @@ func main() {
 	if err != nil {
 		log.Fatalf("sqlx.Connect: %v", err)
 	}
-	var bookStore BookStore = NewSQLBookStore(dbx)
-	var userStore UserStore = NewSQLUserStore(dbx)
-	var borrowHistoryStore BorrowHistoryStore = NewSQLBorrowHistoryStore(dbx)
-	var sessionStore SessionStore = NewSQLSessionStore(dbx)
+	loanPolicy, err := LoanPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("LoanPolicyFromEnv: %v", err)
+	}
+	finePolicy, err := FinePolicyFromEnv()
+	if err != nil {
+		log.Fatalf("FinePolicyFromEnv: %v", err)
+	}
+	sessionPolicy, err := SessionPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("SessionPolicyFromEnv: %v", err)
+	}
+	passwordPolicy, err := PasswordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("PasswordPolicyFromEnv: %v", err)
+	}
+	loginPolicy, err := LoginPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("LoginPolicyFromEnv: %v", err)
+	}
+	var bookStore BookStore = NewSQLBookStore(dbx, loanPolicy)
+	var copyStore CopyStore = NewSQLCopyStore(dbx, loanPolicy)
+	var userStore UserStore = NewSQLUserStore(dbx, loanPolicy)
+	var borrowHistoryStore BorrowHistoryStore = NewSQLBorrowHistoryStore(dbx, loanPolicy, finePolicy)
+	var holdStore HoldStore = NewSQLHoldStore(dbx, loanPolicy)
+	var fineStore FineStore = NewSQLFineStore(dbx)
+	var authorStore AuthorStore = NewSQLAuthorStore(dbx)
+	var categoryStore CategoryStore = NewSQLCategoryStore(dbx)
+	var auditStore AuditStore = NewSQLAuditStore(dbx)
+	var roleStore RoleStore = NewSQLRoleStore(dbx)
+	var totpStore TOTPStore = NewSQLTOTPStore(dbx)
+	var sessionStore SessionStore = NewSQLSessionStore(dbx, sessionPolicy)
+	var loginAttemptStore LoginAttemptStore
+	switch os.Getenv("LOGIN_ATTEMPT_STORE") {
+	case "", "memory":
+		loginAttemptStore = NewMemoryLoginAttemptStore(loginPolicy)
+	case "sql":
+		loginAttemptStore = NewSQLLoginAttemptStore(dbx, loginPolicy)
+	default:
+		log.Fatalf("invalid setting for env LOGIN_ATTEMPT_STORE: %s. expect memory or sql", os.Getenv("LOGIN_ATTEMPT_STORE"))
+	}
 	imageStore, err := NewMinioImageStore(
 		os.Getenv("MINIO_ENDPOINT"),
 		os.Getenv("MINIO_ACCESS_KEY"),
@@ -37,51 +80,230 @@ func main() {
 	if err != nil {
 		log.Fatalf("NewMinioImageStore: %v", err)
 	}
-	loginDurationInSecond, err := strconv.ParseInt(os.Getenv("LOGIN_DURATION_IN_SECOND"), 10, 64)
-	if err != nil {
-		log.Fatalf("empty or invalid setting for env LOGIN_DURATION_IN_SECOND: %s. expect INTEGER", os.Getenv("LOGIN_DURATION_IN_SECOND"))
+	deletedRetentionInDays := int64(30)
+	if v := os.Getenv("DELETED_RETENTION_IN_DAYS"); v != "" {
+		deletedRetentionInDays, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || deletedRetentionInDays < 0 {
+			log.Fatalf("invalid setting for env DELETED_RETENTION_IN_DAYS: %s. expect INTEGER >= 0", v)
+		}
 	}
-	maxBooksEachUserCanBorrow, err := strconv.ParseInt(os.Getenv("MAX_BOOKS_EACH_USER_CAN_BORROW"), 10, 64)
-	if err != nil {
-		log.Fatalf("empty or invalid setting for env MAX_BOOKS_EACH_USER_CAN_BORROW: %s. expect INTEGER", os.Getenv("MAX_BOOKS_EACH_USER_CAN_BORROW"))
+	handler := NewHandler(sessionStore, bookStore, copyStore, userStore, borrowHistoryStore, holdStore, fineStore, authorStore, categoryStore, auditStore, roleStore, totpStore, loginAttemptStore, imageStore, sessionPolicy, passwordPolicy, loginPolicy)
+	// background jobs and the server stop on SIGINT or SIGTERM, the jobs finish
+	// the run they are in before the process exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var jobs sync.WaitGroup
+	background := func(interval time.Duration, fn func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			runPeriodically(ctx, interval, fn)
+		}()
 	}
-	handler := NewHandler(sessionStore, bookStore, userStore, borrowHistoryStore, imageStore, loginDurationInSecond, maxBooksEachUserCanBorrow)
+	background(time.Minute, func() {
+		expired, err := holdStore.ExpireHolds()
+		if err != nil {
+			logrus.WithError(err).Error("expire holds")
+			return
+		}
+		if expired > 0 {
+			logrus.Infof("expired %d holds past their pickup date", expired)
+		}
+	})
+	if deletedRetentionInDays > 0 {
+		background(time.Hour, func() {
+			deletedBefore := time.Now().AddDate(0, 0, -int(deletedRetentionInDays))
+			books, err := bookStore.PurgeDeletedBooks(deletedBefore)
+			if err != nil {
+				logrus.WithError(err).Error("purge deleted books")
+			}
+			users, err := userStore.PurgeDeletedUsers(deletedBefore)
+			if err != nil {
+				logrus.WithError(err).Error("purge deleted users")
+			}
+			if books > 0 || users > 0 {
+				logrus.Infof("purged %d books and %d users deleted more than %d days ago", books, users, deletedRetentionInDays)
+			}
+		})
+	}
+	background(10*time.Minute, func() {
+		expired, err := sessionStore.DeleteExpiredSessions()
+		if err != nil {
+			logrus.WithError(err).Error("delete expired sessions")
+			return
+		}
+		if expired > 0 {
+			logrus.Infof("deleted %d expired sessions", expired)
+		}
+		if _, err := loginAttemptStore.PruneAttempts(); err != nil {
+			logrus.WithError(err).Error("prune login attempts")
+		}
+	})
 	RoutesMux(handler, router)
 	SetCors(router)
-	Serve(router)
+	Serve(ctx, router)
+	jobs.Wait()
 }
 
-func RoutesMux(handler *Handler, r *mux.Router) {
-	static := http.FileServer(http.Dir("fe"))
-	r.PathPrefix("/fe/").Handler(http.StripPrefix("/fe/", static))
+// Route is an endpoint of the API. Routes without a Permission are public, the
+// others need a session whose role has the permission. Accounts limits the user
+// routes of a resource to some accounts, every account when nil.
+type Route struct {
+	Method     string
+	Path       string
+	Permission string
+	Handler    http.HandlerFunc
+	Accounts   *accountScope
+}
+
+// Allows tells whether a user with permissions gets past the permission check
+// of the route, roles are the names of all roles. A route limited to some
+// accounts needs its scoped permission on every role of those accounts, so
+// /admin/staff is for whoever manages all the staff. Handlers may check
+// further, like the role of the user acted on.
+func (route Route) Allows(permissions Permissions, roles []string) bool {
+	if route.Permission == "" {
+		return true
+	}
+	if !permissions.Can(route.Permission) {
+		return false
+	}
+	if route.Accounts == nil {
+		return true
+	}
+	for _, role := range roles {
+		if route.Accounts.allows(role) && !permissions.CanOnRole(route.Permission, role) {
+			return false
+		}
+	}
+	return true
+}
+
+// Routes is the route table of the API. The /admin/user routes reach every
+// account the requestor may manage, /admin/staff and /librarian/borrowers only
+// the staff and the borrowers.
+func Routes(handler *Handler) []Route {
+	return []Route{
+		{Method: http.MethodPost, Path: "/login", Handler: handler.Login},
+		{Method: http.MethodPost, Path: "/login/totp", Handler: handler.VerifyLoginTOTP},
+		{Method: http.MethodPost, Path: "/logout", Handler: handler.Logout},
+		{Method: http.MethodPost, Path: "/password-reset", Handler: handler.ResetPassword},
 
-	public := r.PathPrefix("/").Subrouter()
-	public.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
-	public.HandleFunc("/logout", handler.Logout).Methods(http.MethodPost)
+		{Method: http.MethodGet, Path: "/internal/book/{id}", Permission: PermBookRead, Handler: handler.GetBookDetails},
+		{Method: http.MethodGet, Path: "/internal/book/{id}/copies", Permission: PermBookRead, Handler: handler.ListCopies},
+		{Method: http.MethodGet, Path: "/internal/book/isbn/{isbn}", Permission: PermBookRead, Handler: handler.GetBookByISBN},
+		{Method: http.MethodGet, Path: "/internal/mybooks", Permission: PermLoanOwn, Handler: handler.ListMyBooks},
+		{Method: http.MethodGet, Path: "/internal/books", Permission: PermBookRead, Handler: handler.ListAllBooks},
+		{Method: http.MethodGet, Path: "/internal/books/search", Permission: PermBookRead, Handler: handler.SearchBooks},
+		{Method: http.MethodGet, Path: "/internal/authors", Permission: PermBookRead, Handler: handler.ListAuthors},
+		{Method: http.MethodGet, Path: "/internal/categories", Permission: PermBookRead, Handler: handler.ListCategories},
+		{Method: http.MethodGet, Path: "/internal/user/{id}", Permission: PermAccount, Handler: handler.GetUserByID},
+		{Method: http.MethodGet, Path: "/internal/borrowhistory", Permission: PermLoanOwn, Handler: handler.ListBorrowHistoryPerUser},
+		{Method: http.MethodPost, Path: "/internal/bookrenew/{id}", Permission: PermLoanOwn, Handler: handler.RenewMyLoan},
+		{Method: http.MethodPost, Path: "/internal/holds", Permission: PermLoanOwn, Handler: handler.PlaceMyHold},
+		{Method: http.MethodGet, Path: "/internal/holds", Permission: PermLoanOwn, Handler: handler.ListMyHolds},
+		{Method: http.MethodDelete, Path: "/internal/holds/{id}", Permission: PermLoanOwn, Handler: handler.CancelMyHold},
+		{Method: http.MethodGet, Path: "/internal/fines", Permission: PermLoanOwn, Handler: handler.ListMyFines},
+		{Method: http.MethodGet, Path: "/internal/sessions", Permission: PermAccount, Handler: handler.ListMySessions},
+		{Method: http.MethodDelete, Path: "/internal/sessions/{id}", Permission: PermAccount, Handler: handler.RevokeMySession},
+		{Method: http.MethodPost, Path: "/internal/me/password", Permission: PermAccount, Handler: handler.ChangeMyPassword},
+		{Method: http.MethodPost, Path: "/internal/me/totp", Permission: PermAccount, Handler: handler.StartMyTOTP},
+		{Method: http.MethodPost, Path: "/internal/me/totp/confirm", Permission: PermAccount, Handler: handler.ConfirmMyTOTP},
+		{Method: http.MethodDelete, Path: "/internal/me/totp", Permission: PermAccount, Handler: handler.DisableMyTOTP},
+		{Method: http.MethodPost, Path: "/internal/me/totp/recovery-codes", Permission: PermAccount, Handler: handler.RegenerateMyRecoveryCodes},
 
-	internal := r.PathPrefix("/internal").Subrouter()
-	internal.Use(handler.GenerateAuthMiddleware(Borrower))
-	internal.HandleFunc("/book/{id}", handler.GetBookDetails).Methods(http.MethodGet)
-	internal.HandleFunc("/mybooks", handler.ListMyBooks).Methods(http.MethodGet)
-	internal.HandleFunc("/books", handler.ListAllBooks).Methods(http.MethodGet)
-	internal.HandleFunc("/user/{id}", handler.GetUserByID).Methods(http.MethodGet)
-	internal.HandleFunc("/borrowhistory", handler.ListBorrowHistoryPerUser).Methods(http.MethodGet)
+		{Method: http.MethodPost, Path: "/admin/user", Permission: PermUserManage, Handler: handler.AddUser},
+		{Method: http.MethodPut, Path: "/admin/user", Permission: PermUserManage, Handler: handler.UpdateUser},
+		{Method: http.MethodDelete, Path: "/admin/user/{id}", Permission: PermUserManage, Handler: handler.RemoveUser},
+		{Method: http.MethodGet, Path: "/admin/users", Permission: PermUserRead, Handler: handler.ListUsers},
+		{Method: http.MethodPost, Path: "/admin/user/{id}/restore", Permission: PermUserManage, Handler: handler.RestoreUser},
+		{Method: http.MethodDelete, Path: "/admin/user/{id}/sessions", Permission: PermUserManage, Handler: handler.RevokeUserSessions},
+		{Method: http.MethodPost, Path: "/admin/user/{id}/password-reset", Permission: PermUserManage, Handler: handler.IssuePasswordReset},
+		{Method: http.MethodDelete, Path: "/admin/user/{id}/lockout", Permission: PermUserManage, Handler: handler.UnlockUser},
+		{Method: http.MethodDelete, Path: "/admin/user/{id}/totp", Permission: PermUserManage, Handler: handler.ResetUserTOTP},
+		{Method: http.MethodPost, Path: "/admin/book/{id}/restore", Permission: PermBookWrite, Handler: handler.RestoreBook},
+		{Method: http.MethodGet, Path: "/admin/trash/users", Permission: PermUserManage, Handler: handler.ListDeletedUsers},
+		{Method: http.MethodGet, Path: "/admin/trash/books", Permission: PermBookWrite, Handler: handler.ListDeletedBooks},
+		{Method: http.MethodPost, Path: "/admin/users/import", Permission: PermUserManage, Handler: handler.ImportUsersCSV},
+		{Method: http.MethodGet, Path: "/admin/users/export", Permission: PermUserRead, Handler: handler.ExportUsersCSV},
+		{Method: http.MethodGet, Path: "/admin/staff", Permission: PermUserRead, Handler: handler.ListUsers, Accounts: &staffAccounts},
+		{Method: http.MethodPost, Path: "/admin/staff", Permission: PermUserManage, Handler: handler.AddUser, Accounts: &staffAccounts},
+		{Method: http.MethodGet, Path: "/admin/staff/{id}", Permission: PermUserRead, Handler: handler.GetUserByID, Accounts: &staffAccounts},
+		{Method: http.MethodPut, Path: "/admin/staff/{id}", Permission: PermUserManage, Handler: handler.UpdateUser, Accounts: &staffAccounts},
+		{Method: http.MethodDelete, Path: "/admin/staff/{id}", Permission: PermUserManage, Handler: handler.RemoveUser, Accounts: &staffAccounts},
+		{Method: http.MethodPost, Path: "/admin/staff/{id}/restore", Permission: PermUserManage, Handler: handler.RestoreUser, Accounts: &staffAccounts},
+		{Method: http.MethodDelete, Path: "/admin/staff/{id}/sessions", Permission: PermUserManage, Handler: handler.RevokeUserSessions, Accounts: &staffAccounts},
+		{Method: http.MethodPost, Path: "/admin/staff/{id}/password-reset", Permission: PermUserManage, Handler: handler.IssuePasswordReset, Accounts: &staffAccounts},
+		{Method: http.MethodDelete, Path: "/admin/staff/{id}/lockout", Permission: PermUserManage, Handler: handler.UnlockUser, Accounts: &staffAccounts},
+		{Method: http.MethodDelete, Path: "/admin/staff/{id}/totp", Permission: PermUserManage, Handler: handler.ResetUserTOTP, Accounts: &staffAccounts},
+		{Method: http.MethodGet, Path: "/admin/audit", Permission: PermAuditRead, Handler: handler.ListAuditLog},
+		{Method: http.MethodGet, Path: "/admin/permissions", Permission: PermRoleManage, Handler: handler.ListPermissions},
+		{Method: http.MethodGet, Path: "/admin/roles", Permission: PermRoleManage, Handler: handler.ListRoles},
+		{Method: http.MethodPost, Path: "/admin/role", Permission: PermRoleManage, Handler: handler.AddRole},
+		{Method: http.MethodPut, Path: "/admin/role", Permission: PermRoleManage, Handler: handler.UpdateRole},
+		{Method: http.MethodDelete, Path: "/admin/role/{name}", Permission: PermRoleManage, Handler: handler.RemoveRole},
 
-	admin := r.PathPrefix("/admin").Subrouter()
-	admin.Use(handler.GenerateAuthMiddleware(Librarian))
-	admin.HandleFunc("/user", handler.AddUser).Methods(http.MethodPost)
-	admin.HandleFunc("/user", handler.UpdateUser).Methods(http.MethodPut)
-	admin.HandleFunc("/user/{id}", handler.RemoveUser).Methods(http.MethodDelete)
-	admin.HandleFunc("/users", handler.ListUsers).Methods(http.MethodGet)
-	admin.HandleFunc("/uploadimage", handler.UploadImage).Methods(http.MethodPost)
+		{Method: http.MethodGet, Path: "/librarian/borrowers", Permission: PermUserRead, Handler: handler.ListUsers, Accounts: &borrowerAccounts},
+		{Method: http.MethodPost, Path: "/librarian/borrowers", Permission: PermUserManage, Handler: handler.AddUser, Accounts: &borrowerAccounts},
+		{Method: http.MethodGet, Path: "/librarian/borrowers/{id}", Permission: PermUserRead, Handler: handler.GetUserByID, Accounts: &borrowerAccounts},
+		{Method: http.MethodPut, Path: "/librarian/borrowers/{id}", Permission: PermUserManage, Handler: handler.UpdateUser, Accounts: &borrowerAccounts},
+		{Method: http.MethodDelete, Path: "/librarian/borrowers/{id}", Permission: PermUserManage, Handler: handler.RemoveUser, Accounts: &borrowerAccounts},
+		{Method: http.MethodPost, Path: "/librarian/borrowers/{id}/restore", Permission: PermUserManage, Handler: handler.RestoreUser, Accounts: &borrowerAccounts},
+		{Method: http.MethodDelete, Path: "/librarian/borrowers/{id}/sessions", Permission: PermUserManage, Handler: handler.RevokeUserSessions, Accounts: &borrowerAccounts},
+		{Method: http.MethodPost, Path: "/librarian/borrowers/{id}/password-reset", Permission: PermUserManage, Handler: handler.IssuePasswordReset, Accounts: &borrowerAccounts},
+		{Method: http.MethodDelete, Path: "/librarian/borrowers/{id}/lockout", Permission: PermUserManage, Handler: handler.UnlockUser, Accounts: &borrowerAccounts},
+		{Method: http.MethodDelete, Path: "/librarian/borrowers/{id}/totp", Permission: PermUserManage, Handler: handler.ResetUserTOTP, Accounts: &borrowerAccounts},
+		{Method: http.MethodPost, Path: "/librarian/book", Permission: PermBookWrite, Handler: handler.AddBook},
+		{Method: http.MethodPut, Path: "/librarian/book", Permission: PermBookWrite, Handler: handler.UpdateBook},
+		{Method: http.MethodDelete, Path: "/librarian/book/{id}", Permission: PermBookWrite, Handler: handler.RemoveBook},
+		{Method: http.MethodPost, Path: "/librarian/books/import", Permission: PermBookWrite, Handler: handler.ImportBooksCSV},
+		{Method: http.MethodGet, Path: "/librarian/books/export", Permission: PermBookWrite, Handler: handler.ExportBooksCSV},
+		{Method: http.MethodPost, Path: "/librarian/books/import/marc", Permission: PermBookWrite, Handler: handler.ImportMARC},
+		{Method: http.MethodGet, Path: "/librarian/books/export/marc", Permission: PermBookWrite, Handler: handler.ExportMARC},
+		{Method: http.MethodPost, Path: "/librarian/uploadimage", Permission: PermBookWrite, Handler: handler.UploadImage},
+		{Method: http.MethodPost, Path: "/librarian/book/{id}/copies", Permission: PermBookWrite, Handler: handler.AddCopy},
+		{Method: http.MethodPost, Path: "/librarian/authors/{id}/merge", Permission: PermBookWrite, Handler: handler.MergeAuthors},
+		{Method: http.MethodPost, Path: "/librarian/category", Permission: PermCategoryWrite, Handler: handler.AddCategory},
+		{Method: http.MethodPut, Path: "/librarian/category", Permission: PermCategoryWrite, Handler: handler.UpdateCategory},
+		{Method: http.MethodDelete, Path: "/librarian/category/{id}", Permission: PermCategoryWrite, Handler: handler.RemoveCategory},
+		{Method: http.MethodPut, Path: "/librarian/copy", Permission: PermBookWrite, Handler: handler.UpdateCopy},
+		{Method: http.MethodDelete, Path: "/librarian/copy/{id}", Permission: PermBookWrite, Handler: handler.RetireCopy},
+		{Method: http.MethodGet, Path: "/librarian/borrowcount/{user_id}", Permission: PermLoanRead, Handler: handler.CountBorrowedBooksByUserID},
+		{Method: http.MethodPost, Path: "/librarian/bookborrow", Permission: PermLoanCreate, Handler: handler.BorrowBook},
+		{Method: http.MethodDelete, Path: "/librarian/bookreturn/{id}", Permission: PermLoanCreate, Handler: handler.ReturnBook},
+		{Method: http.MethodPost, Path: "/librarian/bookrenew/{id}", Permission: PermLoanCreate, Handler: handler.RenewLoan},
+		{Method: http.MethodGet, Path: "/librarian/bookrenew/{id}", Permission: PermLoanRead, Handler: handler.ListRenewals},
+		{Method: http.MethodGet, Path: "/librarian/borrowrecord", Permission: PermLoanRead, Handler: handler.GetBorrowRecord},
+		{Method: http.MethodGet, Path: "/librarian/borrowhistory/export", Permission: PermLoanRead, Handler: handler.ExportBorrowHistoryCSV},
+		{Method: http.MethodGet, Path: "/librarian/overdue", Permission: PermLoanRead, Handler: handler.ListOverdue},
+		{Method: http.MethodPost, Path: "/librarian/holds", Permission: PermLoanCreate, Handler: handler.PlaceHold},
+		{Method: http.MethodGet, Path: "/librarian/holds", Permission: PermLoanRead, Handler: handler.ListHolds},
+		{Method: http.MethodDelete, Path: "/librarian/holds/{id}", Permission: PermLoanCreate, Handler: handler.CancelHold},
+		{Method: http.MethodGet, Path: "/librarian/fines/{user_id}", Permission: PermFineManage, Handler: handler.ListFines},
+		{Method: http.MethodPost, Path: "/librarian/fines/{user_id}/payment", Permission: PermFineManage, Handler: handler.RecordFinePayment},
+		{Method: http.MethodPost, Path: "/librarian/fines/{user_id}/waiver", Permission: PermFineManage, Handler: handler.WaiveFine},
+	}
+}
+
+// RoutesMux registers the route table along with the static files of the frontend
+func RoutesMux(handler *Handler, r *mux.Router) {
+	r.Use(handler.AuditMiddleware)
+	static := http.FileServer(http.Dir("fe"))
+	r.PathPrefix("/fe/").Handler(http.StripPrefix("/fe/", static))
+	for _, route := range Routes(handler) {
+		var next http.Handler = route.Handler
+		if route.Permission != "" {
+			next = handler.AuthMiddleware(handler.Authorize(route, route.Handler))
+		}
+		if route.Accounts != nil {
+			next = withAccountScope(*route.Accounts, next)
+		}
+		r.Handle(route.Path, next).Methods(route.Method)
+	}
+}
 
-	librarian := r.PathPrefix("/librarian").Subrouter()
-	librarian.Use(handler.GenerateAuthMiddleware(Librarian))
-	librarian.HandleFunc("/book", handler.AddBook).Methods(http.MethodPost)
-	librarian.HandleFunc("/book", handler.UpdateBook).Methods(http.MethodPut)
-	librarian.HandleFunc("/book/{id}", handler.RemoveBook).Methods(http.MethodDelete)
-	librarian.HandleFunc("/borrowcount/{user_id}", handler.CountBorrowedBooksByUserID).Methods(http.MethodGet)
-	librarian.HandleFunc("/bookborrow", handler.BorrowBook).Methods(http.MethodPost)
-	librarian.HandleFunc("/bookreturn/{id}", handler.ReturnBook).Methods(http.MethodDelete)
-	librarian.HandleFunc("/borrowrecord", handler.GetBorrowRecord).Methods(http.MethodGet)
+func withAccountScope(scope accountScope, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "accounts", scope)))
+	})
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// seededPermissions are the permissions db.sql gives the built-in roles
+var seededPermissions = map[string]Permissions{
+	Admin: {PermAccount, PermBookRead, PermBookWrite, PermCategoryWrite, PermLoanOwn, PermLoanCreate, PermLoanRead, PermFineManage,
+		"user:read:*", "user:manage:*", PermAuditRead, PermRoleManage},
+	Librarian: {PermAccount, PermBookRead, PermBookWrite, PermCategoryWrite, PermLoanOwn, PermLoanCreate, PermLoanRead, PermFineManage,
+		"user:read:librarian", "user:read:borrower", "user:manage:borrower"},
+	Borrower: {PermAccount, PermBookRead, PermLoanOwn},
+}
+
+func TestRoutesAllow(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		admin     bool
+		librarian bool
+		borrower  bool
+	}{
+		{http.MethodPost, "/login", true, true, true},
+		{http.MethodPost, "/login/totp", true, true, true},
+		{http.MethodPost, "/logout", true, true, true},
+		{http.MethodPost, "/password-reset", true, true, true},
+		{http.MethodGet, "/internal/book/{id}", true, true, true},
+		{http.MethodGet, "/internal/book/{id}/copies", true, true, true},
+		{http.MethodGet, "/internal/book/isbn/{isbn}", true, true, true},
+		{http.MethodGet, "/internal/mybooks", true, true, true},
+		{http.MethodGet, "/internal/books", true, true, true},
+		{http.MethodGet, "/internal/books/search", true, true, true},
+		{http.MethodGet, "/internal/authors", true, true, true},
+		{http.MethodGet, "/internal/categories", true, true, true},
+		{http.MethodGet, "/internal/user/{id}", true, true, true},
+		{http.MethodGet, "/internal/borrowhistory", true, true, true},
+		{http.MethodPost, "/internal/bookrenew/{id}", true, true, true},
+		{http.MethodPost, "/internal/holds", true, true, true},
+		{http.MethodGet, "/internal/holds", true, true, true},
+		{http.MethodDelete, "/internal/holds/{id}", true, true, true},
+		{http.MethodGet, "/internal/fines", true, true, true},
+		{http.MethodGet, "/internal/sessions", true, true, true},
+		{http.MethodDelete, "/internal/sessions/{id}", true, true, true},
+		{http.MethodPost, "/internal/me/password", true, true, true},
+		{http.MethodPost, "/internal/me/totp", true, true, true},
+		{http.MethodPost, "/internal/me/totp/confirm", true, true, true},
+		{http.MethodDelete, "/internal/me/totp", true, true, true},
+		{http.MethodPost, "/internal/me/totp/recovery-codes", true, true, true},
+		{http.MethodPost, "/admin/user", true, true, false},
+		{http.MethodPut, "/admin/user", true, true, false},
+		{http.MethodDelete, "/admin/user/{id}", true, true, false},
+		{http.MethodGet, "/admin/users", true, true, false},
+		{http.MethodPost, "/admin/user/{id}/restore", true, true, false},
+		{http.MethodDelete, "/admin/user/{id}/sessions", true, true, false},
+		{http.MethodPost, "/admin/user/{id}/password-reset", true, true, false},
+		{http.MethodDelete, "/admin/user/{id}/lockout", true, true, false},
+		{http.MethodDelete, "/admin/user/{id}/totp", true, true, false},
+		{http.MethodPost, "/admin/book/{id}/restore", true, true, false},
+		{http.MethodGet, "/admin/trash/users", true, true, false},
+		{http.MethodGet, "/admin/trash/books", true, true, false},
+		{http.MethodPost, "/admin/users/import", true, true, false},
+		{http.MethodGet, "/admin/users/export", true, true, false},
+		{http.MethodGet, "/admin/staff", true, false, false},
+		{http.MethodPost, "/admin/staff", true, false, false},
+		{http.MethodGet, "/admin/staff/{id}", true, false, false},
+		{http.MethodPut, "/admin/staff/{id}", true, false, false},
+		{http.MethodDelete, "/admin/staff/{id}", true, false, false},
+		{http.MethodPost, "/admin/staff/{id}/restore", true, false, false},
+		{http.MethodDelete, "/admin/staff/{id}/sessions", true, false, false},
+		{http.MethodPost, "/admin/staff/{id}/password-reset", true, false, false},
+		{http.MethodDelete, "/admin/staff/{id}/lockout", true, false, false},
+		{http.MethodDelete, "/admin/staff/{id}/totp", true, false, false},
+		{http.MethodGet, "/admin/audit", true, false, false},
+		{http.MethodGet, "/admin/permissions", true, false, false},
+		{http.MethodGet, "/admin/roles", true, false, false},
+		{http.MethodPost, "/admin/role", true, false, false},
+		{http.MethodPut, "/admin/role", true, false, false},
+		{http.MethodDelete, "/admin/role/{name}", true, false, false},
+		{http.MethodGet, "/librarian/borrowers", true, true, false},
+		{http.MethodPost, "/librarian/borrowers", true, true, false},
+		{http.MethodGet, "/librarian/borrowers/{id}", true, true, false},
+		{http.MethodPut, "/librarian/borrowers/{id}", true, true, false},
+		{http.MethodDelete, "/librarian/borrowers/{id}", true, true, false},
+		{http.MethodPost, "/librarian/borrowers/{id}/restore", true, true, false},
+		{http.MethodDelete, "/librarian/borrowers/{id}/sessions", true, true, false},
+		{http.MethodPost, "/librarian/borrowers/{id}/password-reset", true, true, false},
+		{http.MethodDelete, "/librarian/borrowers/{id}/lockout", true, true, false},
+		{http.MethodDelete, "/librarian/borrowers/{id}/totp", true, true, false},
+		{http.MethodPost, "/librarian/book", true, true, false},
+		{http.MethodPut, "/librarian/book", true, true, false},
+		{http.MethodDelete, "/librarian/book/{id}", true, true, false},
+		{http.MethodPost, "/librarian/books/import", true, true, false},
+		{http.MethodGet, "/librarian/books/export", true, true, false},
+		{http.MethodPost, "/librarian/books/import/marc", true, true, false},
+		{http.MethodGet, "/librarian/books/export/marc", true, true, false},
+		{http.MethodPost, "/librarian/uploadimage", true, true, false},
+		{http.MethodPost, "/librarian/book/{id}/copies", true, true, false},
+		{http.MethodPost, "/librarian/authors/{id}/merge", true, true, false},
+		{http.MethodPost, "/librarian/category", true, true, false},
+		{http.MethodPut, "/librarian/category", true, true, false},
+		{http.MethodDelete, "/librarian/category/{id}", true, true, false},
+		{http.MethodPut, "/librarian/copy", true, true, false},
+		{http.MethodDelete, "/librarian/copy/{id}", true, true, false},
+		{http.MethodGet, "/librarian/borrowcount/{user_id}", true, true, false},
+		{http.MethodPost, "/librarian/bookborrow", true, true, false},
+		{http.MethodDelete, "/librarian/bookreturn/{id}", true, true, false},
+		{http.MethodPost, "/librarian/bookrenew/{id}", true, true, false},
+		{http.MethodGet, "/librarian/bookrenew/{id}", true, true, false},
+		{http.MethodGet, "/librarian/borrowrecord", true, true, false},
+		{http.MethodGet, "/librarian/borrowhistory/export", true, true, false},
+		{http.MethodGet, "/librarian/overdue", true, true, false},
+		{http.MethodPost, "/librarian/holds", true, true, false},
+		{http.MethodGet, "/librarian/holds", true, true, false},
+		{http.MethodDelete, "/librarian/holds/{id}", true, true, false},
+		{http.MethodGet, "/librarian/fines/{user_id}", true, true, false},
+		{http.MethodPost, "/librarian/fines/{user_id}/payment", true, true, false},
+		{http.MethodPost, "/librarian/fines/{user_id}/waiver", true, true, false},
+	}
+	roles := []string{Admin, Librarian, Borrower}
+	routes := make(map[string]Route)
+	for _, route := range Routes(&Handler{}) {
+		routes[route.Method+" "+route.Path] = route
+	}
+	for _, tt := range tests {
+		key := tt.method + " " + tt.path
+		route, ok := routes[key]
+		if !ok {
+			t.Errorf("%s: not in the route table", key)
+			continue
+		}
+		delete(routes, key)
+		for role, want := range map[string]bool{Admin: tt.admin, Librarian: tt.librarian, Borrower: tt.borrower} {
+			if got := route.Allows(seededPermissions[role], roles); got != want {
+				t.Errorf("%s: Allows(%s) = %v, want %v", key, role, got, want)
+			}
+		}
+	}
+	for key := range routes {
+		t.Errorf("%s: missing from the expected matrix", key)
+	}
+}
+
+func TestRoutesAllowCustomRole(t *testing.T) {
+	roles := []string{Admin, Librarian, Borrower, "volunteer"}
+	tests := []struct {
+		name        string
+		permissions Permissions
+		method      string
+		path        string
+		want        bool
+	}{
+		{"manager of borrowers", Permissions{"user:manage:borrower"}, http.MethodPost, "/librarian/borrowers", true},
+		{"manager of some staff", Permissions{"user:manage:librarian"}, http.MethodPost, "/admin/staff", false},
+		{"manager of all staff", Permissions{"user:manage:admin", "user:manage:librarian", "user:manage:volunteer"}, http.MethodPost, "/admin/staff", true},
+		{"manager of some staff on every account", Permissions{"user:manage:librarian"}, http.MethodPost, "/admin/user", true},
+		{"volunteer lends books", Permissions{PermLoanCreate}, http.MethodPost, "/librarian/bookborrow", true},
+		{"volunteer can't edit the catalog", Permissions{PermLoanCreate}, http.MethodPost, "/librarian/book", false},
+	}
+	routes := make(map[string]Route)
+	for _, route := range Routes(&Handler{}) {
+		routes[route.Method+" "+route.Path] = route
+	}
+	for _, tt := range tests {
+		route, ok := routes[tt.method+" "+tt.path]
+		if !ok {
+			t.Fatalf("%s %s: not in the route table", tt.method, tt.path)
+		}
+		if got := route.Allows(tt.permissions, roles); got != tt.want {
+			t.Errorf("%s: Allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MARC21 records, in the shape of MARCXML (http://www.loc.gov/standards/marcxml/).
+// Binary ISO 2709 records are parsed into the same structs.
+type marcRecord struct {
+	XMLName       xml.Name           `xml:"record"`
+	Leader        string             `xml:"leader"`
+	ControlFields []marcControlField `xml:"controlfield"`
+	DataFields    []marcDataField    `xml:"datafield"`
+}
+
+type marcControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+const (
+	marcXMLNamespace     = "http://www.loc.gov/MARC21/slim"
+	marcRecordTerminator = 0x1d
+	marcFieldTerminator  = 0x1e
+	marcSubfieldDelim    = 0x1f
+	// marcExportLeader describes a book record in UTF-8, lengths are not meaningful in MARCXML
+	marcExportLeader = "00000nam a2200000 i 4500"
+)
+
+// parseMARC reads a MARCXML collection or a file of binary MARC21 records and
+// calls fn with every record, or with the error that made a record unreadable.
+// An error is returned only when the file itself can't be read any further.
+func parseMARC(r io.Reader, fn func(record marcRecord, err error)) error {
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		_, _ = br.Discard(3)
+	}
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+		case '<':
+			return parseMARCXML(br, fn)
+		default:
+			return parseMARC21(br, fn)
+		}
+	}
+}
+
+func parseMARCXML(r io.Reader, fn func(record marcRecord, err error)) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid MARCXML: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+		var record marcRecord
+		if err := decoder.DecodeElement(&record, &start); err != nil {
+			return fmt.Errorf("invalid MARCXML: %w", err)
+		}
+		fn(record, nil)
+	}
+}
+
+func parseMARC21(r *bufio.Reader, fn func(record marcRecord, err error)) error {
+	for {
+		raw, err := r.ReadBytes(marcRecordTerminator)
+		if err == io.EOF && len(bytes.TrimSpace(raw)) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// records are often separated by line breaks when files are concatenated
+		raw = bytes.TrimLeft(raw, "\r\n")
+		record, rErr := decodeMARC21Record(raw)
+		fn(record, rErr)
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// decodeMARC21Record decodes one ISO 2709 record: a 24 byte leader, a
+// directory of 12 byte entries (tag, length, offset) and the fields it points at
+func decodeMARC21Record(raw []byte) (marcRecord, error) {
+	var record marcRecord
+	if len(raw) < 25 {
+		return record, errors.New("record is shorter than its leader")
+	}
+	record.Leader = string(raw[:24])
+	base, ok := marcNumber(raw[12:17])
+	if !ok || base < 25 || base > len(raw) {
+		return record, errors.New("invalid base address of data in leader")
+	}
+	if raw[9] != 'a' && !utf8.Valid(raw) {
+		return record, errors.New("unsupported MARC-8 character encoding, expect UTF-8")
+	}
+	directory := raw[24 : base-1]
+	if len(directory)%12 != 0 {
+		return record, errors.New("invalid directory length")
+	}
+	for i := 0; i < len(directory); i += 12 {
+		entry := directory[i : i+12]
+		tag := string(entry[:3])
+		length, lOK := marcNumber(entry[3:7])
+		start, sOK := marcNumber(entry[7:12])
+		if !lOK || !sOK || base+start+length > len(raw) {
+			return record, fmt.Errorf("invalid directory entry for field %s", tag)
+		}
+		data := bytes.TrimRight(raw[base+start:base+start+length], string([]byte{marcFieldTerminator, marcRecordTerminator}))
+		if tag < "010" {
+			record.ControlFields = append(record.ControlFields, marcControlField{Tag: tag, Value: string(data)})
+			continue
+		}
+		if len(data) < 2 {
+			return record, fmt.Errorf("field %s has no indicators", tag)
+		}
+		field := marcDataField{Tag: tag, Ind1: string(data[0]), Ind2: string(data[1])}
+		for _, subfield := range bytes.Split(data[2:], []byte{marcSubfieldDelim}) {
+			if len(subfield) == 0 {
+				continue
+			}
+			field.Subfields = append(field.Subfields, marcSubfield{Code: string(subfield[0]), Value: string(subfield[1:])})
+		}
+		record.DataFields = append(record.DataFields, field)
+	}
+	return record, nil
+}
+
+// marcNumber parses the fixed width numbers of the leader and the directory,
+// which are digits only, unlike strconv.Atoi that also takes a sign
+func marcNumber(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, len(b) > 0
+}
+
+func (m marcRecord) controlField(tag string) string {
+	for _, f := range m.ControlFields {
+		if f.Tag == tag {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// subfields returns every value of the code subfield of the tag fields
+func (m marcRecord) subfields(tag, code string) []string {
+	var values []string
+	for _, f := range m.DataFields {
+		if f.Tag != tag {
+			continue
+		}
+		for _, s := range f.Subfields {
+			if s.Code == code {
+				values = append(values, s.Value)
+			}
+		}
+	}
+	return values
+}
+
+func (m marcRecord) subfield(tag, code string) string {
+	if values := m.subfields(tag, code); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+var (
+	marcYear  = regexp.MustCompile(`\d{4}`)
+	marcPages = regexp.MustCompile(`(\d+)\s*p`)
+)
+
+// trimISBD strips the punctuation cataloguers put between subfields
+func trimISBD(s string) string {
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(s), " /:;,="))
+}
+
+// marcRelators maps the relator terms ($e) and codes ($4) of added entries to author roles
+var marcRelators = map[string]string{
+	"author": AuthorRoleAuthor, "aut": AuthorRoleAuthor,
+	"editor": AuthorRoleEditor, "edt": AuthorRoleEditor,
+	"translator": AuthorRoleTranslator, "trl": AuthorRoleTranslator,
+}
+
+// authors credits the main entry 100 (or 110) as author and the added entries
+// 700 by their relator, as author when it has none or an unknown one
+func (m marcRecord) authors() BookAuthors {
+	authors := BookAuthors{}
+	main := trimISBD(m.subfield("100", "a"))
+	if main == "" {
+		main = trimISBD(m.subfield("110", "a"))
+	}
+	if main != "" {
+		authors = append(authors, BookAuthor{Name: main, Role: AuthorRoleAuthor})
+	}
+	for _, field := range m.DataFields {
+		if field.Tag != "700" {
+			continue
+		}
+		author := BookAuthor{Role: AuthorRoleAuthor}
+		for _, s := range field.Subfields {
+			switch s.Code {
+			case "a":
+				author.Name = trimISBD(s.Value)
+			case "e", "4":
+				if role, ok := marcRelators[strings.ToLower(strings.Trim(s.Value, " .,"))]; ok {
+					author.Role = role
+				}
+			}
+		}
+		if author.Name != "" {
+			authors = append(authors, author)
+		}
+	}
+	return authors
+}
+
+// Book maps title 245, authors 100 (or 110) and 700, ISBN 020, edition 250, publisher
+// and year 264 (or 260), pages 300, language 008 (or 041), description 520 and
+// subjects 650
+func (m marcRecord) Book() (Book, error) {
+	book := Book{Subjects: []string{}}
+	book.Title = trimISBD(m.subfield("245", "a"))
+	if subtitle := trimISBD(m.subfield("245", "b")); subtitle != "" && book.Title != "" {
+		book.Title += ": " + subtitle
+	}
+	if book.Title == "" {
+		return book, errors.New("missing title in field 245")
+	}
+	book.Authors = m.authors()
+	isbns := m.subfields("020", "a")
+	for _, value := range isbns {
+		// values look like `0306406152 (pbk.)`
+		if isbn, _, _ := strings.Cut(strings.TrimSpace(value), " "); isbn != "" {
+			if normalized, err := NormalizeISBN(isbn); err == nil {
+				book.ISBN = normalized
+				break
+			}
+		}
+	}
+	if book.ISBN == "" && len(isbns) > 0 {
+		return book, fmt.Errorf("%w in field 020: %s", ErrInvalidISBN, isbns[0])
+	}
+	book.Edition = trimISBD(m.subfield("250", "a"))
+	publication := "264"
+	if m.subfield("264", "b") == "" && m.subfield("264", "c") == "" {
+		publication = "260"
+	}
+	book.Publisher = trimISBD(m.subfield(publication, "b"))
+	if year := marcYear.FindString(m.subfield(publication, "c")); year != "" {
+		book.PublicationYear, _ = strconv.Atoi(year)
+	}
+	if pages := marcPages.FindStringSubmatch(m.subfield("300", "a")); pages != nil {
+		book.PageCount, _ = strconv.Atoi(pages[1])
+	}
+	if fixed := m.controlField("008"); len(fixed) >= 38 {
+		book.Language = strings.TrimSpace(fixed[35:38])
+	}
+	if book.Language == "" {
+		book.Language = m.subfield("041", "a")
+	}
+	book.Description = strings.TrimSpace(m.subfield("520", "a"))
+	seen := make(map[string]bool)
+	for _, value := range m.subfields("650", "a") {
+		subject := trimISBD(strings.TrimRight(value, "."))
+		if subject != "" && !seen[subject] {
+			seen[subject] = true
+			book.Subjects = append(book.Subjects, subject)
+		}
+	}
+	return book, validateBook(&book)
+}
+
+// marcRecordFromBook is the inverse of marcRecord.Book
+func marcRecordFromBook(book Book) marcRecord {
+	record := marcRecord{
+		Leader:        marcExportLeader,
+		ControlFields: []marcControlField{{Tag: "001", Value: strconv.FormatInt(book.ID, 10)}},
+	}
+	add := func(tag, ind1, ind2 string, subfields ...marcSubfield) {
+		var nonEmpty []marcSubfield
+		for _, s := range subfields {
+			if s.Value != "" {
+				nonEmpty = append(nonEmpty, s)
+			}
+		}
+		if len(nonEmpty) > 0 {
+			record.DataFields = append(record.DataFields, marcDataField{Tag: tag, Ind1: ind1, Ind2: ind2, Subfields: nonEmpty})
+		}
+	}
+	year := ""
+	if book.PublicationYear > 0 {
+		year = strconv.Itoa(book.PublicationYear)
+	}
+	pages := ""
+	if book.PageCount > 0 {
+		pages = fmt.Sprintf("%d pages", book.PageCount)
+	}
+	add("020", " ", " ", marcSubfield{Code: "a", Value: book.ISBN})
+	add("041", " ", " ", marcSubfield{Code: "a", Value: book.Language})
+	// the first credit is the main entry when it is an author, every other credit an added entry
+	added := book.Authors
+	if len(added) > 0 && added[0].Role == AuthorRoleAuthor {
+		add("100", "1", " ", marcSubfield{Code: "a", Value: added[0].Name})
+		added = added[1:]
+	}
+	add("245", "1", "0", marcSubfield{Code: "a", Value: book.Title})
+	add("250", " ", " ", marcSubfield{Code: "a", Value: book.Edition})
+	add("264", " ", "1", marcSubfield{Code: "b", Value: book.Publisher}, marcSubfield{Code: "c", Value: year})
+	add("300", " ", " ", marcSubfield{Code: "a", Value: pages})
+	add("520", " ", " ", marcSubfield{Code: "a", Value: book.Description})
+	for _, subject := range book.Subjects {
+		add("650", " ", "4", marcSubfield{Code: "a", Value: subject})
+	}
+	for _, author := range added {
+		add("700", "1", " ", marcSubfield{Code: "a", Value: author.Name}, marcSubfield{Code: "e", Value: author.Role})
+	}
+	return record
+}
+
+// marcXMLWriter streams records into a MARCXML collection
+type marcXMLWriter struct {
+	encoder *xml.Encoder
+}
+
+func newMARCXMLWriter(w io.Writer) (*marcXMLWriter, error) {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return nil, err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err := encoder.EncodeToken(xml.StartElement{
+		Name: xml.Name{Local: "collection"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: marcXMLNamespace}},
+	})
+	return &marcXMLWriter{encoder: encoder}, err
+}
+
+func (m *marcXMLWriter) Write(record marcRecord) error {
+	return m.encoder.Encode(record)
+}
+
+// Close ends the collection, it doesn't close the underlying writer
+func (m *marcXMLWriter) Close() error {
+	if err := m.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "collection"}}); err != nil {
+		return err
+	}
+	return m.encoder.Flush()
+}
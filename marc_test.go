@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testMARC21Record builds a binary MARC21 record of the fields, tag then data
+// without the field terminator, the way a cataloguing tool would write it
+func testMARC21Record(fields ...string) string {
+	var directory, data strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		field := fields[i+1] + string(rune(marcFieldTerminator))
+		fmt.Fprintf(&directory, "%s%04d%05d", fields[i], len(field), data.Len())
+		data.WriteString(field)
+	}
+	directory.WriteByte(marcFieldTerminator)
+	base := 24 + directory.Len()
+	length := base + data.Len() + 1
+	leader := fmt.Sprintf("%05dnam a22%05d i 4500", length, base)
+	return leader + directory.String() + data.String() + string(rune(marcRecordTerminator))
+}
+
+func TestDecodeMARC21Record(t *testing.T) {
+	raw := testMARC21Record(
+		"001", "12345",
+		"245", "10\x1fa"+"Dune /\x1fc"+"Frank Herbert.",
+	)
+	record, err := decodeMARC21Record([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := record.controlField("001"); got != "12345" {
+		t.Errorf("controlField(001) = %q, want 12345", got)
+	}
+	if got := record.subfield("245", "a"); got != "Dune /" {
+		t.Errorf("subfield(245, a) = %q, want %q", got, "Dune /")
+	}
+	if got := record.subfield("245", "c"); got != "Frank Herbert." {
+		t.Errorf("subfield(245, c) = %q, want %q", got, "Frank Herbert.")
+	}
+}
+
+func TestDecodeMARC21RecordMalformed(t *testing.T) {
+	valid := testMARC21Record("001", "12345", "245", "10\x1faDune")
+	// the directory starts after the leader, the second entry is the 245 field
+	entry := 24 + 12
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"shorter than its leader", valid[:20]},
+		{"base address not a number", valid[:12] + "00a37" + valid[17:]},
+		{"base address past the end", valid[:12] + "99999" + valid[17:]},
+		{"signed base address", valid[:12] + "+0049" + valid[17:]},
+		{"directory not in entries of 12", valid[:12] + "00048" + valid[17:]},
+		{"negative length", valid[:entry+3] + "-001" + valid[entry+7:]},
+		{"negative start", valid[:entry+7] + "-9999" + valid[entry+12:]},
+		{"signed length", valid[:entry+3] + "+009" + valid[entry+7:]},
+		{"length past the end", valid[:entry+3] + "9999" + valid[entry+7:]},
+		{"start past the end", valid[:entry+7] + "99999" + valid[entry+12:]},
+		{"length not a number", valid[:entry+3] + "00x9" + valid[entry+7:]},
+		{"data field without indicators", testMARC21Record("245", "1")},
+	}
+	for _, tt := range tests {
+		if _, err := decodeMARC21Record([]byte(tt.raw)); err == nil {
+			t.Errorf("%s: decodeMARC21Record succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHashPrefix marks the scheme and version of a stored password hash.
+// Bump the version whenever the scheme or its cost changes so old hashes can be
+// upgraded on the next successful login.
+const (
+	passwordHashPrefix = "$lms-v1$"
+	passwordHashCost   = 12
+)
+
+// dummyPasswordHash is compared against when the user does not exist so that a
+// failed lookup takes as long as a failed password check
+var dummyPasswordHash, _ = HashPassword("dummy password used to equalize timing")
+
+// HashPassword returns a salted, versioned hash of the given password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return passwordHashPrefix + string(hash), nil
+}
+
+// VerifyPassword checks password against the stored value. needsRehash is true
+// when the stored value is a legacy plaintext password or an older hash format
+// and should be replaced with a fresh HashPassword result.
+func VerifyPassword(stored, password string) (ok bool, needsRehash bool) {
+	if !strings.HasPrefix(stored, passwordHashPrefix) {
+		// legacy rows store the password in plaintext
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	hash := []byte(strings.TrimPrefix(stored, passwordHashPrefix))
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost(hash)
+	return true, err != nil || cost < passwordHashCost
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultLoanPeriodInDays = 14
+	defaultMaxRenewals      = 2
+	defaultHoldPickupInDays = 3
+)
+
+// LoanPolicy decides how long a book can be borrowed. A period configured for
+// a category of the book, or the nearest of their ancestors, wins over one
+// configured for the user type, which wins over the default.
+type LoanPolicy struct {
+	MaxBooksPerUser int64
+	DefaultPeriod   time.Duration
+	ByCategory      map[string]time.Duration // by category slug
+	ByUserType      map[string]time.Duration
+	// MaxRenewals caps the renewals of a loan, each extends it by its loan period
+	MaxRenewals int
+	// HoldPickupPeriod is how long a copy set aside for a hold waits for its borrower
+	HoldPickupPeriod time.Duration
+}
+
+// LoanPeriod takes the category slugs of a book nearest first, see bookCategoryPath
+func (p LoanPolicy) LoanPeriod(categories []string, userType string) time.Duration {
+	for _, category := range categories {
+		if period, ok := p.ByCategory[category]; ok {
+			return period
+		}
+	}
+	if period, ok := p.ByUserType[userType]; ok {
+		return period
+	}
+	return p.DefaultPeriod
+}
+
+// LoanPolicyFromEnv reads MAX_BOOKS_EACH_USER_CAN_BORROW, LOAN_PERIOD_IN_DAYS, LOAN_PERIOD_IN_DAYS_BY_BOOK_TYPE,
+// LOAN_PERIOD_IN_DAYS_BY_USER_TYPE, MAX_RENEWALS and HOLD_PICKUP_PERIOD_IN_DAYS
+func LoanPolicyFromEnv() (LoanPolicy, error) {
+	policy := LoanPolicy{
+		DefaultPeriod:    defaultLoanPeriodInDays * 24 * time.Hour,
+		MaxRenewals:      defaultMaxRenewals,
+		HoldPickupPeriod: defaultHoldPickupInDays * 24 * time.Hour,
+	}
+	maxBooks, err := strconv.ParseInt(os.Getenv("MAX_BOOKS_EACH_USER_CAN_BORROW"), 10, 64)
+	if err != nil {
+		return policy, fmt.Errorf("empty or invalid setting for env MAX_BOOKS_EACH_USER_CAN_BORROW: %s. expect INTEGER", os.Getenv("MAX_BOOKS_EACH_USER_CAN_BORROW"))
+	}
+	policy.MaxBooksPerUser = maxBooks
+	if days := os.Getenv("HOLD_PICKUP_PERIOD_IN_DAYS"); days != "" {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n <= 0 {
+			return policy, fmt.Errorf("invalid setting for env HOLD_PICKUP_PERIOD_IN_DAYS: %s. expect positive INTEGER", days)
+		}
+		policy.HoldPickupPeriod = time.Duration(n) * 24 * time.Hour
+	}
+	if renewals := os.Getenv("MAX_RENEWALS"); renewals != "" {
+		n, err := strconv.Atoi(renewals)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid setting for env MAX_RENEWALS: %s. expect INTEGER", renewals)
+		}
+		policy.MaxRenewals = n
+	}
+	if days := os.Getenv("LOAN_PERIOD_IN_DAYS"); days != "" {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n <= 0 {
+			return policy, fmt.Errorf("invalid setting for env LOAN_PERIOD_IN_DAYS: %s. expect positive INTEGER", days)
+		}
+		policy.DefaultPeriod = time.Duration(n) * 24 * time.Hour
+	}
+	policy.ByCategory, err = parseDaysByKey("LOAN_PERIOD_IN_DAYS_BY_BOOK_TYPE")
+	if err != nil {
+		return policy, err
+	}
+	policy.ByUserType, err = parseDaysByKey("LOAN_PERIOD_IN_DAYS_BY_USER_TYPE")
+	if err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+// parseDaysByKey parses an env in the form `key1:days1,key2:days2`
+func parseDaysByKey(env string) (map[string]time.Duration, error) {
+	periods := make(map[string]time.Duration)
+	value := strings.TrimSpace(os.Getenv(env))
+	if value == "" {
+		return periods, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, days, found := strings.Cut(strings.TrimSpace(pair), ":")
+		n, err := strconv.ParseInt(strings.TrimSpace(days), 10, 64)
+		if !found || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid setting for env %s: %s. expect key:DAYS,key:DAYS", env, value)
+		}
+		periods[strings.TrimSpace(key)] = time.Duration(n) * 24 * time.Hour
+	}
+	return periods, nil
+}
+
+// FinePolicy decides the late fee charged when an overdue loan is returned.
+// Amounts are in the smallest currency unit. A zero FeePerDay disables late
+// fees, a zero MaxFeePerItem means no cap and a negative MaxOutstanding lets
+// users borrow whatever they owe.
+type FinePolicy struct {
+	FeePerDay      int64
+	GraceDays      int64
+	MaxFeePerItem  int64
+	MaxOutstanding int64
+}
+
+// LateFee charges FeePerDay for every started day late beyond the grace days
+func (p FinePolicy) LateFee(dueAt, returnedAt time.Time) int64 {
+	if p.FeePerDay <= 0 || !returnedAt.After(dueAt) {
+		return 0
+	}
+	late := returnedAt.Sub(dueAt)
+	daysLate := int64(late / (24 * time.Hour))
+	if late%(24*time.Hour) > 0 {
+		daysLate++
+	}
+	chargeable := daysLate - p.GraceDays
+	if chargeable <= 0 {
+		return 0
+	}
+	fee := chargeable * p.FeePerDay
+	if p.MaxFeePerItem > 0 && fee > p.MaxFeePerItem {
+		fee = p.MaxFeePerItem
+	}
+	return fee
+}
+
+// FinePolicyFromEnv reads LATE_FEE_PER_DAY, LATE_FEE_GRACE_DAYS, LATE_FEE_MAX_PER_ITEM and MAX_OUTSTANDING_FINES
+func FinePolicyFromEnv() (FinePolicy, error) {
+	policy := FinePolicy{MaxOutstanding: -1}
+	for env, value := range map[string]*int64{
+		"LATE_FEE_PER_DAY":      &policy.FeePerDay,
+		"LATE_FEE_GRACE_DAYS":   &policy.GraceDays,
+		"LATE_FEE_MAX_PER_ITEM": &policy.MaxFeePerItem,
+		"MAX_OUTSTANDING_FINES": &policy.MaxOutstanding,
+	} {
+		setting := os.Getenv(env)
+		if setting == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(setting, 10, 64)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid setting for env %s: %s. expect non negative INTEGER", env, setting)
+		}
+		*value = n
+	}
+	return policy, nil
+}
+
+const (
+	defaultSessionIdleTimeout  = 2 * time.Hour
+	defaultSessionSeenInterval = time.Minute
+	defaultSessionMFATimeout   = 5 * time.Minute
+)
+
+// SessionPolicy decides when a session expires: after IdleTimeout without a
+// request or MaxLifetime after login, whichever comes first. A zero IdleTimeout
+// turns the idle timeout off. The last seen time of a session is written at
+// most once every SeenInterval so requests don't each cost a write. A session
+// waiting for a TOTP code expires after MFATimeout.
+type SessionPolicy struct {
+	IdleTimeout  time.Duration
+	MaxLifetime  time.Duration
+	SeenInterval time.Duration
+	MFATimeout   time.Duration
+}
+
+// ExpiresAt is when a session is gone at the latest, used for the cookie
+func (p SessionPolicy) ExpiresAt(createdAt time.Time) time.Time {
+	return createdAt.Add(p.MaxLifetime)
+}
+
+// SessionPolicyFromEnv reads LOGIN_DURATION_IN_SECOND as the maximum lifetime and SESSION_IDLE_TIMEOUT_IN_SECOND
+func SessionPolicyFromEnv() (SessionPolicy, error) {
+	policy := SessionPolicy{IdleTimeout: defaultSessionIdleTimeout, SeenInterval: defaultSessionSeenInterval, MFATimeout: defaultSessionMFATimeout}
+	lifetime, err := strconv.ParseInt(os.Getenv("LOGIN_DURATION_IN_SECOND"), 10, 64)
+	if err != nil || lifetime <= 0 {
+		return policy, fmt.Errorf("empty or invalid setting for env LOGIN_DURATION_IN_SECOND: %s. expect positive INTEGER", os.Getenv("LOGIN_DURATION_IN_SECOND"))
+	}
+	policy.MaxLifetime = time.Duration(lifetime) * time.Second
+	if idle := os.Getenv("SESSION_IDLE_TIMEOUT_IN_SECOND"); idle != "" {
+		n, err := strconv.ParseInt(idle, 10, 64)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid setting for env SESSION_IDLE_TIMEOUT_IN_SECOND: %s. expect non negative INTEGER", idle)
+		}
+		policy.IdleTimeout = time.Duration(n) * time.Second
+	}
+	if policy.IdleTimeout > 0 && policy.IdleTimeout < 2*policy.SeenInterval {
+		return policy, fmt.Errorf("invalid setting for env SESSION_IDLE_TIMEOUT_IN_SECOND: %s. expect 0 or at least %d", os.Getenv("SESSION_IDLE_TIMEOUT_IN_SECOND"), int64(2*policy.SeenInterval/time.Second))
+	}
+	return policy, nil
+}
+
+const (
+	defaultPasswordMinLength     = 8
+	defaultPasswordMinClasses    = 2
+	defaultPasswordResetTTLHours = 24
+	// passwordMaxLength is the most bytes bcrypt looks at, see HashPassword
+	passwordMaxLength = 72
+)
+
+// PasswordPolicy decides which passwords are strong enough. MinClasses is how
+// many of lowercase letters, uppercase letters, digits and other characters a
+// password has to mix. Reset tokens issued by staff expire after ResetTokenTTL.
+type PasswordPolicy struct {
+	MinLength     int
+	MinClasses    int
+	ResetTokenTTL time.Duration
+}
+
+// Check returns what is wrong with password, nil when it is strong enough. It
+// can't contain the username either.
+func (p PasswordPolicy) Check(password, username string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if len(password) > passwordMaxLength {
+		return fmt.Errorf("password must be at most %d bytes long", passwordMaxLength)
+	}
+	var lower, upper, digit, other int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.MinClasses {
+		return fmt.Errorf("password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return fmt.Errorf("password can't contain the username")
+	}
+	return nil
+}
+
+// PasswordPolicyFromEnv reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_CHARACTER_CLASSES and PASSWORD_RESET_TTL_IN_HOURS
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+	policy := PasswordPolicy{
+		MinLength:     defaultPasswordMinLength,
+		MinClasses:    defaultPasswordMinClasses,
+		ResetTokenTTL: defaultPasswordResetTTLHours * time.Hour,
+	}
+	if length := os.Getenv("PASSWORD_MIN_LENGTH"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n <= 0 || n > passwordMaxLength {
+			return policy, fmt.Errorf("invalid setting for env PASSWORD_MIN_LENGTH: %s. expect INTEGER from 1 to %d", length, passwordMaxLength)
+		}
+		policy.MinLength = n
+	}
+	if classes := os.Getenv("PASSWORD_MIN_CHARACTER_CLASSES"); classes != "" {
+		n, err := strconv.Atoi(classes)
+		if err != nil || n < 0 || n > 4 {
+			return policy, fmt.Errorf("invalid setting for env PASSWORD_MIN_CHARACTER_CLASSES: %s. expect INTEGER from 0 to 4", classes)
+		}
+		policy.MinClasses = n
+	}
+	if hours := os.Getenv("PASSWORD_RESET_TTL_IN_HOURS"); hours != "" {
+		n, err := strconv.ParseInt(hours, 10, 64)
+		if err != nil || n <= 0 {
+			return policy, fmt.Errorf("invalid setting for env PASSWORD_RESET_TTL_IN_HOURS: %s. expect positive INTEGER", hours)
+		}
+		policy.ResetTokenTTL = time.Duration(n) * time.Hour
+	}
+	return policy, nil
+}
+
+const (
+	defaultLoginFreeAttempts     = 3
+	defaultLoginBaseDelay        = time.Second
+	defaultLoginMaxDelay         = 5 * time.Minute
+	defaultLoginLockoutThreshold = 10
+	defaultLoginLockout          = 30 * time.Minute
+	defaultLoginFailureWindow    = time.Hour
+)
+
+// LoginPolicy slows down guessing passwords. Failed logins are counted per
+// username and per IP, after FreeAttempts each failure blocks the next attempt
+// for BaseDelay, doubling up to MaxDelay, and LockoutThreshold failures lock
+// the key out for Lockout. Counts start over after FailureWindow without one.
+type LoginPolicy struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	Lockout          time.Duration
+	FailureWindow    time.Duration
+}
+
+// Delay is how long a key is blocked after its failures-th failed login
+func (p LoginPolicy) Delay(failures int) time.Duration {
+	if p.LockoutThreshold > 0 && failures >= p.LockoutThreshold {
+		return p.Lockout
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// LoginPolicyFromEnv reads LOGIN_FREE_ATTEMPTS, LOGIN_LOCKOUT_THRESHOLD and LOGIN_LOCKOUT_IN_SECOND
+func LoginPolicyFromEnv() (LoginPolicy, error) {
+	policy := LoginPolicy{
+		FreeAttempts:     defaultLoginFreeAttempts,
+		BaseDelay:        defaultLoginBaseDelay,
+		MaxDelay:         defaultLoginMaxDelay,
+		LockoutThreshold: defaultLoginLockoutThreshold,
+		Lockout:          defaultLoginLockout,
+		FailureWindow:    defaultLoginFailureWindow,
+	}
+	if attempts := os.Getenv("LOGIN_FREE_ATTEMPTS"); attempts != "" {
+		n, err := strconv.Atoi(attempts)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid setting for env LOGIN_FREE_ATTEMPTS: %s. expect INTEGER", attempts)
+		}
+		policy.FreeAttempts = n
+	}
+	if threshold := os.Getenv("LOGIN_LOCKOUT_THRESHOLD"); threshold != "" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid setting for env LOGIN_LOCKOUT_THRESHOLD: %s. expect INTEGER, 0 never locks out", threshold)
+		}
+		policy.LockoutThreshold = n
+	}
+	if lockout := os.Getenv("LOGIN_LOCKOUT_IN_SECOND"); lockout != "" {
+		n, err := strconv.ParseInt(lockout, 10, 64)
+		if err != nil || n <= 0 {
+			return policy, fmt.Errorf("invalid setting for env LOGIN_LOCKOUT_IN_SECOND: %s. expect positive INTEGER", lockout)
+		}
+		policy.Lockout = time.Duration(n) * time.Second
+	}
+	if policy.FailureWindow < policy.Lockout {
+		policy.FailureWindow = policy.Lockout
+	}
+	return policy, nil
+}
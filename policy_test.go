@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinePolicyLateFee(t *testing.T) {
+	day := 24 * time.Hour
+	dueAt := time.Date(2024, 3, 1, 17, 0, 0, 0, time.UTC)
+	policy := FinePolicy{FeePerDay: 10, GraceDays: 2, MaxFeePerItem: 50}
+	tests := []struct {
+		name   string
+		policy FinePolicy
+		late   time.Duration
+		want   int64
+	}{
+		{"returned early", policy, -day, 0},
+		{"returned when due", policy, 0, 0},
+		{"a second late within the grace days", policy, time.Second, 0},
+		{"at the end of the grace days", policy, 2 * day, 0},
+		{"a second past the grace days", policy, 2*day + time.Second, 10},
+		{"a whole day past the grace days", policy, 3 * day, 10},
+		{"a started second day past the grace days", policy, 3*day + time.Second, 20},
+		{"just under the cap", policy, 6 * day, 40},
+		{"at the cap", policy, 7 * day, 50},
+		{"a second past the cap", policy, 7*day + time.Second, 50},
+		{"long past the cap", policy, 60 * day, 50},
+		{"no cap", FinePolicy{FeePerDay: 10, GraceDays: 2}, 60 * day, 580},
+		{"no grace days", FinePolicy{FeePerDay: 10}, time.Second, 10},
+		{"late fees disabled", FinePolicy{GraceDays: 2, MaxFeePerItem: 50}, 60 * day, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.LateFee(dueAt, dueAt.Add(tt.late)); got != tt.want {
+			t.Errorf("%s: LateFee = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoginPolicyDelay(t *testing.T) {
+	policy := LoginPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 8 * time.Second, LockoutThreshold: 10, Lockout: 30 * time.Minute}
+	tests := []struct {
+		policy   LoginPolicy
+		failures int
+		want     time.Duration
+	}{
+		{policy, 0, 0},
+		{policy, 3, 0},
+		{policy, 4, time.Second},
+		{policy, 5, 2 * time.Second},
+		{policy, 6, 4 * time.Second},
+		{policy, 7, 8 * time.Second},
+		{policy, 9, 8 * time.Second},
+		{policy, 10, 30 * time.Minute},
+		{policy, 11, 30 * time.Minute},
+		{LoginPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 8 * time.Second}, 100, 8 * time.Second},
+		{LoginPolicy{BaseDelay: time.Second, MaxDelay: 8 * time.Second}, 1, time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Delay(tt.failures); got != tt.want {
+			t.Errorf("%+v: Delay(%d) = %v, want %v", tt.policy, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryLoginAttemptStore(t *testing.T) {
+	retryAfter := func(t *testing.T, store LoginAttemptStore, key string) time.Duration {
+		t.Helper()
+		wait, err := store.RetryAfter(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+	recordFailures := func(t *testing.T, store LoginAttemptStore, key string, n int) (blocked time.Duration) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			var err error
+			if blocked, err = store.RecordFailure(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return blocked
+	}
+
+	t.Run("blocks after the free attempts", func(t *testing.T) {
+		store := NewMemoryLoginAttemptStore(LoginPolicy{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, FailureWindow: time.Hour})
+		if blocked := recordFailures(t, store, "user:alice", 2); blocked != 0 || retryAfter(t, store, "user:alice") != 0 {
+			t.Fatalf("blocked within the free attempts")
+		}
+		if blocked := recordFailures(t, store, "user:alice", 1); blocked != time.Minute {
+			t.Fatalf("RecordFailure after the free attempts = %v, want %v", blocked, time.Minute)
+		}
+		if wait := retryAfter(t, store, "user:alice"); wait <= 0 || wait > time.Minute {
+			t.Errorf("RetryAfter = %v, want up to %v", wait, time.Minute)
+		}
+		// usernames and IPs are counted apart
+		if retryAfter(t, store, "user:bob") != 0 || retryAfter(t, store, "ip:192.0.2.1") != 0 {
+			t.Errorf("failures of one key block another")
+		}
+	})
+
+	t.Run("lockout expires", func(t *testing.T) {
+		lockout := 100 * time.Millisecond
+		store := NewMemoryLoginAttemptStore(LoginPolicy{FreeAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond,
+			LockoutThreshold: 3, Lockout: lockout, FailureWindow: time.Hour})
+		if blocked := recordFailures(t, store, "ip:192.0.2.1", 3); blocked != lockout {
+			t.Fatalf("RecordFailure at the lockout threshold = %v, want %v", blocked, lockout)
+		}
+		if wait := retryAfter(t, store, "ip:192.0.2.1"); wait <= 0 || wait > lockout {
+			t.Fatalf("RetryAfter = %v, want up to %v", wait, lockout)
+		}
+		time.Sleep(lockout + 50*time.Millisecond)
+		if wait := retryAfter(t, store, "ip:192.0.2.1"); wait != 0 {
+			t.Fatalf("RetryAfter after the lockout = %v, want 0", wait)
+		}
+		// the failures are kept within the window, the next one locks out again
+		if blocked := recordFailures(t, store, "ip:192.0.2.1", 1); blocked != lockout {
+			t.Errorf("RecordFailure after the lockout = %v, want %v", blocked, lockout)
+		}
+	})
+
+	t.Run("unlock", func(t *testing.T) {
+		store := NewMemoryLoginAttemptStore(LoginPolicy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Minute,
+			LockoutThreshold: 2, Lockout: time.Hour, FailureWindow: time.Hour})
+		recordFailures(t, store, userLoginKey("Alice "), 2)
+		if retryAfter(t, store, userLoginKey("alice")) == 0 {
+			t.Fatal("not locked out, usernames are counted case insensitively")
+		}
+		if err := store.ResetAttempts(userLoginKey("alice")); err != nil {
+			t.Fatal(err)
+		}
+		if wait := retryAfter(t, store, userLoginKey("alice")); wait != 0 {
+			t.Fatalf("RetryAfter after unlock = %v, want 0", wait)
+		}
+		if blocked := recordFailures(t, store, userLoginKey("alice"), 1); blocked != 0 {
+			t.Errorf("RecordFailure after unlock = %v, want the count to start over", blocked)
+		}
+	})
+
+	t.Run("counts start over after the failure window", func(t *testing.T) {
+		window := 50 * time.Millisecond
+		store := NewMemoryLoginAttemptStore(LoginPolicy{FreeAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, FailureWindow: window})
+		recordFailures(t, store, "user:alice", 1)
+		time.Sleep(window + 20*time.Millisecond)
+		if blocked := recordFailures(t, store, "user:alice", 1); blocked != 0 {
+			t.Errorf("RecordFailure after the window = %v, want 0", blocked)
+		}
+		time.Sleep(window + 20*time.Millisecond)
+		if pruned, err := store.PruneAttempts(); err != nil || pruned != 1 {
+			t.Errorf("PruneAttempts = %d, %v, want 1", pruned, err)
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Permissions are what a role allows, like `book:write`. The user permissions
+// are scoped by the role of the user they act on, `user:manage:borrower`, and
+// `*` stands for every role, `user:manage:*`.
+const (
+	PermAccount        = "account:self" // see and sign out of your own account and sessions
+	PermBookRead       = "book:read"
+	PermBookWrite      = "book:write"
+	PermCategoryWrite  = "category:write"
+	PermLoanOwn        = "loan:own"
+	PermLoanCreate     = "loan:create"
+	PermLoanRead       = "loan:read"
+	PermFineManage     = "fine:manage"
+	PermUserRead       = "user:read"
+	PermUserManage     = "user:manage"
+	PermAuditRead      = "audit:read"
+	PermRoleManage     = "role:manage"
+	permissionAllRoles = "*"
+)
+
+// PermissionInfo describes a permission for whoever edits roles, a scoped one
+// is granted per role as Name:<role> or Name:*
+type PermissionInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Scoped      bool   `json:"scoped"`
+}
+
+var permissionInfos = []PermissionInfo{
+	{Name: PermAccount, Description: "see your own account and manage your sessions"},
+	{Name: PermBookRead, Description: "browse and search the catalog"},
+	{Name: PermBookWrite, Description: "add, change and remove books, copies and authors, import and export the catalog"},
+	{Name: PermCategoryWrite, Description: "add, change and remove categories"},
+	{Name: PermLoanOwn, Description: "see and renew your own loans, place holds and see your fines"},
+	{Name: PermLoanCreate, Description: "lend, return and renew books and manage holds for any user"},
+	{Name: PermLoanRead, Description: "see the loans and holds of every user"},
+	{Name: PermFineManage, Description: "see the fines of any user, record payments and waive fines"},
+	{Name: PermUserRead, Description: "see users of a role", Scoped: true},
+	{Name: PermUserManage, Description: "add, change, remove and sign out users of a role", Scoped: true},
+	{Name: PermAuditRead, Description: "read the audit log"},
+	{Name: PermRoleManage, Description: "add, change and remove roles"},
+}
+
+// Role is a named set of permissions, the type of a user names their role.
+// Built-in roles can't be removed and the permissions of the admin role can't
+// be changed. Users of a role with RequireTOTP can only set up TOTP until they do.
+type Role struct {
+	Name        string      `json:"name" db:"name"`
+	Description string      `json:"description" db:"description"`
+	Permissions Permissions `json:"permissions" db:"permissions"`
+	RequireTOTP bool        `json:"require_totp" db:"require_totp"`
+	Builtin     bool        `json:"builtin" db:"builtin"`
+	UserCount   int64       `json:"user_count" db:"user_count"`
+}
+
+// Permissions scans the array of permissions of a role
+type Permissions []string
+
+func (p *Permissions) Scan(src interface{}) error {
+	var permissions pq.StringArray
+	if err := permissions.Scan(src); err != nil {
+		return err
+	}
+	*p = Permissions(permissions)
+	return nil
+}
+
+func (p Permissions) Value() (driver.Value, error) {
+	return pq.StringArray(p).Value()
+}
+
+// Can tells whether the permissions allow permission. A scoped permission is
+// matched by its wildcard, and an unscoped check like `user:manage` passes with
+// any scope of it: routes check the permission, handlers then check its scope.
+func (p Permissions) Can(permission string) bool {
+	for _, granted := range p {
+		if granted == permission || strings.HasPrefix(granted, permission+":") {
+			return true
+		}
+		if scope := strings.TrimSuffix(granted, permissionAllRoles); scope != granted && strings.HasPrefix(permission, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePermissions tells whether a and b grant the same permissions in any order
+func samePermissions(a, b Permissions) bool {
+	a, b = append(Permissions{}, a...), append(Permissions{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, " ") == strings.Join(b, " ")
+}
+
+// CanOnRole tells whether the permissions allow the scoped permission on users of role
+func (p Permissions) CanOnRole(permission, role string) bool {
+	return p.Can(permission + ":" + role)
+}
+
+var roleName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// validateRole normalizes the name and permissions of a role, scoped
+// permissions have to name a role in roles or the role itself
+func validateRole(role *Role, roles map[string]bool) error {
+	role.Name = strings.ToLower(strings.TrimSpace(role.Name))
+	role.Description = strings.TrimSpace(role.Description)
+	if !roleName.MatchString(role.Name) {
+		return fmt.Errorf("invalid name %q, expect lowercase letters, digits, dots, dashes and underscores", role.Name)
+	}
+	seen := make(map[string]bool, len(role.Permissions))
+	permissions := Permissions{}
+	for _, permission := range role.Permissions {
+		permission = strings.ToLower(strings.TrimSpace(permission))
+		if seen[permission] {
+			continue
+		}
+		seen[permission] = true
+		if !validPermission(permission, role.Name, roles) {
+			return fmt.Errorf("unknown permission %q", permission)
+		}
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	role.Permissions = permissions
+	return nil
+}
+
+func validPermission(permission, self string, roles map[string]bool) bool {
+	for _, info := range permissionInfos {
+		if !info.Scoped {
+			if permission == info.Name {
+				return true
+			}
+			continue
+		}
+		if scope := strings.TrimPrefix(permission, info.Name+":"); scope != permission {
+			return scope == permissionAllRoles || scope == self || roles[scope]
+		}
+	}
+	return false
+}
+
+// Authorize lets the request through to next when the route allows the user,
+// it goes behind AuthMiddleware
+func (h *Handler) Authorize(route Route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithFields(logrus.Fields{"route": r.RequestURI, "permission": route.Permission})
+		user := r.Context().Value("user").(GetSessionResponse)
+		var roles []string
+		if route.Accounts != nil {
+			known, err := h.knownRoles()
+			if err != nil {
+				logger.WithError(err).Info("list roles failed")
+				h.JSONInternalServerError(w, "list roles failed")
+				return
+			}
+			for role := range known {
+				roles = append(roles, role)
+			}
+		}
+		if !route.Allows(user.Permissions, roles) {
+			logger.Info("unauthorized")
+			h.JSONUnauthorized(w, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rolesAllowed lists the roles whose users the requestor has the scoped permission on
+func (h *Handler) rolesAllowed(requestor GetSessionResponse, permission string) ([]string, error) {
+	roles, err := h.RoleStore.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	var allowed []string
+	for _, role := range roles {
+		if requestor.Permissions.CanOnRole(permission, role.Name) {
+			allowed = append(allowed, role.Name)
+		}
+	}
+	return allowed, nil
+}
+
+// knownRoles is the set of the names of all roles
+func (h *Handler) knownRoles() (map[string]bool, error) {
+	roles, err := h.RoleStore.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		known[role.Name] = true
+	}
+	return known, nil
+}
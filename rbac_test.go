@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPermissionsCan(t *testing.T) {
+	tests := []struct {
+		name       string
+		granted    Permissions
+		permission string
+		want       bool
+	}{
+		{"exact grant", Permissions{PermBookRead}, PermBookRead, true},
+		{"other permission", Permissions{PermBookRead}, PermBookWrite, false},
+		{"no permissions", nil, PermBookRead, false},
+		{"scoped grant passes the unscoped check", Permissions{"user:manage:borrower"}, PermUserManage, true},
+		{"scoped grant on its role", Permissions{"user:manage:borrower"}, "user:manage:borrower", true},
+		{"scoped grant on another role", Permissions{"user:manage:borrower"}, "user:manage:librarian", false},
+		{"scoped grant of another permission", Permissions{"user:read:borrower"}, PermUserManage, false},
+		{"wildcard passes the unscoped check", Permissions{"user:manage:*"}, PermUserManage, true},
+		{"wildcard on any role", Permissions{"user:manage:*"}, "user:manage:volunteer", true},
+		{"wildcard of another permission", Permissions{"user:read:*"}, "user:manage:borrower", false},
+		{"wildcard doesn't match a longer name", Permissions{"user:manage:*"}, "user:managers", false},
+	}
+	for _, tt := range tests {
+		if got := tt.granted.Can(tt.permission); got != tt.want {
+			t.Errorf("%s: %v.Can(%q) = %v, want %v", tt.name, tt.granted, tt.permission, got, tt.want)
+		}
+	}
+}
+
+func TestValidPermission(t *testing.T) {
+	roles := map[string]bool{Admin: true, Librarian: true, Borrower: true}
+	tests := []struct {
+		permission string
+		want       bool
+	}{
+		{PermBookRead, true},
+		{"user:manage:borrower", true},
+		{"user:manage:*", true},
+		{"user:manage:volunteer", true}, // the role being saved
+		{"user:read:volunteer", true},
+		{"user:manage:ghost", false},
+		{"user:manage", false},
+		{"book:read:borrower", false},
+		{"book:delete", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validPermission(tt.permission, "volunteer", roles); got != tt.want {
+			t.Errorf("validPermission(%q) = %v, want %v", tt.permission, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRole(t *testing.T) {
+	role := Role{Name: " Volunteer ", Description: " lends books ", Permissions: Permissions{" LOAN:CREATE", PermBookRead, "loan:create"}}
+	if err := validateRole(&role, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := Role{Name: "volunteer", Description: "lends books", Permissions: Permissions{PermBookRead, PermLoanCreate}}
+	if !reflect.DeepEqual(role, want) {
+		t.Errorf("validateRole = %+v, want %+v", role, want)
+	}
+	for _, role := range []Role{{Name: "branch manager"}, {Name: ""}, {Name: "ok", Permissions: Permissions{"user:manage:ghost"}}} {
+		if err := validateRole(&role, nil); err == nil {
+			t.Errorf("validateRole(%+v) accepted an invalid role", role)
+		}
+	}
+}
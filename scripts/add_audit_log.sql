@@ -0,0 +1,29 @@
+-- run once on a database created before the audit log, changes made before it
+-- are not recorded
+begin ;
+-- create table audit_log, who changed what. actor_id has no foreign key so the
+-- entries of removed users are kept, actor is their username at the time
+ CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INT,
+    actor  text NOT NULL DEFAULT '',
+    action  text NOT NULL,
+    entity  text NOT NULL DEFAULT '',
+    entity_id BIGINT,
+    changes jsonb NOT NULL DEFAULT '{}',
+    ip  text NOT NULL DEFAULT '',
+    request_id  text NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+create index audit_log_actor_id on audit_log(actor_id, id);
+create index audit_log_entity on audit_log(entity, entity_id, id);
+create index audit_log_created_at on audit_log(created_at);
+CREATE OR REPLACE FUNCTION forbid_audit_log_change()
+RETURNS TRIGGER AS $$
+BEGIN
+   RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ language 'plpgsql';
+create trigger audit_log_append_only before UPDATE OR DELETE on audit_log for each statement execute procedure forbid_audit_log_change();
+create trigger audit_log_no_truncate before TRUNCATE on audit_log for each statement execute procedure forbid_audit_log_change();
+commit ;
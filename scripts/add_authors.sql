@@ -0,0 +1,44 @@
+-- run once on a database created before authors had their own table. the
+-- names in books.author are split on ';' and credited as authors, the same
+-- way a book added with only an author string is, see validateBook
+begin ;
+-- create table authors, books.author keeps the names of the authors of a book for display and search
+ CREATE TABLE IF NOT EXISTS authors (
+    id SERIAL PRIMARY KEY,
+    name  text NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+create trigger update_authors_updated_at before UPDATE on authors for each row execute procedure update_updated_at_column();
+create unique index authors_name on authors((lower(name)));
+
+-- create table book_authors, the credits of a book in order
+ CREATE TABLE IF NOT EXISTS book_authors (
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    author_id INT NOT NULL REFERENCES authors(id) ON DELETE CASCADE,
+    role  text NOT NULL DEFAULT 'author',
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, author_id, role),
+    constraint validate_author_role CHECK (role IN ('author','editor','translator'))
+);
+create index book_authors_author_id on book_authors(author_id);
+
+-- the names of each book without blanks and repeats, in the order they were written
+create temporary table book_author_names on commit drop as
+select distinct on (book_id, lower(name)) book_id, name, position
+from (
+    select b.id as book_id, regexp_replace(trim(n.name), '\s+', ' ', 'g') as name, n.position::int - 1 as position
+    from books b, unnest(string_to_array(b.author, ';')) with ordinality as n(name, position)
+) names
+where name <> ''
+order by book_id, lower(name), position;
+
+-- the first spelling of a name met becomes the name of the author
+insert into authors (name)
+select distinct on (lower(name)) name from book_author_names order by lower(name), book_id, position;
+insert into book_authors (book_id, author_id, position)
+select n.book_id, a.id, n.position from book_author_names n join authors a on lower(a.name) = lower(n.name);
+update books b set author = n.names
+from (select book_id, string_agg(name, '; ' order by position) as names from book_author_names group by book_id) n
+where n.book_id = b.id;
+commit ;
@@ -0,0 +1,52 @@
+-- run once on a database created before book copies. books.count held the
+-- copies on the shelf and went down on borrowing, so every book gets count
+-- available copies plus a borrowed copy for each loan still out. returned
+-- loans point at a copy of their book, a retired one if it has none left
+begin ;
+-- create table book_copies, one row per physical copy of a book
+ CREATE TABLE IF NOT EXISTS book_copies (
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    barcode  text NOT NULL UNIQUE,
+    shelf_location  text NOT NULL DEFAULT '',
+    condition  text NOT NULL DEFAULT 'good',
+    status  text NOT NULL DEFAULT 'available',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    constraint validate_copy_condition CHECK (condition IN ('new','good','fair','poor','damaged')),
+    constraint validate_copy_status CHECK (status IN ('available','borrowed','lost','retired'))
+);
+create index book_copies_book_id_status on book_copies(book_id, status);
+create trigger update_book_copies_updated_at before UPDATE on book_copies for each row execute procedure update_updated_at_column();
+
+-- barcodes look like the ones newBarcode in store.go generates
+insert into book_copies (book_id, barcode)
+select b.id, lpad(b.id::text, 6, '0') || '-' || upper(substr(md5(random()::text || n), 1, 8))
+from books b, generate_series(1, b.count) n;
+
+alter table borrow_history add column copy_id INT REFERENCES book_copies(id) ON DELETE CASCADE;
+do $$
+declare
+    loan record;
+    picked INT;
+begin
+    for loan in select id, book_id, returned from borrow_history order by id loop
+        picked := null;
+        if loan.returned then
+            select id into picked from book_copies where book_id = loan.book_id order by id limit 1;
+        end if;
+        if picked is null then
+            insert into book_copies (book_id, barcode, status)
+            values (loan.book_id, lpad(loan.book_id::text, 6, '0') || '-' || upper(substr(md5(random()::text || loan.id), 1, 8)),
+                case when loan.returned then 'retired' else 'borrowed' end)
+            returning id into picked;
+        end if;
+        update borrow_history set copy_id = picked where id = loan.id;
+    end loop;
+end
+$$;
+alter table borrow_history alter column copy_id set not null;
+
+alter table books drop constraint positive_count;
+alter table books drop column count;
+commit ;
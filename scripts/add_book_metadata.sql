@@ -0,0 +1,18 @@
+-- run once on a database created before ISBNs and bibliographic metadata.
+-- existing books have no ISBN and an empty edition, so they stay unique by
+-- title and author
+begin ;
+alter table books add column isbn  text UNIQUE; -- normalized ISBN-13, see NormalizeISBN
+alter table books add column publisher  text NOT NULL DEFAULT '';
+alter table books add column publication_year INT;
+alter table books add column edition  text NOT NULL DEFAULT '';
+alter table books add column language  text NOT NULL DEFAULT '';
+alter table books add column page_count INT;
+alter table books add column description  text NOT NULL DEFAULT '';
+alter table books add column subjects  text[] NOT NULL DEFAULT '{}';
+alter table books add constraint validate_book_isbn CHECK (isbn ~ '^97[89][0-9]{10}$');
+alter table books add constraint validate_book_page_count CHECK (page_count > 0);
+-- other editions of a book can be added under the same title and author
+alter table books drop constraint unique_book_per_author;
+alter table books add constraint unique_book_edition UNIQUE(title, author, edition);
+commit ;
@@ -0,0 +1,11 @@
+-- run once on a database created before full-text search, postgres computes
+-- the search vector of the books already in the catalog
+begin ;
+-- full-text index of the catalog, title matches rank above author matches above type matches
+alter table books add column search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', title), 'A') ||
+    setweight(to_tsvector('simple', coalesce(author, '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce(type, '')), 'C')
+) STORED;
+create index books_search_vector on books using gin(search_vector);
+commit ;
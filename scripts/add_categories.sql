@@ -0,0 +1,44 @@
+-- run once on a database created before the category tree. every free-text
+-- book type becomes a top-level category, its slug lowercased with the runs of
+-- other characters than letters, digits, '.', '_' and '-' replaced by '-'.
+-- books without a type get no category
+begin ;
+-- create table categories, a tree of categories books are shelved under
+ CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    parent_id INT REFERENCES categories(id) ON DELETE RESTRICT,
+    slug  text NOT NULL UNIQUE,
+    name  text NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    constraint validate_category_slug CHECK (slug ~ '^[a-z0-9][a-z0-9._-]*$')
+);
+create trigger update_categories_updated_at before UPDATE on categories for each row execute procedure update_updated_at_column();
+create index categories_parent_id on categories(parent_id);
+insert into categories(slug, name) values
+('fiction', 'Fiction'), ('non-fiction', 'Non-fiction'), ('spiritual', 'Spiritual'), ('others', 'Others');
+
+-- create table book_categories, the categories of a book in order
+ CREATE TABLE IF NOT EXISTS book_categories (
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    category_id INT NOT NULL REFERENCES categories(id) ON DELETE RESTRICT,
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, category_id)
+);
+create index book_categories_category_id on book_categories(category_id);
+
+create temporary table book_type_slugs on commit drop as
+select id as book_id, trim(type) as name,
+    nullif(trim(both '-._' from regexp_replace(lower(trim(type)), '[^a-z0-9._-]+', '-', 'g')), '') as slug
+from books;
+insert into categories (slug, name)
+select distinct on (slug) slug, name from book_type_slugs where slug is not null order by slug, book_id
+on conflict (slug) do nothing;
+insert into book_categories (book_id, category_id)
+select s.book_id, c.id from book_type_slugs s join categories c on c.slug = s.slug;
+
+-- books.type is the slug of the first category of the book, see book_categories
+alter table books alter column type drop default;
+update books b set type = s.slug from book_type_slugs s where s.book_id = b.id;
+alter table books add constraint book_type_category FOREIGN KEY (type) REFERENCES categories(slug) ON UPDATE CASCADE ON DELETE RESTRICT;
+commit ;
@@ -0,0 +1,19 @@
+-- run once on a database created before fines, after migrate-loan-history.
+-- loans returned late before it are not charged
+begin ;
+-- create table fines, the fee ledger of each user. amounts are in the smallest currency unit,
+-- charges are positive, payments and waivers negative, the balance is their sum
+ CREATE TABLE IF NOT EXISTS fines (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    borrow_history_id INT REFERENCES borrow_history(id) ON DELETE SET NULL,
+    kind  text NOT NULL,
+    amount BIGINT NOT NULL,
+    note  text NOT NULL DEFAULT '',
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    constraint validate_fine_kind CHECK (kind IN ('charge','payment','waiver')),
+    constraint validate_fine_amount CHECK ((kind = 'charge' AND amount > 0) OR (kind <> 'charge' AND amount < 0))
+);
+create index fines_user_id on fines(user_id, id);
+commit ;
@@ -0,0 +1,22 @@
+-- run once on a database created before holds, after migrate-book-copies. a
+-- copy set aside for a ready hold is on_hold until its borrower picks it up
+begin ;
+alter table book_copies drop constraint validate_copy_status;
+alter table book_copies add constraint validate_copy_status CHECK (status IN ('available','borrowed','on_hold','lost','retired'));
+
+-- create table holds, the FIFO reservation queue of each book
+ CREATE TABLE IF NOT EXISTS holds (
+    id SERIAL PRIMARY KEY,
+    book_id INT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    copy_id INT REFERENCES book_copies(id) ON DELETE SET NULL,
+    status  text NOT NULL DEFAULT 'waiting',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ready_at TIMESTAMPTZ,
+    pickup_by TIMESTAMPTZ,
+    closed_at TIMESTAMPTZ,
+    constraint validate_hold_status CHECK (status IN ('waiting','ready','fulfilled','cancelled','expired'))
+);
+create unique index holds_one_active_per_user on holds(book_id, user_id) where status in ('waiting','ready');
+create index holds_queue on holds(book_id, id) where status = 'waiting';
+commit ;
@@ -0,0 +1,12 @@
+-- run once on a database created before failed logins were throttled, only
+-- needed when LOGIN_ATTEMPT_STORE is sql
+begin ;
+-- create table login_attempts, the failed logins per username and IP when
+-- LOGIN_ATTEMPT_STORE is sql, see LoginPolicy
+ CREATE TABLE IF NOT EXISTS login_attempts (
+    key text PRIMARY KEY, -- `user:<username>` or `ip:<address>`
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    blocked_until TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+commit ;
@@ -0,0 +1,15 @@
+-- run once on a database created before staff could issue password resets
+begin ;
+-- create table password_resets, one-time tokens staff issue to reset a password
+ CREATE TABLE IF NOT EXISTS password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash  text NOT NULL UNIQUE, -- SHA-256 of the token, see HashToken
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    constraint validate_password_reset_token_hash CHECK (token_hash ~ '^[0-9a-f]{64}$')
+);
+create index password_resets_user_id on password_resets(user_id);
+commit ;
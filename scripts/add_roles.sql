@@ -0,0 +1,33 @@
+-- run once on a database created before roles, it adds the built-in roles
+-- with the permissions the user types used to have
+begin ;
+-- create table roles, the type of a user names their role, see rbac.go
+ CREATE TABLE IF NOT EXISTS roles (
+    name text PRIMARY KEY,
+    description text NOT NULL DEFAULT '',
+    builtin boolean NOT NULL DEFAULT false, -- built-in roles can't be removed
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+create trigger update_roles_updated_at before UPDATE on roles for each row execute procedure update_updated_at_column();
+ CREATE TABLE IF NOT EXISTS role_permissions (
+    role text NOT NULL REFERENCES roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission text NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+insert into roles(name, description, builtin) values
+('admin', 'runs the library system', true),
+('librarian', 'runs the catalog, loans and borrowers', true),
+('borrower', 'borrows books', true);
+insert into role_permissions(role, permission) values
+('admin', 'account:self'), ('admin', 'book:read'), ('admin', 'book:write'), ('admin', 'category:write'),
+('admin', 'loan:own'), ('admin', 'loan:create'), ('admin', 'loan:read'), ('admin', 'fine:manage'),
+('admin', 'user:read:*'), ('admin', 'user:manage:*'), ('admin', 'audit:read'), ('admin', 'role:manage'),
+('librarian', 'account:self'), ('librarian', 'book:read'), ('librarian', 'book:write'), ('librarian', 'category:write'),
+('librarian', 'loan:own'), ('librarian', 'loan:create'), ('librarian', 'loan:read'), ('librarian', 'fine:manage'),
+('librarian', 'user:read:librarian'), ('librarian', 'user:read:borrower'), ('librarian', 'user:manage:borrower'),
+('borrower', 'account:self'), ('borrower', 'book:read'), ('borrower', 'loan:own');
+
+alter table users drop constraint validate_user_type;
+alter table users add constraint users_type_role FOREIGN KEY (type) REFERENCES roles(name) ON UPDATE CASCADE ON DELETE RESTRICT;
+commit ;
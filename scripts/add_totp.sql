@@ -0,0 +1,21 @@
+-- run once on a database created before two-factor authentication
+begin ;
+alter table roles add column if not exists require_totp boolean NOT NULL DEFAULT false;
+alter table sessions add column if not exists mfa_pending boolean NOT NULL DEFAULT false;
+-- create table user_totp, the authenticator of a user, enabled once confirmed_at is set
+ CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret  text NOT NULL, -- base32, see NewTOTPSecret
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    confirmed_at TIMESTAMP,
+    last_step BIGINT -- time step of the last code used, so a code works only once
+);
+-- create table recovery_codes, one-time codes for when the authenticator is lost
+ CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash  text NOT NULL, -- bcrypt of the code, see hashRecoveryCode
+    used_at TIMESTAMP
+);
+create index if not exists recovery_codes_user_id on recovery_codes(user_id);
+commit ;
@@ -0,0 +1,18 @@
+-- run once on a database created before the trash, after migrate-book-metadata.
+-- the unique constraints only hold among the users and books not in the trash
+begin ;
+alter table users add column deleted_at TIMESTAMP; -- set while the user is in the trash, purged after DELETED_RETENTION_IN_DAYS
+alter table books add column deleted_at TIMESTAMP; -- set while the book is in the trash, purged after DELETED_RETENTION_IN_DAYS
+
+-- users in the trash don't hold on to their email and username
+alter table users drop constraint users_email_key;
+alter table users drop constraint users_username_key;
+create unique index users_email on users(email) where deleted_at is null;
+create unique index users_username on users(username) where deleted_at is null;
+
+-- books in the trash don't block adding the same book again
+alter table books drop constraint books_isbn_key;
+alter table books drop constraint unique_book_edition;
+create unique index books_isbn on books(isbn) where deleted_at is null;
+create unique index books_unique_edition on books(title, author, edition) where deleted_at is null;
+commit ;
@@ -0,0 +1,11 @@
+-- run once on a database created before session tokens were hashed, after
+-- migrate-multiple-sessions. sessions stored the token itself, they are all
+-- dropped and everybody logs in again
+begin ;
+delete from sessions;
+alter table sessions rename column session_id to token_hash;
+-- named like the constraint of a fresh database
+alter table sessions drop constraint sessions_session_id_key;
+alter table sessions add constraint sessions_token_hash_key UNIQUE (token_hash);
+alter table sessions add constraint validate_session_token_hash CHECK (token_hash ~ '^[0-9a-f]{64}$');
+commit ;
@@ -0,0 +1,27 @@
+-- run once on a database created before loans kept their history, after
+-- migrate-book-copies. it also adds due dates and renewals: existing loans are
+-- due 14 days, the default loan period, after they were borrowed and the time
+-- returned loans came back is unknown
+begin ;
+alter table borrow_history add column due_at TIMESTAMPTZ;
+update borrow_history set due_at = borrowed_at + interval '14 days';
+alter table borrow_history alter column due_at set not null;
+alter table borrow_history add column returned_at TIMESTAMPTZ;
+alter table borrow_history add column renewal_count INT NOT NULL DEFAULT 0;
+create index borrow_history_overdue on borrow_history(due_at) where not returned;
+
+-- create table loan_renewals, one row per due date extension
+ CREATE TABLE IF NOT EXISTS loan_renewals (
+    id SERIAL PRIMARY KEY,
+    borrow_history_id INT NOT NULL REFERENCES borrow_history(id) ON DELETE CASCADE,
+    renewed_by INT REFERENCES users(id) ON DELETE SET NULL,
+    previous_due_at TIMESTAMPTZ NOT NULL,
+    new_due_at TIMESTAMPTZ NOT NULL,
+    renewed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- a borrower can borrow the same book again after returning it, but not twice at the same time
+alter table borrow_history drop constraint unique_book_per_borrower;
+create unique index borrow_history_one_active_loan on borrow_history(book_id, user_id) where not returned;
+create index borrow_history_user_book on borrow_history(user_id, book_id);
+commit ;
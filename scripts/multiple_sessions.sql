@@ -0,0 +1,17 @@
+-- run once on a database created before users could have several sessions,
+-- before migrate-session-tokens. a session keeps the time it was last used
+-- as the time it was created and last seen, its device is unknown
+begin ;
+delete from sessions where user_id is null;
+alter table sessions drop constraint sessions_user_id_key;
+alter table sessions alter column user_id set not null;
+alter table sessions add constraint sessions_session_id_key UNIQUE (session_id);
+alter table sessions add column user_agent  text NOT NULL DEFAULT '';
+alter table sessions add column ip  text NOT NULL DEFAULT '';
+alter table sessions add column created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+alter table sessions add column last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+update sessions set created_at = updated_at, last_seen_at = updated_at;
+drop trigger update_sessions_updated_at on sessions;
+alter table sessions drop column updated_at;
+create index sessions_user_id on sessions(user_id);
+commit ;
@@ -18,12 +18,12 @@ declare -i cnt=0
 declare -a book_ids
 for file in images/*
 do
-  path="$(curl -H "cookie: ${cookie}" -v -F "file=@$file" http://localhost:8080/admin/uploadimage | jq -r .path)"
+  path="$(curl -H "cookie: ${cookie}" -v -F "file=@$file" http://localhost:8080/librarian/uploadimage | jq -r .path)"
   if [ "$path" == "null" ]; then
     echo "Failed to upload image $file"
     exit 1
   fi
-  book_id=$(curl 'http://localhost:8080/librarian/book' -H "Cookie: ${cookie}" --data-raw "{\"title\":\"book_${cnt}\",\"author\":\"author_${cnt}\",\"count\":1,\"type\":\"fiction\",\"cover\":\"${path}\"}" | jq -r .id)
+  book_id=$(curl 'http://localhost:8080/librarian/book' -H "Cookie: ${cookie}" --data-raw "{\"title\":\"book_${cnt}\",\"author\":\"author_${cnt}\",\"copies\":1,\"type\":\"fiction\",\"cover\":\"${path}\"}" | jq -r .id)
   if [ "$book_id" == "null" ]; then
     echo "Failed to add book $cnt"
     exit 1
@@ -32,27 +32,26 @@ do
   book_ids+=($book_id)
 done
 
-# add some users
-declare -a user_ids
-borrower_password="brr"
+# add some users in one CSV import, borrowers first
+borrower_password="brr-Pass-1"
+librarian_password="lbr-Pass-1"
+users_csv="$(mktemp)"
+trap 'rm -rf images "$users_csv"' EXIT
+echo "email,username,password,type" > "$users_csv"
 for i in {1..10}
 do
-    user_id=$(curl 'http://localhost:8080/admin/user' -H "Cookie: ${cookie}" --data-raw "{\"username\":\"borrower${i}\",\"password\":\"${borrower_password}\",\"type\":\"borrower\", \"email\":\"borrower${i}@localhost.com\"}" | jq -r .id)
-    if [ "$user_id" == "null" ]; then
-      echo "Failed to add borrower $i"
-      exit 1
-    fi
-  user_ids+=($user_id)
+  echo "borrower${i}@localhost.com,borrower${i},${borrower_password},borrower" >> "$users_csv"
 done
-librarian_password="lbr"
 for i in {1..3}
 do
-  curl 'http://localhost:8080/admin/user' -H "Cookie: ${cookie}" --data-raw "{\"username\":\"librarian${i}\",\"password\":\"${librarian_password}\",\"type\":\"librarian\", \"email\":\"librarian${i}@localhost.com\"}"
-    if [ "$user_id" == "null" ]; then
-      echo "Failed to add librarian $i"
-      exit 1
-    fi
+  echo "librarian${i}@localhost.com,librarian${i},${librarian_password},librarian" >> "$users_csv"
 done
+report="$(curl 'http://localhost:8080/admin/users/import' -H "Cookie: ${cookie}" -F "file=@${users_csv}")"
+if [ "$(echo "$report" | jq -r .committed)" != "true" ]; then
+  echo "Failed to add users: $report"
+  exit 1
+fi
+declare -a user_ids=($(echo "$report" | jq -r '.rows[0:10][].id'))
 
 # some users borrow some books
 for uid in "${user_ids[@]:0:5}"
@@ -4,13 +4,23 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
@@ -21,83 +31,490 @@ const (
 	Borrower         = "borrower"
 )
 
+const (
+	CopyAvailable string = "available"
+	CopyBorrowed         = "borrowed"
+	CopyOnHold           = "on_hold" // set aside for the borrower at the head of the holds queue
+	CopyLost             = "lost"
+	CopyRetired          = "retired"
+)
+
+const (
+	FineCharge  string = "charge"
+	FinePayment        = "payment"
+	FineWaiver         = "waiver"
+)
+
+const (
+	HoldWaiting   string = "waiting"
+	HoldReady            = "ready" // a copy is set aside until pickup_by
+	HoldFulfilled        = "fulfilled"
+	HoldCancelled        = "cancelled"
+	HoldExpired          = "expired"
+)
+
 type User struct {
-	ID        int64     `json:"id,omitempty" db:"id"`
-	Email     string    `json:"email,omitempty" db:"email"`
-	UserName  string    `json:"username,omitempty" db:"username"`
-	Password  string    `json:"password,omitempty" db:"password"`
-	Type      string    `json:"type,omitempty" db:"type"`
-	CreatedAt time.Time `json:"-" db:"created_at"`
-	UpdatedAt time.Time `json:"-" db:"updated_at"`
+	ID        int64      `json:"id,omitempty" db:"id"`
+	Email     string     `json:"email,omitempty" db:"email"`
+	UserName  string     `json:"username,omitempty" db:"username"`
+	Password  string     `json:"password,omitempty" db:"password"`
+	Type      string     `json:"type,omitempty" db:"type"`
+	CreatedAt time.Time  `json:"-" db:"created_at"`
+	UpdatedAt time.Time  `json:"-" db:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
 type Book struct {
-	ID        int64     `json:"id,omitempty" db:"id"`
-	Title     string    `json:"title,omitempty" db:"title"`
-	Author    string    `json:"author,omitempty" db:"author"`
-	Type      string    `json:"type,omitempty" db:"type"`
-	CoverUrl  string    `json:"cover" db:"cover"`
-	Count     int       `json:"count" db:"count"`
-	CreatedAt time.Time `json:"-" db:"created_at"`
-	UpdatedAt time.Time `json:"-" db:"updated_at"`
+	ID              int64          `json:"id,omitempty" db:"id"`
+	Title           string         `json:"title,omitempty" db:"title"`
+	Author          string         `json:"author,omitempty" db:"author"`
+	Type            string         `json:"type,omitempty" db:"type"` // slug of the first of Categories
+	CoverUrl        string         `json:"cover" db:"cover"`
+	ISBN            string         `json:"isbn,omitempty" db:"isbn"` // normalized ISBN-13
+	Publisher       string         `json:"publisher,omitempty" db:"publisher"`
+	PublicationYear int            `json:"publication_year,omitempty" db:"publication_year"`
+	Edition         string         `json:"edition,omitempty" db:"edition"`
+	Language        string         `json:"language,omitempty" db:"language"`
+	PageCount       int            `json:"page_count,omitempty" db:"page_count"`
+	Description     string         `json:"description,omitempty" db:"description"`
+	Subjects        pq.StringArray `json:"subjects" db:"subjects"`
+	Authors         BookAuthors    `json:"authors" db:"authors"` // Author is kept as their display name
+	Categories      BookCategories `json:"categories" db:"categories"`
+	TotalCopies     int            `json:"total_copies" db:"total_copies"`         // derived from book_copies, read only
+	AvailableCopies int            `json:"available_copies" db:"available_copies"` // derived from book_copies, read only
+	CreatedAt       time.Time      `json:"-" db:"created_at"`
+	UpdatedAt       time.Time      `json:"-" db:"updated_at"`
+	DeletedAt       *time.Time     `json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+const (
+	AuthorRoleAuthor     string = "author"
+	AuthorRoleEditor            = "editor"
+	AuthorRoleTranslator        = "translator"
+)
+
+// Author is a person credited on books, spelled the same way across the catalog
+type Author struct {
+	ID        int64     `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	BookCount int64     `json:"book_count" db:"book_count"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// BookAuthor credits an author on a book, in the order of the credits
+type BookAuthor struct {
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// BookAuthors scans the JSON array built by bookColumns
+type BookAuthors []BookAuthor
+
+func (a *BookAuthors) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = BookAuthors{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	default:
+		return fmt.Errorf("unsupported type %T for book authors", src)
+	}
+}
+
+// bookAuthorSeparator joins the names of the authors of a book into books.author.
+// It is not a comma as catalogued names look like `Surname, Name`.
+const bookAuthorSeparator = "; "
+
+// DisplayName joins the names of the credited authors, or of everyone credited
+// when the book only has editors or translators
+func (a BookAuthors) DisplayName() string {
+	var names, all []string
+	for _, author := range a {
+		all = append(all, author.Name)
+		if author.Role == AuthorRoleAuthor {
+			names = append(names, author.Name)
+		}
+	}
+	if len(names) == 0 {
+		names = all
+	}
+	return strings.Join(names, bookAuthorSeparator)
+}
+
+// Category is a node of the category tree books are shelved under. Path joins
+// the slugs from the root down to the category.
+type Category struct {
+	ID        int64     `json:"id" db:"id"`
+	ParentID  *int64    `json:"parent_id" db:"parent_id"`
+	Slug      string    `json:"slug" db:"slug"`
+	Name      string    `json:"name" db:"name"`
+	Path      string    `json:"path" db:"path"`
+	BookCount int64     `json:"book_count" db:"book_count"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// BookCategory assigns a book to a category, given by ID or Slug on write
+type BookCategory struct {
+	ID   int64  `json:"id,omitempty" db:"id"`
+	Slug string `json:"slug" db:"slug"`
+	Name string `json:"name,omitempty" db:"name"`
+}
+
+// BookCategories scans the JSON array built by bookColumns
+type BookCategories []BookCategory
+
+func (c *BookCategories) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*c = BookCategories{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("unsupported type %T for book categories", src)
+	}
+}
+
+// ListBooksOptions sorts the catalog by Sort, one of the keys of bookSortKeys,
+// in Order asc or desc, with ties broken by id. Cursor is the nextCursor
+// returned with the previous page, empty for the first page.
+type ListBooksOptions struct {
+	Sort     string
+	Order    string
+	Category string // slug, matches the category and all its descendants
+	Author   string
+	Cursor   string
+	Limit    int64
+	LastID   int64 // legacy id cursor, only honoured when sorting by id without Cursor
+}
+
+// BookSearch is a catalog search. Query is free text matched against title,
+// author and type, the other fields narrow the result down. Cursor is the
+// nextCursor returned with the previous page, empty for the first page.
+type BookSearch struct {
+	Query     string
+	Category  string // slug, matches the category and all its descendants
+	Author    string
+	Available bool
+	Cursor    string
+	Limit     int64
+}
+
+// BookCopy is a physical copy of a book
+type BookCopy struct {
+	ID            int64     `json:"id,omitempty" db:"id"`
+	BookID        int64     `json:"book_id,omitempty" db:"book_id"`
+	Barcode       string    `json:"barcode,omitempty" db:"barcode"`
+	ShelfLocation string    `json:"shelf_location" db:"shelf_location"`
+	Condition     string    `json:"condition,omitempty" db:"condition"`
+	Status        string    `json:"status,omitempty" db:"status"`
+	CreatedAt     time.Time `json:"-" db:"created_at"`
+	UpdatedAt     time.Time `json:"-" db:"updated_at"`
 }
 
 type BorrowHistory struct {
-	ID         int64     `json:"id,omitempty" db:"id"`
-	UserID     int64     `json:"user_id,omitempty" db:"user_id"`
-	BookID     int64     `json:"book_id,omitempty" db:"book_id"`
-	BorrowedAt time.Time `json:"borrowed_at,omitempty" db:"borrowed_at"`
-	Returned   bool      `json:"returned" db:"returned"`
+	ID           int64      `json:"id,omitempty" db:"id"`
+	UserID       int64      `json:"user_id,omitempty" db:"user_id"`
+	BookID       int64      `json:"book_id,omitempty" db:"book_id"`
+	CopyID       int64      `json:"copy_id,omitempty" db:"copy_id"`
+	BorrowedAt   time.Time  `json:"borrowed_at,omitempty" db:"borrowed_at"`
+	DueAt        time.Time  `json:"due_at" db:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty" db:"returned_at"`
+	Returned     bool       `json:"returned" db:"returned"`
+	RenewalCount int        `json:"renewal_count" db:"renewal_count"`
+}
+
+// LoanRenewal records one extension of a loan's due date
+type LoanRenewal struct {
+	ID              int64     `json:"id" db:"id"`
+	BorrowHistoryID int64     `json:"borrow_history_id" db:"borrow_history_id"`
+	RenewedBy       int64     `json:"renewed_by" db:"renewed_by"`
+	PreviousDueAt   time.Time `json:"previous_due_at" db:"previous_due_at"`
+	NewDueAt        time.Time `json:"new_due_at" db:"new_due_at"`
+	RenewedAt       time.Time `json:"renewed_at" db:"renewed_at"`
+}
+
+// Hold is a borrower's place in the reservation queue of a book
+type Hold struct {
+	ID            int64      `json:"id" db:"id"`
+	BookID        int64      `json:"book_id" db:"book_id"`
+	BookTitle     string     `json:"title" db:"title"`
+	UserID        int64      `json:"user_id" db:"user_id"`
+	Username      string     `json:"username" db:"username"`
+	CopyID        int64      `json:"copy_id,omitempty" db:"copy_id"`
+	Status        string     `json:"status" db:"status"`
+	QueuePosition int64      `json:"queue_position,omitempty" db:"queue_position"` // only set while waiting
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	ReadyAt       *time.Time `json:"ready_at,omitempty" db:"ready_at"`
+	PickupBy      *time.Time `json:"pickup_by,omitempty" db:"pickup_by"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty" db:"closed_at"`
+}
+
+// Fine is an entry of a user's fee ledger. Charges are positive, payments and waivers negative
+type Fine struct {
+	ID              int64     `json:"id" db:"id"`
+	UserID          int64     `json:"user_id" db:"user_id"`
+	BorrowHistoryID int64     `json:"borrow_history_id,omitempty" db:"borrow_history_id"`
+	Kind            string    `json:"kind" db:"kind"`
+	Amount          int64     `json:"amount" db:"amount"`
+	Note            string    `json:"note" db:"note"`
+	CreatedBy       int64     `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+}
+
+var (
+	ErrLoanAlreadyReturned = errors.New("loan is already returned")
+	ErrRenewalLimitReached = errors.New("loan has reached the maximum number of renewals")
+	ErrBookHasPendingHolds = errors.New("other borrowers are waiting for this book")
+	ErrCopiesAvailable     = errors.New("copies of the book are available, borrow it instead")
+	ErrHoldExists          = errors.New("user already has a hold on this book")
+	ErrAlreadyBorrowing    = errors.New("user is currently borrowing the book")
+	ErrNoCopiesAvailable   = errors.New("no copies of the book are available")
+	ErrCopyOfOtherBook     = errors.New("the copy is not a copy of the book")
+	ErrBorrowLimitReached  = errors.New("user has borrowed the maximum number of books")
+	ErrOutstandingFines    = errors.New("user owes more fines than allowed to borrow")
+	ErrCopyBorrowed        = errors.New("the copy is borrowed, return it first")
+	ErrInvalidCopyStatus   = errors.New("invalid copy status, expect available, lost or retired")
+	ErrExceedsBalance      = errors.New("amount exceeds the outstanding balance")
+	ErrHoldNotActive       = errors.New("hold is no longer active")
+	ErrInvalidCursor       = errors.New("invalid cursor")
+	ErrInvalidSort         = errors.New("invalid sort or order")
+	ErrDuplicateBook       = errors.New("a book with the same title, author and edition already exists")
+	ErrUnknownCategory     = errors.New("unknown category")
+	ErrCategoryInUse       = errors.New("category still has subcategories or books")
+	ErrCategoryCycle       = errors.New("category can't be moved under itself")
+	ErrActiveLoans         = errors.New("books are still out on loan, return them first")
+	ErrOutstandingBalance  = errors.New("user still owes fines, settle them first")
+	ErrUnknownRole         = errors.New("unknown role")
+	ErrInvalidResetToken   = errors.New("reset token is unknown, used or expired")
+	ErrRoleInUse           = errors.New("role is still given to users")
+	ErrBuiltinRole         = errors.New("built-in roles can't be removed")
+	ErrAdminRole           = errors.New("the permissions of the admin role can't be changed")
+	ErrTOTPEnabled         = errors.New("two-factor authentication is already enabled")
+	ErrTOTPCodeUsed        = errors.New("the code was used already, wait for the next one")
+)
+
+// PasswordReset is a one-time token staff hand to a user to set a new password,
+// only the hash of the token is kept
+type PasswordReset struct {
+	ID        int64      `json:"id" db:"id"`
+	UserID    int64      `json:"user_id" db:"user_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	CreatedBy *int64     `json:"created_by" db:"created_by"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at" db:"used_at"`
 }
 
+// Session is a login on one device. Only the hash of the token in the cookie
+// is kept, sessions are told apart by ID.
 type Session struct {
-	UserID    int64     `json:"user_id,omitempty" db:"user_id"`
-	SessionID string    `json:"session_id,omitempty" db:"session_id"`
-	CreatedAt time.Time `json:"created_at" db:"updated_at"`
+	ID         int64     `json:"id" db:"id"`
+	UserID     int64     `json:"user_id,omitempty" db:"user_id"`
+	TokenHash  string    `json:"-" db:"token_hash"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	IP         string    `json:"ip" db:"ip"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	MFAPending bool      `json:"mfa_pending" db:"mfa_pending"` // the user still has to enter a TOTP code
+	Current    bool      `json:"current" db:"-"`               // whether the request was made with this session
+}
+
+// TOTP is the authenticator of a user, it is enabled once the user confirms it
+// with a first code. LastStep is the time step of the last code used.
+type TOTP struct {
+	UserID      int64      `json:"user_id" db:"user_id"`
+	Secret      string     `json:"-" db:"secret"`
+	ConfirmedAt *time.Time `json:"confirmed_at" db:"confirmed_at"`
+	LastStep    *int64     `json:"-" db:"last_step"`
+}
+
+func (t TOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
 }
 
 type BookStore interface {
-	AddBook(book Book) (ID int64, err error)
+	// AddBook adds the book along with copies copies with generated barcodes
+	AddBook(book Book, copies int) (ID int64, err error)
 	GetBookDetails(ID int64) (Book, error)
+	GetBookByISBN(isbn string) (Book, error)
+	ImportBooks(books []Book, mode ImportMode) (ids []int64, err error)
 	UpdateBook(book Book) error
+	// RemoveBook moves the book to the trash, it fails with ErrActiveLoans while copies are out
 	RemoveBook(ID int64) error
-	ListBooks(lastID, limit int64, order string) ([]Book, error)
+	RestoreBook(ID int64) error
+	ListDeletedBooks(lastID, limit int64) ([]Book, error)
+	// PurgeDeletedBooks removes books in the trash since before deletedBefore for good
+	PurgeDeletedBooks(deletedBefore time.Time) (int64, error)
+	ListBooks(opts ListBooksOptions) (books []Book, nextCursor string, err error)
+	SearchBooks(search BookSearch) (books []Book, nextCursor string, err error)
+}
+
+type CopyStore interface {
+	AddCopy(bookCopy BookCopy) (int64, error)
+	GetCopy(ID int64) (BookCopy, error)
+	GetCopyByBarcode(barcode string) (BookCopy, error)
+	UpdateCopy(bookCopy BookCopy) error
+	SetCopyStatus(ID int64, status string) error
+	ListCopiesByBookID(bookID int64) ([]BookCopy, error)
+}
+
+type FineStore interface {
+	ListFinesByUserID(userID, lastID, limit int64) ([]Fine, error)
+	GetFineBalance(userID int64) (int64, error)
+	// RecordPayment and WaiveFine reduce the balance by amount, which must be positive and at most the balance
+	RecordPayment(userID, amount int64, note string, createdBy int64) (Fine, error)
+	WaiveFine(userID, borrowHistoryID, amount int64, note string, createdBy int64) (Fine, error)
+}
+
+type CategoryStore interface {
+	AddCategory(category Category) (int64, error)
+	GetCategory(ID int64) (Category, error)
+	UpdateCategory(category Category) error
+	RemoveCategory(ID int64) error
+	ListCategories() ([]Category, error)
+}
+
+// LoginAttemptStore counts failed logins per key, a username or an IP, and
+// blocks a key for a while after too many of them, see LoginPolicy. The memory
+// store suits a single node, nodes behind a load balancer share the SQL one.
+type LoginAttemptStore interface {
+	// RetryAfter is how long the key stays blocked, 0 when it is not
+	RetryAfter(key string) (time.Duration, error)
+	// RecordFailure counts a failed login and returns how long the key is blocked now
+	RecordFailure(key string) (time.Duration, error)
+	ResetAttempts(key string) error
+	// PruneAttempts forgets the keys that are not blocked and did not fail recently
+	PruneAttempts() (int64, error)
+}
+
+type RoleStore interface {
+	AddRole(role Role) error
+	GetRole(name string) (Role, error)
+	// UpdateRole replaces the description and permissions of a role
+	UpdateRole(role Role) error
+	RemoveRole(name string) error
+	ListRoles() ([]Role, error)
+}
+
+// AuditStore only appends to the audit log, entries are never changed or removed
+type AuditStore interface {
+	RecordAudit(entry AuditEntry) error
+	// ListAuditLog lists entries newest first
+	ListAuditLog(filter AuditFilter) ([]AuditEntry, error)
+}
+
+type AuthorStore interface {
+	ListAuthors(lastID, limit int64, name string) ([]Author, error)
+	MergeAuthors(targetID int64, sourceIDs []int64) error
+}
+
+type HoldStore interface {
+	PlaceHold(userID, bookID int64) (Hold, error)
+	GetHold(ID int64) (Hold, error)
+	// CancelHold cancels a waiting or ready hold, a copy set aside for it goes to the next hold
+	CancelHold(ID int64) error
+	ListHoldsByUserID(userID int64) ([]Hold, error)
+	// ListHolds lists active holds in queue order, of all books when bookID is 0
+	ListHolds(bookID, lastID, limit int64) ([]Hold, error)
+	// ExpireHolds closes ready holds whose pickup_by has passed and returns how many were closed
+	ExpireHolds() (int64, error)
 }
 
 type BorrowHistoryStore interface {
-	BorrowBook(user_id, book_id int64) error
-	ReturnBook(id int64) error
+	// BorrowBook lends copyID to the user, or any available copy of bookID when copyID is 0.
+	// It fails with ErrBorrowLimitReached, ErrOutstandingFines, ErrNoCopiesAvailable or ErrAlreadyBorrowing
+	BorrowBook(userID, bookID, copyID int64) error
+	// ReturnBook closes the loan and returns the late fee charged for it
+	ReturnBook(id int64) (int64, error)
+	// RenewLoan pushes the due date of an active loan forward by one loan period
+	RenewLoan(id, renewedBy int64) (BorrowHistory, error)
+	ListRenewals(id int64) ([]LoanRenewal, error)
+	GetBorrowHistoryByID(id int64) (BorrowHistory, error)
 	ListAllBorrowHistoryByUserID(userID, lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error)
 	ListAllBorrowHistory(lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error)
-	GetBorrowHistory(userID, bookID int64) (BorrowHistory, error)
+	ListBorrowHistorySince(lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error)
+	ListOverdue(lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error)
+	// GetBorrowHistory lists every loan of the book by the user, newest first
+	GetBorrowHistory(userID, bookID int64) ([]BorrowHistory, error)
 	CountActiveBorrowedBooksByUserID(userID int64) (int64, error)
 }
 
 type UserStore interface {
 	AddUser(user User) (int64, error)
+	// RemoveUser moves the user to the trash, it fails with ErrActiveLoans while they have books out
+	// and with ErrOutstandingBalance while they owe fines, which would be lost with them
 	RemoveUser(ID int64) error
+	RestoreUser(ID int64) error
 	GetUserByID(ID int64) (User, error)
+	GetDeletedUser(ID int64) (User, error)
+	ListDeletedUsers(lastID, limit int64) ([]User, error)
+	// PurgeDeletedUsers removes users in the trash since before deletedBefore for good
+	PurgeDeletedUsers(deletedBefore time.Time) (int64, error)
+	// UpdateUser returns sql.ErrNoRows when the user is gone or in the trash
 	UpdateUser(user User) error
-	GetUserByCreds(username, password string) (User, error)
+	GetUserByUsername(username string) (User, error)
+	UpdatePassword(ID int64, password string) error
+	ChangePassword(ID int64, password string, keepSessionID int64) error
+	CreatePasswordReset(reset PasswordReset) error
+	GetPasswordReset(token string) (PasswordReset, error)
+	ResetPassword(token, password string) (userID int64, err error)
 	ListUsers(lastID, limit int64, order string, types []string) ([]User, error)
+	ImportUsers(users []User, mode ImportMode) (ids []int64, err error)
 }
 
 type SessionStore interface {
 	CreateSession(session Session) error
-	GetUserBySession(sessionID string) (GetSessionResponse, error)
-	DeleteSession(sessionID string) error
+	// GetUserBySession and DeleteSession take the token from the cookie, not its hash
+	GetUserBySession(token string) (GetSessionResponse, error)
+	DeleteSession(token string) error
+	// ListSessions lists the sessions of a user, most recently seen first
+	ListSessions(userID int64) ([]Session, error)
+	// RevokeSession deletes a session of the user by ID, sql.ErrNoRows if the user has no such session
+	RevokeSession(userID, ID int64) error
+	RevokeUserSessions(userID int64) (int64, error)
+	DeleteExpiredSessions() (int64, error)
+	// VerifySession lets a session waiting for a TOTP code through
+	VerifySession(ID int64) error
+}
+
+type TOTPStore interface {
+	// GetTOTP returns the authenticator of the user, sql.ErrNoRows if they never set one up
+	GetTOTP(userID int64) (TOTP, error)
+	// StartTOTP replaces an unconfirmed secret, ErrTOTPEnabled if the user has a confirmed one
+	StartTOTP(userID int64, secret string) error
+	// ConfirmTOTP enables the authenticator after the code of step, with fresh recovery codes
+	ConfirmTOTP(userID, step int64, recoveryCodeHashes []string) error
+	// UseTOTPStep keeps a code from being used twice, ErrTOTPCodeUsed if its step or a later one was
+	UseTOTPStep(userID, step int64) error
+	// UseRecoveryCode uses up a recovery code, sql.ErrNoRows if the user has no such unused code
+	UseRecoveryCode(userID int64, code string) error
+	ReplaceRecoveryCodes(userID int64, codeHashes []string) error
+	// DisableTOTP removes the authenticator and the recovery codes of the user
+	DisableTOTP(userID int64) error
 }
 
 // SQLUserStore implements UserStore interface
 type SQLUserStore struct {
-	db *sqlx.DB
+	db         *sqlx.DB
+	loanPolicy LoanPolicy
 }
 
-func NewSQLUserStore(db *sqlx.DB) *SQLUserStore {
-	return &SQLUserStore{db: db}
+func NewSQLUserStore(db *sqlx.DB, loanPolicy LoanPolicy) *SQLUserStore {
+	return &SQLUserStore{db: db, loanPolicy: loanPolicy}
 }
 
 func (s *SQLUserStore) AddUser(user User) (ID int64, err error) {
+	user.Password, err = HashPassword(user.Password)
+	if err != nil {
+		return 0, fmt.Errorf("hash password: %v", err)
+	}
 	const query = `INSERT INTO users (email, username, password, type) VALUES (:email, :username, :password, :type) RETURNING id`
 	namedStmt, err := s.db.PrepareNamed(query)
 	if err != nil {
@@ -106,35 +523,324 @@ func (s *SQLUserStore) AddUser(user User) (ID int64, err error) {
 	defer namedStmt.Close()
 	var id int64
 	err = namedStmt.Get(&id, user)
+	if isForeignKeyViolation(err) {
+		return 0, ErrUnknownRole
+	}
 	return id, err
 }
 
-func (s *SQLUserStore) RemoveUser(ID int64) error {
-	const query = `DELETE FROM users WHERE id = $1`
-	_, err := s.db.Exec(query, ID)
+// ImportUsers adds users in one transaction. A user clashing with an existing
+// one or an earlier one of the batch, by email or username, is skipped and gets
+// a zero id. Passwords are not hashed on a dry run.
+func (s *SQLUserStore) ImportUsers(users []User, mode ImportMode) (ids []int64, err error) {
+	if mode == ImportDryRun {
+		for i := range users {
+			users[i].Password = dummyPasswordHash
+		}
+	} else if err = hashPasswords(users); err != nil {
+		return nil, err
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil || !keepImport(mode, ids) {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	const query = `INSERT INTO users (email, username, password, type) VALUES (:email, :username, :password, :type)
+	ON CONFLICT DO NOTHING RETURNING id`
+	namedStmt, err := tx.PrepareNamed(query)
+	if err != nil {
+		return nil, err
+	}
+	defer namedStmt.Close()
+	ids = make([]int64, len(users))
+	for i, user := range users {
+		err = namedStmt.Get(&ids[i], user)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to import user %q: %w", user.UserName, err)
+		}
+	}
+	return ids, nil
+}
+
+// hashPasswords hashes the passwords in place, spread over the CPUs as hashing
+// is slow on purpose
+func hashPasswords(users []User) error {
+	errs := make([]error, len(users))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			users[i].Password, errs[i] = HashPassword(users[i].Password)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("hash password: %v", err)
+		}
+	}
+	return nil
+}
+
+// RemoveUser signs the user out and cancels their holds, their loan history
+// stays until the user is purged
+func (s *SQLUserStore) RemoveUser(ID int64) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	// locking the user serializes this with BorrowBook, which locks it too
+	err = tx.Get(&ID, "SELECT id FROM users WHERE id = $1 and deleted_at IS NULL FOR UPDATE", ID)
+	if err != nil {
+		return fmt.Errorf("failed to lock user: %w", err)
+	}
+	var borrowing int64
+	err = tx.Get(&borrowing, "SELECT count(*) FROM borrow_history WHERE user_id = $1 and returned = false", ID)
+	if err != nil {
+		return fmt.Errorf("failed to count borrowed books: %v", err)
+	}
+	if borrowing > 0 {
+		return ErrActiveLoans
+	}
+	var balance int64
+	err = tx.Get(&balance, "SELECT coalesce(sum(amount), 0) FROM fines WHERE user_id = $1", ID)
+	if err != nil {
+		return fmt.Errorf("failed to get fine balance: %v", err)
+	}
+	if balance > 0 {
+		return ErrOutstandingBalance
+	}
+	if err = cancelHolds(tx, "user_id", ID, s.loanPolicy.HoldPickupPeriod); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = $1", ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete sessions: %v", err)
+	}
+	_, err = tx.Exec("UPDATE users SET deleted_at = current_timestamp WHERE id = $1", ID)
 	return err
 }
 
+// RestoreUser takes the user out of the trash, it fails with a unique violation
+// when another user took their email or username meanwhile
+func (s *SQLUserStore) RestoreUser(ID int64) error {
+	res, err := s.db.Exec("UPDATE users SET deleted_at = NULL WHERE id = $1 and deleted_at IS NOT NULL", ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (s *SQLUserStore) GetUserByID(ID int64) (User, error) {
-	const query = `SELECT id, username, email, type FROM users WHERE id = $1`
+	const query = `SELECT id, username, email, type FROM users WHERE id = $1 and deleted_at IS NULL`
+	var user User
+	err := s.db.Get(&user, query, ID)
+	return user, err
+}
+
+func (s *SQLUserStore) GetDeletedUser(ID int64) (User, error) {
+	const query = `SELECT id, username, email, type, deleted_at FROM users WHERE id = $1 and deleted_at IS NOT NULL`
 	var user User
 	err := s.db.Get(&user, query, ID)
 	return user, err
 }
 
-func (s *SQLUserStore) UpdateUser(user User) error {
+// ListDeletedUsers lists the users in the trash by id
+func (s *SQLUserStore) ListDeletedUsers(lastID, limit int64) ([]User, error) {
+	const query = `SELECT id, username, email, type, deleted_at FROM users WHERE deleted_at IS NOT NULL and id > $1 ORDER BY id ASC LIMIT $2`
+	users := []User{}
+	err := s.db.Select(&users, query, lastID, limit)
+	return users, err
+}
+
+// PurgeDeletedUsers deletes the users along with their loans, fines and holds.
+// Their loan history is lost, RemoveUser made sure they owed nothing.
+func (s *SQLUserStore) PurgeDeletedUsers(deletedBefore time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM users WHERE deleted_at < $1", deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UpdateUser keeps the password when user has none and signs the user out of
+// every session when it changes
+func (s *SQLUserStore) UpdateUser(user User) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	var stored string
+	err = tx.Get(&stored, "SELECT password FROM users WHERE id = $1 and deleted_at IS NULL FOR UPDATE", user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock user: %w", err)
+	}
+	same, needsRehash := true, false
+	if user.Password != "" {
+		same, needsRehash = VerifyPassword(stored, user.Password)
+	}
+	if same && !needsRehash {
+		user.Password = stored
+	} else {
+		user.Password, err = HashPassword(user.Password)
+		if err != nil {
+			return fmt.Errorf("hash password: %v", err)
+		}
+	}
+	if !same {
+		_, err = tx.Exec("DELETE FROM sessions WHERE user_id = $1", user.ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete sessions: %v", err)
+		}
+	}
 	const query = `UPDATE users SET email = :email, username = :username, password = :password, type = :type WHERE id = :id`
-	_, err := s.db.NamedExec(query, user)
+	_, err = tx.NamedExec(query, user)
+	if isForeignKeyViolation(err) {
+		return ErrUnknownRole
+	}
 	return err
 }
 
-func (s *SQLUserStore) GetUserByCreds(username, password string) (User, error) {
-	const query = `SELECT id, username, email, type FROM users WHERE username = $1 AND password = $2`
+// GetUserByUsername returns the user including the stored password hash, use VerifyPassword to check it
+func (s *SQLUserStore) GetUserByUsername(username string) (User, error) {
+	const query = `SELECT id, username, email, password, type FROM users WHERE username = $1 and deleted_at IS NULL`
 	var user User
-	err := s.db.Get(&user, query, username, password)
+	err := s.db.Get(&user, query, username)
 	return user, err
 }
 
+// UpdatePassword hashes and stores a new password for the user
+func (s *SQLUserStore) UpdatePassword(ID int64, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("hash password: %v", err)
+	}
+	const query = `UPDATE users SET password = $1 WHERE id = $2`
+	_, err = s.db.Exec(query, hash, ID)
+	return err
+}
+
+// ChangePassword stores a new password and signs the user out of every other
+// session than keepSessionID
+func (s *SQLUserStore) ChangePassword(ID int64, password string, keepSessionID int64) (err error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("hash password: %v", err)
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	res, err := tx.Exec(`UPDATE users SET password = $1 WHERE id = $2 AND deleted_at IS NULL`, hash, ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec(`DELETE FROM sessions WHERE user_id = $1 AND id <> $2`, ID, keepSessionID)
+	return err
+}
+
+// CreatePasswordReset stores a reset token for the user, the tokens issued
+// before that were not used yet stop working
+func (s *SQLUserStore) CreatePasswordReset(reset PasswordReset) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	_, err = tx.Exec(`DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL`, reset.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NamedExec(`INSERT INTO password_resets (user_id, token_hash, created_by, expires_at)
+	VALUES (:user_id, :token_hash, :created_by, :expires_at)`, reset)
+	return err
+}
+
+// GetPasswordReset finds the reset of a token that can still be used
+func (s *SQLUserStore) GetPasswordReset(token string) (PasswordReset, error) {
+	tokenHash := HashToken(token)
+	var reset PasswordReset
+	err := s.db.Get(&reset, `SELECT id, user_id, token_hash, created_by, created_at, expires_at, used_at FROM password_resets
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > current_timestamp`, tokenHash)
+	if err == nil && !tokenHashEqual(reset.TokenHash, tokenHash) {
+		return PasswordReset{}, sql.ErrNoRows
+	}
+	return reset, err
+}
+
+// ResetPassword uses up the reset token, sets the new password of its user and
+// signs them out everywhere. It returns the ID of the user, ErrInvalidResetToken
+// if the token is unknown, used or expired.
+func (s *SQLUserStore) ResetPassword(token, password string) (userID int64, err error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return 0, fmt.Errorf("hash password: %v", err)
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	tokenHash := HashToken(token)
+	var reset PasswordReset
+	err = tx.Get(&reset, `UPDATE password_resets SET used_at = current_timestamp
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > current_timestamp
+	RETURNING id, user_id, token_hash, created_by, created_at, expires_at, used_at`, tokenHash)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !tokenHashEqual(reset.TokenHash, tokenHash) {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`UPDATE users SET password = $1 WHERE id = $2 AND deleted_at IS NULL`, hash, reset.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrInvalidResetToken
+	}
+	_, err = tx.Exec(`DELETE FROM sessions WHERE user_id = $1`, reset.UserID)
+	return reset.UserID, err
+}
+
 func (s *SQLUserStore) ListUsers(lastID, limit int64, order string, types []string) ([]User, error) {
 	switch order {
 	case "asc":
@@ -151,10 +857,10 @@ func (s *SQLUserStore) listUsersAsc(lastID, limit int64, types []string) ([]User
 		types = []string{Admin, Librarian, Borrower}
 	}
 	args := []interface{}{lastID, types, limit}
-	query := `SELECT id, username, email, type FROM users WHERE id > ? and type in (?) ORDER BY id ASC LIMIT ?`
+	query := `SELECT id, username, email, type FROM users WHERE id > ? and type in (?) and deleted_at IS NULL ORDER BY id ASC LIMIT ?`
 	if lastID <= 0 {
 		args = []interface{}{types, limit}
-		query = `SELECT id, username, email, type FROM users WHERE type IN (?) ORDER BY id ASC LIMIT ?`
+		query = `SELECT id, username, email, type FROM users WHERE type IN (?) and deleted_at IS NULL ORDER BY id ASC LIMIT ?`
 	}
 	query, args, err := sqlx.In(query, args...)
 	if err != nil {
@@ -171,10 +877,10 @@ func (s *SQLUserStore) listUsersDesc(lastID, limit int64, types []string) ([]Use
 		types = []string{Admin, Librarian, Borrower}
 	}
 	args := []interface{}{lastID, types, limit}
-	query := `SELECT id, username, email, type FROM users WHERE id < ? and type in (?) ORDER BY id DESC LIMIT ?`
+	query := `SELECT id, username, email, type FROM users WHERE id < ? and type in (?) and deleted_at IS NULL ORDER BY id DESC LIMIT ?`
 	if lastID <= 0 {
 		args = []interface{}{types, limit}
-		query = `SELECT id, username, email, type FROM users WHERE type IN (?) ORDER BY id DESC LIMIT ?`
+		query = `SELECT id, username, email, type FROM users WHERE type IN (?) and deleted_at IS NULL ORDER BY id DESC LIMIT ?`
 	}
 	query, args, err := sqlx.In(query, args...)
 	if err != nil {
@@ -189,16 +895,17 @@ func (s *SQLUserStore) listUsersDesc(lastID, limit int64, types []string) ([]Use
 
 // SQLBorrowHistoryStore implements BorrowHistoryStore interface
 type SQLBorrowHistoryStore struct {
-	db *sqlx.DB
+	db         *sqlx.DB
+	loanPolicy LoanPolicy
+	finePolicy FinePolicy
 }
 
-func NewSQLBorrowHistoryStore(db *sqlx.DB) *SQLBorrowHistoryStore {
-	return &SQLBorrowHistoryStore{db: db}
+func NewSQLBorrowHistoryStore(db *sqlx.DB, loanPolicy LoanPolicy, finePolicy FinePolicy) *SQLBorrowHistoryStore {
+	return &SQLBorrowHistoryStore{db: db, loanPolicy: loanPolicy, finePolicy: finePolicy}
 }
 
-func (s *SQLBorrowHistoryStore) BorrowBook(userID, bookID int64) error {
+func (s *SQLBorrowHistoryStore) BorrowBook(userID, bookID, copyID int64) (err error) {
 	tx := s.db.MustBegin()
-	var err error
 	defer func() {
 		if err != nil {
 			tx.Rollback()
@@ -206,28 +913,115 @@ func (s *SQLBorrowHistoryStore) BorrowBook(userID, bookID int64) error {
 		}
 		tx.Commit()
 	}()
+	// locking the user serializes concurrent loans of the same user, so the
+	// limit below can't be exceeded by requests racing each other
+	var userType string
+	err = tx.Get(&userType, "SELECT type FROM users WHERE id = $1 and deleted_at IS NULL FOR UPDATE", userID)
+	if err != nil {
+		return fmt.Errorf("failed to lock user: %w", err)
+	}
+	var borrowing int64
+	err = tx.Get(&borrowing, "SELECT count(*) FROM borrow_history WHERE user_id = $1 and returned = false", userID)
+	if err != nil {
+		return fmt.Errorf("failed to count borrowed books: %v", err)
+	}
+	if borrowing >= s.loanPolicy.MaxBooksPerUser {
+		return ErrBorrowLimitReached
+	}
+	if s.finePolicy.MaxOutstanding >= 0 {
+		var balance int64
+		err = tx.Get(&balance, "SELECT coalesce(sum(amount), 0) FROM fines WHERE user_id = $1", userID)
+		if err != nil {
+			return fmt.Errorf("failed to get fine balance: %v", err)
+		}
+		if balance > s.finePolicy.MaxOutstanding {
+			return ErrOutstandingFines
+		}
+	}
+	// a copy set aside by a ready hold can only be lent to the hold's borrower
+	var hold struct {
+		ID     int64 `db:"id"`
+		BookID int64 `db:"book_id"`
+		CopyID int64 `db:"copy_id"`
+	}
+	err = tx.Get(&hold, "SELECT id, book_id, copy_id FROM holds WHERE user_id = $1 and status = $2 and (book_id = $3 or book_id = (SELECT book_id FROM book_copies WHERE id = $4)) ORDER BY id LIMIT 1 FOR UPDATE", userID, HoldReady, bookID, copyID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get ready hold: %v", err)
+	}
+	if copyID == 0 && hold.ID != 0 {
+		copyID = hold.CopyID
+	}
+	var bookCopy BookCopy
+	if copyID == 0 {
+		err = tx.Get(&bookCopy, "SELECT id, book_id, status FROM book_copies WHERE book_id = $1 and status = $2 ORDER BY id LIMIT 1 FOR UPDATE", bookID, CopyAvailable)
+		if err == sql.ErrNoRows {
+			return ErrNoCopiesAvailable
+		}
+	} else {
+		err = tx.Get(&bookCopy, "SELECT id, book_id, status FROM book_copies WHERE id = $1 FOR UPDATE", copyID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get book copy: %w", err)
+	}
+	if bookID != 0 && bookCopy.BookID != bookID {
+		return fmt.Errorf("%w: copy %d, book %d", ErrCopyOfOtherBook, bookCopy.ID, bookID)
+	}
+	// any copy of the held book fulfils the hold, not only the one set aside for it
+	holdFulfilled := hold.ID != 0 && hold.BookID == bookCopy.BookID
+	holdMatches := holdFulfilled && hold.CopyID == bookCopy.ID
+	if bookCopy.Status != CopyAvailable && !(bookCopy.Status == CopyOnHold && holdMatches) {
+		return fmt.Errorf("%w: copy %d is %s", ErrNoCopiesAvailable, bookCopy.ID, bookCopy.Status)
+	}
+	bookID = bookCopy.BookID
+	// a book in the trash can't be lent, RemoveBook locks it for update
+	err = tx.Get(&bookID, "SELECT id FROM books WHERE id = $1 and deleted_at IS NULL FOR SHARE", bookID)
+	if err != nil {
+		return fmt.Errorf("failed to get book: %w", err)
+	}
 	var currentlyBorrowing int64
 	err = tx.Get(&currentlyBorrowing, "SELECT count(*) FROM borrow_history WHERE user_id = $1 and book_id = $2 and returned = false", userID, bookID)
 	if err != nil {
 		return fmt.Errorf("failed to check if user is currently borrowing the book: %v", err)
 	}
 	if currentlyBorrowing > 0 {
-		return fmt.Errorf("user is currently borrowing the book")
+		return ErrAlreadyBorrowing
+	}
+	if holdFulfilled {
+		_, err = tx.Exec("UPDATE holds SET status = $1, closed_at = current_timestamp WHERE id = $2", HoldFulfilled, hold.ID)
+		if err != nil {
+			return fmt.Errorf("failed to fulfill hold: %v", err)
+		}
+	}
+	categories, err := bookCategoryPath(tx, bookID)
+	if err != nil {
+		return fmt.Errorf("failed to get book categories: %v", err)
+	}
+	dueAt := time.Now().Add(s.loanPolicy.LoanPeriod(categories, userType))
+	// every loan is its own row, the partial unique index borrow_history_one_active_loan
+	// guarantees a user can't borrow the same book twice at the same time
+	_, err = tx.Exec("INSERT INTO borrow_history (user_id, book_id, copy_id, due_at) VALUES ($1, $2, $3, $4)", userID, bookID, bookCopy.ID, dueAt)
+	if isUniqueViolation(err) {
+		return ErrAlreadyBorrowing
 	}
-	_, err = tx.Exec("INSERT INTO borrow_history (user_id, book_id) VALUES ($1, $2) on conflict (user_id, book_id) do update set borrowed_at = current_timestamp, returned = false", userID, bookID)
 	if err != nil {
 		return fmt.Errorf("failed to insert borrow history: %v", err)
 	}
-	_, err = tx.Exec("UPDATE books SET count = count - 1 WHERE id = $1 and count > 0", bookID)
+	res, err := tx.Exec("UPDATE book_copies SET status = $1 WHERE id = $2 and status IN ($3, $4)", CopyBorrowed, bookCopy.ID, CopyAvailable, CopyOnHold)
 	if err != nil {
-		return fmt.Errorf("failed to update book count: %v", err)
+		return fmt.Errorf("failed to update copy status: %v", err)
+	}
+	if n, rErr := res.RowsAffected(); rErr != nil || n != 1 {
+		return ErrNoCopiesAvailable
+	}
+	if holdFulfilled && !holdMatches {
+		// the copy set aside for the hold goes to the next borrower in the queue
+		return releaseCopy(tx, bookID, hold.CopyID, s.loanPolicy.HoldPickupPeriod)
 	}
 	return nil
 }
 
-func (s *SQLBorrowHistoryStore) ReturnBook(id int64) error {
+func (s *SQLBorrowHistoryStore) ReturnBook(id int64) (fee int64, err error) {
 	tx := s.db.MustBegin()
-	var err error
 	defer func() {
 		if err != nil {
 			tx.Rollback()
@@ -235,28 +1029,154 @@ func (s *SQLBorrowHistoryStore) ReturnBook(id int64) error {
 		}
 		tx.Commit()
 	}()
-	var bookID int64
-	err = tx.Get(&bookID, "UPDATE borrow_history SET returned = true WHERE id = $1 and returned = false returning book_id", id)
-	if err != nil {
-		return fmt.Errorf("failed to update borrow history: %v", err)
+	var returned struct {
+		UserID     int64     `db:"user_id"`
+		BookID     int64     `db:"book_id"`
+		CopyID     int64     `db:"copy_id"`
+		DueAt      time.Time `db:"due_at"`
+		ReturnedAt time.Time `db:"returned_at"`
 	}
-	_, err = tx.Exec("UPDATE books SET count = count + 1 WHERE id = $1", bookID)
+	err = tx.Get(&returned, "UPDATE borrow_history SET returned = true, returned_at = current_timestamp WHERE id = $1 and returned = false returning user_id, book_id, copy_id, due_at, returned_at", id)
 	if err != nil {
-		return fmt.Errorf("failed to update book count: %v", err)
+		return 0, fmt.Errorf("failed to update borrow history: %w", err)
+	}
+	fee = s.finePolicy.LateFee(returned.DueAt, returned.ReturnedAt)
+	if fee > 0 {
+		note := fmt.Sprintf("late return, due %s", returned.DueAt.Format(time.DateOnly))
+		_, err = tx.Exec("INSERT INTO fines (user_id, borrow_history_id, kind, amount, note) VALUES ($1, $2, $3, $4, $5)", returned.UserID, id, FineCharge, fee, note)
+		if err != nil {
+			return 0, fmt.Errorf("failed to charge late fee: %v", err)
+		}
+	}
+	return fee, releaseCopy(tx, returned.BookID, returned.CopyID, s.loanPolicy.HoldPickupPeriod)
+}
+
+// releaseCopy sets the copy aside for the next waiting hold of the book, or makes it available when nobody is waiting
+func releaseCopy(tx *sqlx.Tx, bookID, copyID int64, pickupPeriod time.Duration) error {
+	// locking the book serializes this with PlaceHold, which locks it too
+	_, err := tx.Exec("SELECT id FROM books WHERE id = $1 FOR UPDATE", bookID)
+	if err != nil {
+		return fmt.Errorf("failed to lock book: %v", err)
+	}
+	var holdID int64
+	err = tx.Get(&holdID, "SELECT id FROM holds WHERE book_id = $1 and status = $2 ORDER BY id LIMIT 1 FOR UPDATE", bookID, HoldWaiting)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("UPDATE book_copies SET status = $1 WHERE id = $2", CopyAvailable, copyID)
+		if err != nil {
+			return fmt.Errorf("failed to update copy status: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get next hold: %v", err)
+	}
+	_, err = tx.Exec("UPDATE holds SET status = $1, copy_id = $2, ready_at = current_timestamp, pickup_by = $3 WHERE id = $4", HoldReady, copyID, time.Now().Add(pickupPeriod), holdID)
+	if err != nil {
+		return fmt.Errorf("failed to assign copy to hold: %v", err)
+	}
+	_, err = tx.Exec("UPDATE book_copies SET status = $1 WHERE id = $2", CopyOnHold, copyID)
+	if err != nil {
+		return fmt.Errorf("failed to update copy status: %v", err)
 	}
 	return nil
 }
 
+func (s *SQLBorrowHistoryStore) RenewLoan(id, renewedBy int64) (loan BorrowHistory, err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	var current struct {
+		BorrowHistory
+		UserType string `db:"user_type"`
+	}
+	err = tx.Get(&current, `SELECT bh.id, bh.user_id, bh.book_id, bh.copy_id, bh.borrowed_at, bh.due_at, bh.returned_at, bh.returned, bh.renewal_count, u.type as user_type
+	FROM borrow_history bh
+	join users u on bh.user_id = u.id
+	WHERE bh.id = $1 FOR UPDATE OF bh`, id)
+	if err != nil {
+		return loan, fmt.Errorf("failed to get borrow history: %w", err)
+	}
+	if current.Returned {
+		return loan, ErrLoanAlreadyReturned
+	}
+	if current.RenewalCount >= s.loanPolicy.MaxRenewals {
+		return loan, ErrRenewalLimitReached
+	}
+	var waiting int64
+	err = tx.Get(&waiting, "SELECT count(*) FROM holds WHERE book_id = $1 and status = $2", current.BookID, HoldWaiting)
+	if err != nil {
+		return loan, fmt.Errorf("failed to count pending holds: %v", err)
+	}
+	if waiting > 0 {
+		return loan, ErrBookHasPendingHolds
+	}
+	// renewing an overdue loan starts the new period from now instead of from the missed due date
+	from := current.DueAt
+	if now := time.Now(); from.Before(now) {
+		from = now
+	}
+	categories, err := bookCategoryPath(tx, current.BookID)
+	if err != nil {
+		return loan, fmt.Errorf("failed to get book categories: %v", err)
+	}
+	newDueAt := from.Add(s.loanPolicy.LoanPeriod(categories, current.UserType))
+	_, err = tx.Exec("UPDATE borrow_history SET due_at = $1, renewal_count = renewal_count + 1 WHERE id = $2", newDueAt, id)
+	if err != nil {
+		return loan, fmt.Errorf("failed to update due date: %v", err)
+	}
+	_, err = tx.Exec("INSERT INTO loan_renewals (borrow_history_id, renewed_by, previous_due_at, new_due_at) VALUES ($1, $2, $3, $4)", id, renewedBy, current.DueAt, newDueAt)
+	if err != nil {
+		return loan, fmt.Errorf("failed to record renewal: %v", err)
+	}
+	loan = current.BorrowHistory
+	loan.DueAt = newDueAt
+	loan.RenewalCount++
+	return loan, nil
+}
+
+func (s *SQLBorrowHistoryStore) ListRenewals(id int64) ([]LoanRenewal, error) {
+	const query = `SELECT id, borrow_history_id, coalesce(renewed_by, 0) as renewed_by, previous_due_at, new_due_at, renewed_at FROM loan_renewals WHERE borrow_history_id = $1 ORDER BY id ASC`
+	var renewals []LoanRenewal
+	err := s.db.Select(&renewals, query, id)
+	return renewals, err
+}
+
+func (s *SQLBorrowHistoryStore) GetBorrowHistoryByID(id int64) (BorrowHistory, error) {
+	const query = `SELECT id, user_id, book_id, copy_id, borrowed_at, due_at, returned_at, returned, renewal_count FROM borrow_history WHERE id = $1`
+	var bh BorrowHistory
+	err := s.db.Get(&bh, query, id)
+	return bh, err
+}
+
 type GetBorrowHistoryDetailResponse struct {
-	ID          int64     `json:"id" db:"id"`
-	UserID      int64     `json:"user_id" db:"user_id"`
-	Username    string    `json:"username" db:"username"`
-	BookID      int64     `json:"book_id" db:"book_id"`
-	BookTitle   string    `json:"title" db:"title"`
-	Borrowed_at time.Time `json:"borrowed_at" db:"borrowed_at"`
-	Returned    bool      `json:"returned" db:"returned"`
+	ID           int64      `json:"id" db:"id"`
+	UserID       int64      `json:"user_id" db:"user_id"`
+	Username     string     `json:"username" db:"username"`
+	BookID       int64      `json:"book_id" db:"book_id"`
+	BookTitle    string     `json:"title" db:"title"`
+	CopyID       int64      `json:"copy_id" db:"copy_id"`
+	Barcode      string     `json:"barcode" db:"barcode"`
+	Borrowed_at  time.Time  `json:"borrowed_at" db:"borrowed_at"`
+	DueAt        time.Time  `json:"due_at" db:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty" db:"returned_at"`
+	Returned     bool       `json:"returned" db:"returned"`
+	RenewalCount int        `json:"renewal_count" db:"renewal_count"`
+	Overdue      bool       `json:"overdue" db:"overdue"`
 }
 
+// borrowHistoryDetailQuery selects GetBorrowHistoryDetailResponse rows, append the WHERE clause to it
+const borrowHistoryDetailQuery = `SELECT bh.id, username, u.id as user_id, title, b.id as book_id, c.id as copy_id, barcode,
+	borrowed_at, due_at, returned_at, returned, renewal_count, (NOT returned AND due_at < current_timestamp) as overdue
+	FROM borrow_history bh 
+	join users u on bh.user_id = u.id 
+	join books b on bh.book_id = b.id 
+	join book_copies c on bh.copy_id = c.id `
+
 func (s *SQLBorrowHistoryStore) CountActiveBorrowedBooksByUserID(userID int64) (int64, error) {
 	const query = `SELECT count(*) from borrow_history WHERE user_id = $1 and returned = false`
 	var cnt int64
@@ -265,45 +1185,82 @@ func (s *SQLBorrowHistoryStore) CountActiveBorrowedBooksByUserID(userID int64) (
 }
 
 func (s *SQLBorrowHistoryStore) ListAllBorrowHistoryByUserID(userID, lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error) {
-	const query = `SELECT bh.id, username, u.id as user_id, title, b.id as book_id, borrowed_at, returned
-	FROM borrow_history bh 
-	join users u on bh.user_id = u.id 
-	join books b on bh.book_id = b.id 
-	WHERE user_id = $1 AND bh.id > $2 ORDER BY id DESC LIMIT $3`
+	const query = borrowHistoryDetailQuery + `WHERE user_id = $1 AND bh.id > $2 ORDER BY id DESC LIMIT $3`
 	var bh []GetBorrowHistoryDetailResponse
 	err := s.db.Select(&bh, query, userID, lastID, limit)
 	return bh, err
 }
 
 func (s *SQLBorrowHistoryStore) ListAllBorrowHistory(lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error) {
-	const query = `SELECT bh.id, username, u.id as user_id, title, b.id as book_id, borrowed_at, returned
-	FROM borrow_history bh 
-	join users u on bh.user_id = u.id 
-	join books b on bh.book_id = b.id 
-	WHERE bh.id > $1 ORDER BY id DESC LIMIT $2`
+	const query = borrowHistoryDetailQuery + `WHERE bh.id > $1 ORDER BY id DESC LIMIT $2`
 	var bh []GetBorrowHistoryDetailResponse
 	err := s.db.Select(&bh, query, lastID, limit)
 	return bh, err
 }
 
-func (s *SQLBorrowHistoryStore) GetBorrowHistory(userID, bookID int64) (BorrowHistory, error) {
-	const query = `SELECT * FROM borrow_history WHERE user_id = $1 AND book_id = $2`
-	var bh BorrowHistory
-	err := s.db.Get(&bh, query, userID, bookID)
+// ListBorrowHistorySince lists loans after lastID in id order
+func (s *SQLBorrowHistoryStore) ListBorrowHistorySince(lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error) {
+	const query = borrowHistoryDetailQuery + `WHERE bh.id > $1 ORDER BY bh.id ASC LIMIT $2`
+	var bh []GetBorrowHistoryDetailResponse
+	err := s.db.Select(&bh, query, lastID, limit)
+	return bh, err
+}
+
+// ListOverdue lists loans that are not returned and past their due date
+func (s *SQLBorrowHistoryStore) ListOverdue(lastID, limit int64) ([]GetBorrowHistoryDetailResponse, error) {
+	const query = borrowHistoryDetailQuery + `WHERE NOT returned AND due_at < current_timestamp AND bh.id > $1 ORDER BY bh.id ASC LIMIT $2`
+	var bh []GetBorrowHistoryDetailResponse
+	err := s.db.Select(&bh, query, lastID, limit)
+	return bh, err
+}
+
+func (s *SQLBorrowHistoryStore) GetBorrowHistory(userID, bookID int64) ([]BorrowHistory, error) {
+	const query = `SELECT id, user_id, book_id, copy_id, borrowed_at, due_at, returned_at, returned, renewal_count FROM borrow_history WHERE user_id = $1 AND book_id = $2 ORDER BY id DESC`
+	var bh []BorrowHistory
+	err := s.db.Select(&bh, query, userID, bookID)
 	return bh, err
 }
 
 // SQLSessionStore implements SessionStore interface
 type SQLSessionStore struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	policy SessionPolicy
+}
+
+func NewSQLSessionStore(db *sqlx.DB, policy SessionPolicy) *SQLSessionStore {
+	return &SQLSessionStore{db: db, policy: policy}
+}
+
+// sessionAlive matches sessions of `sessions s` that have not expired, it takes
+// the maximum lifetime, the idle timeout and the time to enter a TOTP code in
+// seconds as the named arguments max, idle and mfa, see policyArgs
+const sessionAlive = `(s.created_at > current_timestamp - make_interval(secs => :max)
+	AND (:idle = 0 OR s.last_seen_at > current_timestamp - make_interval(secs => :idle))
+	AND NOT (s.mfa_pending AND s.created_at < current_timestamp - make_interval(secs => :mfa)))`
+
+func (s *SQLSessionStore) policyArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"max":  s.policy.MaxLifetime.Seconds(),
+		"idle": s.policy.IdleTimeout.Seconds(),
+		"seen": s.policy.SeenInterval.Seconds(),
+		"mfa":  s.policy.MFATimeout.Seconds(),
+	}
 }
 
-func NewSQLSessionStore(db *sqlx.DB) *SQLSessionStore {
-	return &SQLSessionStore{db: db}
+// namedQuery binds the named arguments of query, along with those of the policy
+func (s *SQLSessionStore) namedQuery(query string, args map[string]interface{}) (string, []interface{}, error) {
+	for name, value := range s.policyArgs() {
+		args[name] = value
+	}
+	query, bound, err := sqlx.Named(query, args)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.db.Rebind(query), bound, nil
 }
 
 func (s *SQLSessionStore) CreateSession(session Session) error {
-	const query = `INSERT INTO sessions (user_id, session_id) VALUES (:user_id, :session_id) on conflict(user_id) do update set session_id = excluded.session_id `
+	const query = `INSERT INTO sessions (user_id, token_hash, user_agent, ip, mfa_pending) VALUES (:user_id, :token_hash, :user_agent, :ip, :mfa_pending)`
 	_, err := s.db.NamedExec(query, session)
 	if err != nil {
 		return err
@@ -312,100 +1269,1585 @@ func (s *SQLSessionStore) CreateSession(session Session) error {
 }
 
 type GetSessionResponse struct {
-	UserID           int64     `json:"user_id" db:"user_id"`
-	UserName         string    `json:"username" db:"username"`
-	Email            string    `json:"email" db:"email"`
-	UserType         string    `json:"type" db:"type"`
-	SessionCreatedAt time.Time `json:"session_created_at" db:"session_created_at"`
-}
-
-func (s *SQLSessionStore) GetUserBySession(sessionID string) (GetSessionResponse, error) {
-	const query = `SELECT u.id as user_id, u.username, u.email, u.type, s.updated_at as session_created_at  
-	FROM users u join sessions s on u.id = s.user_id and session_id = $1`
-	var user GetSessionResponse
-	err := s.db.Get(&user, query, sessionID)
-	return user, err
+	UserID           int64       `json:"user_id" db:"user_id"`
+	UserName         string      `json:"username" db:"username"`
+	Email            string      `json:"email" db:"email"`
+	UserType         string      `json:"type" db:"type"`
+	SessionCreatedAt time.Time   `json:"session_created_at" db:"session_created_at"`
+	SessionID        int64       `json:"-" db:"session_id"` // Session.ID of the session
+	Permissions      Permissions `json:"permissions" db:"permissions"`
+	MFAPending       bool        `json:"mfa_pending" db:"mfa_pending"`
+	TOTPRequired     bool        `json:"totp_required" db:"totp_required"` // the role of the user requires TOTP
+	TOTPEnabled      bool        `json:"totp_enabled" db:"totp_enabled"`
+}
+
+// GetUserBySession looks the session up by the hash of its token, expired
+// sessions are not found. It slides the idle timeout by marking the session as
+// seen, at most once every SeenInterval. The index lookup only ever sees
+// hashes; the hash found is compared again in constant time.
+func (s *SQLSessionStore) GetUserBySession(token string) (GetSessionResponse, error) {
+	const query = `WITH seen AS (
+		UPDATE sessions s SET last_seen_at = current_timestamp
+		WHERE s.token_hash = :hash AND s.last_seen_at < current_timestamp - make_interval(secs => :seen) AND ` + sessionAlive + `
+	) SELECT u.id as user_id, u.username, u.email, u.type, s.created_at as session_created_at, s.id as session_id, s.token_hash,
+		array(SELECT rp.permission FROM role_permissions rp WHERE rp.role = u.type) as permissions, s.mfa_pending,
+		(SELECT r.require_totp FROM roles r WHERE r.name = u.type) as totp_required,
+		EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id = u.id AND t.confirmed_at IS NOT NULL) as totp_enabled
+	FROM users u join sessions s on u.id = s.user_id and s.token_hash = :hash WHERE u.deleted_at IS NULL AND ` + sessionAlive
+	hash := HashToken(token)
+	bound, args, err := s.namedQuery(query, map[string]interface{}{"hash": hash})
+	if err != nil {
+		return GetSessionResponse{}, err
+	}
+	var session struct {
+		GetSessionResponse
+		TokenHash string `db:"token_hash"`
+	}
+	err = s.db.Get(&session, bound, args...)
+	if err != nil {
+		return GetSessionResponse{}, err
+	}
+	if !tokenHashEqual(session.TokenHash, hash) {
+		return GetSessionResponse{}, sql.ErrNoRows
+	}
+	return session.GetSessionResponse, nil
 }
 
-func (s *SQLSessionStore) DeleteSession(sessionID string) error {
-	const query = `DELETE FROM sessions WHERE session_id = $1`
-	_, err := s.db.Exec(query, sessionID)
+func (s *SQLSessionStore) DeleteSession(token string) error {
+	const query = `DELETE FROM sessions WHERE token_hash = $1`
+	_, err := s.db.Exec(query, HashToken(token))
 	return err
 }
 
+func (s *SQLSessionStore) ListSessions(userID int64) ([]Session, error) {
+	const query = `SELECT s.id, s.user_id, s.user_agent, s.ip, s.created_at, s.last_seen_at FROM sessions s
+	WHERE s.user_id = :user_id AND ` + sessionAlive + ` ORDER BY s.last_seen_at DESC, s.id DESC`
+	bound, args, err := s.namedQuery(query, map[string]interface{}{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	err = s.db.Select(&sessions, bound, args...)
+	return sessions, err
+}
+
+// DeleteExpiredSessions removes the sessions GetUserBySession no longer finds
+func (s *SQLSessionStore) DeleteExpiredSessions() (int64, error) {
+	const query = `DELETE FROM sessions s WHERE NOT ` + sessionAlive
+	bound, args, err := s.namedQuery(query, map[string]interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(bound, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLSessionStore) VerifySession(ID int64) error {
+	res, err := s.db.Exec(`UPDATE sessions SET mfa_pending = false WHERE id = $1 AND mfa_pending`, ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLSessionStore) RevokeSession(userID, ID int64) error {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE id = $1 AND user_id = $2`, ID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLSessionStore) RevokeUserSessions(userID int64) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 // SQLBookStore implements BookStore interface
 type SQLBookStore struct {
-	db *sqlx.DB
+	db         *sqlx.DB
+	loanPolicy LoanPolicy
 }
 
-func NewSQLBookStore(db *sqlx.DB) *SQLBookStore {
-	return &SQLBookStore{db: db}
+func NewSQLBookStore(db *sqlx.DB, loanPolicy LoanPolicy) *SQLBookStore {
+	return &SQLBookStore{db: db, loanPolicy: loanPolicy}
 }
 
-func (s *SQLBookStore) AddBook(book Book) (ID int64, err error) {
-	const query = `INSERT INTO books (title, author, type, cover, count) VALUES (:title, :author, :type, :cover, :count) RETURNING id`
-	namedStmt, err := s.db.PrepareNamed(query)
+// bookColumns selects a book from `books b` along with its copy counts
+const bookColumns = `b.id, b.title, b.author, coalesce(b.type, '') AS type, b.cover, b.created_at, b.updated_at, b.deleted_at,
+	coalesce(b.isbn, '') AS isbn, b.publisher, coalesce(b.publication_year, 0) AS publication_year, b.edition,
+	b.language, coalesce(b.page_count, 0) AS page_count, b.description, b.subjects,
+	(SELECT coalesce(json_agg(json_build_object('id', a.id, 'name', a.name, 'role', ba.role) ORDER BY ba.position), '[]')
+		FROM book_authors ba JOIN authors a ON a.id = ba.author_id WHERE ba.book_id = b.id) AS authors,
+	(SELECT coalesce(json_agg(json_build_object('id', cat.id, 'slug', cat.slug, 'name', cat.name) ORDER BY bc.position), '[]')
+		FROM book_categories bc JOIN categories cat ON cat.id = bc.category_id WHERE bc.book_id = b.id) AS categories,
+	(SELECT count(*) FROM book_copies c WHERE c.book_id = b.id AND c.status NOT IN ('lost', 'retired')) AS total_copies,
+	(SELECT count(*) FROM book_copies c WHERE c.book_id = b.id AND c.status = 'available') AS available_copies`
+
+// bookMetadata writes the bibliographic fields, unknown ones stay NULL
+const bookMetadata = `NULLIF(:isbn, ''), :publisher, NULLIF(:publication_year, 0), :edition, :language, NULLIF(:page_count, 0), :description, :subjects`
+
+// insertBookQuery leaves the type to setBookCategories
+const insertBookQuery = `INSERT INTO books (title, author, cover, isbn, publisher, publication_year, edition, language, page_count, description, subjects)
+	VALUES (:title, :author, :cover, ` + bookMetadata + `)`
+
+func (s *SQLBookStore) AddBook(book Book, copies int) (ID int64, err error) {
+	if book.Subjects == nil {
+		book.Subjects = pq.StringArray{}
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	namedStmt, err := tx.PrepareNamed(insertBookQuery + ` RETURNING id`)
 	if err != nil {
 		return 0, err
 	}
 	defer namedStmt.Close()
 	var id int64
-	err = namedStmt.Get(&id, book)
-	return id, err
+	if err = namedStmt.Get(&id, book); err != nil {
+		return 0, err
+	}
+	if err = setBookAuthors(tx, id, book.Authors); err != nil {
+		return 0, err
+	}
+	if err = setBookCategories(tx, id, book.Categories); err != nil {
+		return 0, err
+	}
+	// a new book has no holds waiting, so its copies go on the shelf as they are
+	for i := 0; i < copies; i++ {
+		barcode, err := newBarcode(id)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(`INSERT INTO book_copies (book_id, barcode) VALUES ($1, $2)`, id, barcode); err != nil {
+			return 0, fmt.Errorf("failed to insert copy: %w", err)
+		}
+	}
+	return id, nil
+}
+
+// setBookCategories replaces the categories of a book and sets its type to the
+// slug of the first one
+func setBookCategories(tx *sqlx.Tx, bookID int64, categories BookCategories) error {
+	_, err := tx.Exec(`DELETE FROM book_categories WHERE book_id = $1`, bookID)
+	if err != nil {
+		return fmt.Errorf("failed to clear book categories: %w", err)
+	}
+	var primary *string
+	for i, category := range categories {
+		var found BookCategory
+		err = tx.Get(&found, `SELECT id, slug, name FROM categories WHERE id = $1 OR slug = $2`, category.ID, category.Slug)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrUnknownCategory, category.Slug)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get category: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO book_categories (book_id, category_id, position) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, bookID, found.ID, i)
+		if err != nil {
+			return fmt.Errorf("failed to add book to category %q: %w", found.Slug, err)
+		}
+		if primary == nil {
+			primary = &found.Slug
+		}
+	}
+	_, err = tx.Exec(`UPDATE books SET type = $1 WHERE id = $2`, primary, bookID)
+	return err
+}
+
+// bookCategoryPath lists the slugs of the categories of a book followed by
+// their ancestors, nearest first
+func bookCategoryPath(tx *sqlx.Tx, bookID int64) ([]string, error) {
+	const query = `WITH RECURSIVE path AS (
+		SELECT cat.parent_id, cat.slug, bc.position, 0 AS depth
+		FROM book_categories bc JOIN categories cat ON cat.id = bc.category_id WHERE bc.book_id = $1
+		UNION ALL
+		SELECT cat.parent_id, cat.slug, path.position, path.depth + 1
+		FROM categories cat JOIN path ON cat.id = path.parent_id
+	) SELECT slug FROM path ORDER BY depth, position`
+	var slugs []string
+	err := tx.Select(&slugs, query, bookID)
+	return slugs, err
+}
+
+// setBookAuthors replaces the credits of a book, adding authors not known yet.
+// Names differing only in case are the same author.
+func setBookAuthors(tx *sqlx.Tx, bookID int64, authors BookAuthors) error {
+	_, err := tx.Exec(`DELETE FROM book_authors WHERE book_id = $1`, bookID)
+	if err != nil {
+		return fmt.Errorf("failed to clear book authors: %w", err)
+	}
+	for i, author := range authors {
+		var authorID int64
+		err = tx.Get(&authorID, `INSERT INTO authors (name) VALUES ($1)
+		ON CONFLICT ((lower(name))) DO UPDATE SET name = authors.name RETURNING id`, author.Name)
+		if err != nil {
+			return fmt.Errorf("failed to add author %q: %w", author.Name, err)
+		}
+		_, err = tx.Exec(`INSERT INTO book_authors (book_id, author_id, role, position) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, bookID, authorID, author.Role, i)
+		if err != nil {
+			return fmt.Errorf("failed to credit author %q: %w", author.Name, err)
+		}
+	}
+	return nil
+}
+
+// ImportMode decides what a bulk import keeps when some rows clash with
+// existing ones. Clashing rows always get a zero id.
+type ImportMode int
+
+const (
+	ImportSkipDuplicates ImportMode = iota // keep the rows that don't clash
+	ImportAllOrNothing                     // keep nothing if any row clashes
+	ImportDryRun                           // keep nothing, only find the clashes
+)
+
+// keepImport tells if an import transaction that produced ids should be committed
+func keepImport(mode ImportMode, ids []int64) bool {
+	switch mode {
+	case ImportSkipDuplicates:
+		return true
+	case ImportAllOrNothing:
+		for _, id := range ids {
+			if id == 0 {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// ImportBooks adds books in one transaction. A book clashing with an existing
+// one or an earlier one of the batch, by ISBN or by title, author and edition,
+// is skipped and gets a zero id.
+func (s *SQLBookStore) ImportBooks(books []Book, mode ImportMode) (ids []int64, err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil || !keepImport(mode, ids) {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	namedStmt, err := tx.PrepareNamed(insertBookQuery + ` ON CONFLICT DO NOTHING RETURNING id`)
+	if err != nil {
+		return nil, err
+	}
+	defer namedStmt.Close()
+	ids = make([]int64, len(books))
+	for i, book := range books {
+		if book.Subjects == nil {
+			book.Subjects = pq.StringArray{}
+		}
+		err = namedStmt.Get(&ids[i], book)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to import book %q: %w", book.Title, err)
+		}
+		if err = setBookAuthors(tx, ids[i], book.Authors); err != nil {
+			return nil, err
+		}
+		if err = setBookCategories(tx, ids[i], book.Categories); err != nil {
+			return nil, fmt.Errorf("book %q: %w", book.Title, err)
+		}
+	}
+	return ids, nil
 }
 
 func (s *SQLBookStore) GetBookDetails(ID int64) (Book, error) {
-	const query = `SELECT * FROM books WHERE id = $1`
+	const query = `SELECT ` + bookColumns + ` FROM books b WHERE b.id = $1 AND b.deleted_at IS NULL`
 	var book Book
 	err := s.db.Get(&book, query, ID)
 	return book, err
 }
 
-func (s *SQLBookStore) UpdateBook(book Book) error {
-	const query = `UPDATE books SET title = :title, author = :author, type = :type, cover = :cover, count = :count WHERE id = :id`
-	_, err := s.db.NamedExec(query, book)
-	return err
+func (s *SQLBookStore) GetBookByISBN(isbn string) (Book, error) {
+	const query = `SELECT ` + bookColumns + ` FROM books b WHERE b.isbn = $1 AND b.deleted_at IS NULL`
+	var book Book
+	err := s.db.Get(&book, query, isbn)
+	return book, err
 }
 
-func (s *SQLBookStore) RemoveBook(ID int64) error {
-	const query = `DELETE FROM books WHERE id = $1`
-	_, err := s.db.Exec(query, ID)
-	return err
+func (s *SQLBookStore) UpdateBook(book Book) (err error) {
+	const query = `UPDATE books SET title = :title, author = :author, cover = :cover,
+	(isbn, publisher, publication_year, edition, language, page_count, description, subjects) = (` + bookMetadata + `)
+	WHERE id = :id AND deleted_at IS NULL`
+	if book.Subjects == nil {
+		book.Subjects = pq.StringArray{}
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	if _, err = tx.NamedExec(query, book); err != nil {
+		return err
+	}
+	if err = setBookAuthors(tx, book.ID, book.Authors); err != nil {
+		return err
+	}
+	return setBookCategories(tx, book.ID, book.Categories)
 }
 
-func (s *SQLBookStore) ListBooks(lastID, limit int64, order string) ([]Book, error) {
-	switch order {
-	case "asc":
-		return s.listBooksAsc(lastID, limit)
-	case "desc":
-		return s.listBooksDesc(lastID, limit)
-	default:
-		return nil, fmt.Errorf("invalid order: %s", order)
+// RemoveBook cancels the holds on the book, its copies and loan history stay
+// until the book is purged
+func (s *SQLBookStore) RemoveBook(ID int64) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	err = tx.Get(&ID, "SELECT id FROM books WHERE id = $1 and deleted_at IS NULL FOR UPDATE", ID)
+	if err != nil {
+		return fmt.Errorf("failed to lock book: %w", err)
+	}
+	var lent int64
+	err = tx.Get(&lent, "SELECT count(*) FROM borrow_history WHERE book_id = $1 and returned = false", ID)
+	if err != nil {
+		return fmt.Errorf("failed to count lent copies: %v", err)
+	}
+	if lent > 0 {
+		return ErrActiveLoans
+	}
+	if err = cancelHolds(tx, "book_id", ID, s.loanPolicy.HoldPickupPeriod); err != nil {
+		return err
 	}
+	_, err = tx.Exec("UPDATE books SET deleted_at = current_timestamp WHERE id = $1", ID)
+	return err
 }
 
-func (s *SQLBookStore) listBooksAsc(lastID, limit int64) ([]Book, error) {
-	args := []interface{}{lastID, limit}
-	query := `SELECT * FROM books WHERE id > $1 ORDER BY id ASC LIMIT $2`
-	if lastID <= 0 {
-		args = []interface{}{limit}
-		query = `SELECT * FROM books ORDER BY id ASC LIMIT $1`
+// RestoreBook takes the book out of the trash, it fails with a unique violation
+// when the same book was added again meanwhile
+func (s *SQLBookStore) RestoreBook(ID int64) error {
+	res, err := s.db.Exec("UPDATE books SET deleted_at = NULL WHERE id = $1 and deleted_at IS NOT NULL", ID)
+	if err != nil {
+		return err
 	}
-	var books []Book
-	err := s.db.Select(&books, query, args...)
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListDeletedBooks lists the books in the trash by id
+func (s *SQLBookStore) ListDeletedBooks(lastID, limit int64) ([]Book, error) {
+	const query = `SELECT ` + bookColumns + ` FROM books b WHERE b.deleted_at IS NOT NULL AND b.id > $1 ORDER BY b.id ASC LIMIT $2`
+	books := []Book{}
+	err := s.db.Select(&books, query, lastID, limit)
 	return books, err
 }
 
-func (s *SQLBookStore) listBooksDesc(lastID, limit int64) ([]Book, error) {
-	args := []interface{}{lastID, limit}
-	query := `SELECT * FROM books WHERE id < $1 ORDER BY id DESC LIMIT $2`
-	if lastID <= 0 {
-		args = []interface{}{limit}
-		query = `SELECT * FROM books ORDER BY id DESC LIMIT $1`
+// PurgeDeletedBooks deletes the books along with their copies, loans and holds.
+// The loans of every borrower of the books are lost, fines charged for them
+// stay on the borrowers' balance without their loan.
+func (s *SQLBookStore) PurgeDeletedBooks(deletedBefore time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM books WHERE deleted_at < $1", deletedBefore)
+	if err != nil {
+		return 0, err
 	}
-	var books []Book
-	err := s.db.Select(&books, query, args...)
-	return books, err
+	return res.RowsAffected()
+}
+
+// bookSortKey is a column the catalog can be sorted by. cast types the cursor
+// value back into the column type, value reads it from the last book of a page.
+type bookSortKey struct {
+	column string
+	cast   string
+	value  func(Book) string
+}
+
+var bookSortKeys = map[string]bookSortKey{
+	"id":         {column: `b.id`, cast: `bigint`, value: func(b Book) string { return strconv.FormatInt(b.ID, 10) }},
+	"title":      {column: `b.title`, cast: `text`, value: func(b Book) string { return b.Title }},
+	"author":     {column: `coalesce(b.author, '')`, cast: `text`, value: func(b Book) string { return b.Author }},
+	"type":       {column: `coalesce(b.type, '')`, cast: `text`, value: func(b Book) string { return b.Type }},
+	"category":   {column: `coalesce(b.type, '')`, cast: `text`, value: func(b Book) string { return b.Type }},
+	"created_at": {column: `b.created_at`, cast: `timestamp`, value: func(b Book) string { return b.CreatedAt.Format(sqlTimestampLayout) }},
+	"updated_at": {column: `b.updated_at`, cast: `timestamp`, value: func(b Book) string { return b.UpdatedAt.Format(sqlTimestampLayout) }},
+	"available": {
+		column: `EXISTS (SELECT 1 FROM book_copies c WHERE c.book_id = b.id AND c.status = 'available')`,
+		cast:   `boolean`,
+		value:  func(b Book) string { return strconv.FormatBool(b.AvailableCopies > 0) },
+	},
+}
+
+// sqlTimestampLayout keeps the microseconds of a TIMESTAMP column
+const sqlTimestampLayout = "2006-01-02 15:04:05.999999"
+
+func (s *SQLBookStore) ListBooks(opts ListBooksOptions) ([]Book, string, error) {
+	key, ok := bookSortKeys[opts.Sort]
+	if !ok || (opts.Order != "asc" && opts.Order != "desc") {
+		return nil, "", ErrInvalidSort
+	}
+	conds, args := bookFilters(opts.Category, opts.Author, false)
+	cmp := ">"
+	if opts.Order == "desc" {
+		cmp = "<"
+	}
+	switch {
+	case opts.Cursor != "":
+		// the sort and order are part of the cursor so a page can't be resumed in another ordering
+		parts, err := decodeCursor(opts.Cursor, 4)
+		if err != nil {
+			return nil, "", err
+		}
+		if parts[0] != opts.Sort || parts[1] != opts.Order {
+			return nil, "", ErrInvalidCursor
+		}
+		lastID, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		conds = append(conds, fmt.Sprintf(`(%s, b.id) %s (CAST(? AS %s), ?)`, key.column, cmp, key.cast))
+		args = append(args, parts[2], lastID)
+	case opts.Sort == "id" && opts.LastID > 0:
+		conds = append(conds, `b.id `+cmp+` ?`)
+		args = append(args, opts.LastID)
+	}
+	query := `SELECT ` + bookColumns + ` FROM books b` + whereClause(conds) +
+		fmt.Sprintf(` ORDER BY %s %s, b.id %s LIMIT ?`, key.column, opts.Order, opts.Order)
+	var books []Book
+	err := s.db.Select(&books, s.db.Rebind(query), append(args, opts.Limit+1)...)
+	if err != nil || int64(len(books)) <= opts.Limit {
+		return books, "", err
+	}
+	books = books[:opts.Limit]
+	last := books[len(books)-1]
+	return books, encodeCursor(opts.Sort, opts.Order, key.value(last), strconv.FormatInt(last.ID, 10)), nil
+}
+
+// bookFilters narrows a `books b` query down to books not in the trash, a
+// category and its descendants, an author and books with a copy on the shelf
+func bookFilters(category, author string, available bool) ([]string, []interface{}) {
+	conds := []string{`b.deleted_at IS NULL`}
+	var args []interface{}
+	if category != "" {
+		conds = append(conds, `EXISTS (SELECT 1 FROM book_categories bc WHERE bc.book_id = b.id AND bc.category_id IN (
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM categories WHERE slug = lower(?)
+				UNION ALL
+				SELECT cat.id FROM categories cat JOIN subtree ON cat.parent_id = subtree.id
+			) SELECT id FROM subtree))`)
+		args = append(args, category)
+	}
+	if author != "" {
+		conds = append(conds, `EXISTS (SELECT 1 FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+			WHERE ba.book_id = b.id AND lower(a.name) = lower(?))`)
+		args = append(args, author)
+	}
+	if available {
+		conds = append(conds, `EXISTS (SELECT 1 FROM book_copies c WHERE c.book_id = b.id AND c.status = 'available')`)
+	}
+	return conds, args
+}
+
+// SearchBooks ranks matches with the books.search_vector full-text index on
+// postgres and falls back to a case-insensitive LIKE, newest first, on other
+// drivers or when there is no free text
+func (s *SQLBookStore) SearchBooks(search BookSearch) ([]Book, string, error) {
+	conds, args := bookFilters(search.Category, search.Author, search.Available)
+	if search.Query != "" && s.db.DriverName() == "postgres" {
+		return s.searchBooksRanked(search, conds, args)
+	}
+	if search.Query != "" {
+		pattern := "%" + escapeLike(strings.ToLower(search.Query)) + "%"
+		conds = append(conds, `(lower(b.title) LIKE ? ESCAPE '\' OR lower(b.author) LIKE ? ESCAPE '\' OR lower(b.type) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if search.Cursor != "" {
+		parts, err := decodeCursor(search.Cursor, 1)
+		if err != nil {
+			return nil, "", err
+		}
+		lastID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		conds = append(conds, `b.id < ?`)
+		args = append(args, lastID)
+	}
+	query := `SELECT ` + bookColumns + ` FROM books b` + whereClause(conds) + ` ORDER BY b.id DESC LIMIT ?`
+	var books []Book
+	err := s.db.Select(&books, s.db.Rebind(query), append(args, search.Limit+1)...)
+	if err != nil || int64(len(books)) <= search.Limit {
+		return books, "", err
+	}
+	books = books[:search.Limit]
+	return books, encodeCursor(strconv.FormatInt(books[len(books)-1].ID, 10)), nil
+}
+
+func (s *SQLBookStore) searchBooksRanked(search BookSearch, conds []string, args []interface{}) ([]Book, string, error) {
+	const rank = `ts_rank(b.search_vector, websearch_to_tsquery('simple', ?))`
+	conds = append([]string{`b.search_vector @@ websearch_to_tsquery('simple', ?)`}, conds...)
+	args = append([]interface{}{search.Query, search.Query}, args...)
+	if search.Cursor != "" {
+		parts, err := decodeCursor(search.Cursor, 2)
+		if err != nil {
+			return nil, "", err
+		}
+		lastRank, err := strconv.ParseFloat(parts[0], 32)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		lastID, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		conds = append(conds, `(`+rank+`, b.id) < (?::real, ?)`)
+		args = append(args, search.Query, float32(lastRank), lastID)
+	}
+	query := `SELECT * FROM (SELECT ` + bookColumns + `, ` + rank + ` AS rank FROM books b` + whereClause(conds) +
+		`) ranked ORDER BY rank DESC, id DESC LIMIT ?`
+	var ranked []struct {
+		Book
+		Rank float32 `db:"rank"`
+	}
+	err := s.db.Select(&ranked, s.db.Rebind(query), append(args, search.Limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	var nextCursor string
+	if int64(len(ranked)) > search.Limit {
+		ranked = ranked[:search.Limit]
+		last := ranked[len(ranked)-1]
+		nextCursor = encodeCursor(strconv.FormatFloat(float64(last.Rank), 'g', -1, 32), strconv.FormatInt(last.ID, 10))
+	}
+	books := make([]Book, 0, len(ranked))
+	for _, r := range ranked {
+		books = append(books, r.Book)
+	}
+	return books, nextCursor, nil
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return ` WHERE ` + strings.Join(conds, ` AND `)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// encodeCursor packs the sort key of the last row of a page into an opaque
+// token, decodeCursor unpacks it and expects exactly n parts
+func encodeCursor(parts ...string) string {
+	raw, _ := json.Marshal(parts)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(cursor string, n int) ([]string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var parts []string
+	if err := json.Unmarshal(raw, &parts); err != nil || len(parts) != n {
+		return nil, ErrInvalidCursor
+	}
+	return parts, nil
+}
+
+// SQLCopyStore implements CopyStore interface
+type SQLCopyStore struct {
+	db         *sqlx.DB
+	loanPolicy LoanPolicy
+}
+
+func NewSQLCopyStore(db *sqlx.DB, loanPolicy LoanPolicy) *SQLCopyStore {
+	return &SQLCopyStore{db: db, loanPolicy: loanPolicy}
+}
+
+func (s *SQLCopyStore) AddCopy(bookCopy BookCopy) (ID int64, err error) {
+	if bookCopy.Barcode == "" {
+		bookCopy.Barcode, err = newBarcode(bookCopy.BookID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if bookCopy.Condition == "" {
+		bookCopy.Condition = "good"
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	ID, err = s.addCopy(tx, bookCopy)
+	return ID, err
+}
+
+// addCopy inserts the copy and hands it to the holds queue of the book
+func (s *SQLCopyStore) addCopy(tx *sqlx.Tx, bookCopy BookCopy) (int64, error) {
+	const query = `INSERT INTO book_copies (book_id, barcode, shelf_location, condition) VALUES (:book_id, :barcode, :shelf_location, :condition) RETURNING id`
+	namedStmt, err := tx.PrepareNamed(query)
+	if err != nil {
+		return 0, err
+	}
+	defer namedStmt.Close()
+	var id int64
+	err = namedStmt.Get(&id, bookCopy)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert copy: %v", err)
+	}
+	return id, releaseCopy(tx, bookCopy.BookID, id, s.loanPolicy.HoldPickupPeriod)
+}
+
+func (s *SQLCopyStore) GetCopy(ID int64) (BookCopy, error) {
+	const query = `SELECT * FROM book_copies WHERE id = $1`
+	var bookCopy BookCopy
+	err := s.db.Get(&bookCopy, query, ID)
+	return bookCopy, err
+}
+
+func (s *SQLCopyStore) GetCopyByBarcode(barcode string) (BookCopy, error) {
+	const query = `SELECT * FROM book_copies WHERE barcode = $1`
+	var bookCopy BookCopy
+	err := s.db.Get(&bookCopy, query, barcode)
+	return bookCopy, err
+}
+
+// UpdateCopy updates the barcode, shelf location and condition, and the status
+// too when it is set, all or nothing. Borrowed copies must be returned before
+// their status changes.
+func (s *SQLCopyStore) UpdateCopy(bookCopy BookCopy) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	const query = `UPDATE book_copies SET barcode = $1, shelf_location = $2, condition = $3 WHERE id = $4`
+	res, err := tx.Exec(query, bookCopy.Barcode, bookCopy.ShelfLocation, bookCopy.Condition, bookCopy.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if bookCopy.Status == "" {
+		return nil
+	}
+	return s.setCopyStatus(tx, bookCopy.ID, bookCopy.Status)
+}
+
+// SetCopyStatus marks a copy as available, lost or retired. Borrowed copies must be returned first
+func (s *SQLCopyStore) SetCopyStatus(ID int64, status string) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	return s.setCopyStatus(tx, ID, status)
+}
+
+func (s *SQLCopyStore) setCopyStatus(tx *sqlx.Tx, ID int64, status string) (err error) {
+	switch status {
+	case CopyAvailable, CopyLost, CopyRetired:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidCopyStatus, status)
+	}
+	var bookCopy BookCopy
+	err = tx.Get(&bookCopy, "SELECT id, book_id, status FROM book_copies WHERE id = $1 FOR UPDATE", ID)
+	if err != nil {
+		return fmt.Errorf("failed to get book copy: %w", err)
+	}
+	if bookCopy.Status == CopyBorrowed {
+		return ErrCopyBorrowed
+	}
+	if bookCopy.Status == CopyOnHold {
+		// the hold goes back to waiting and keeps its place in the queue
+		_, err = tx.Exec("UPDATE holds SET status = $1, copy_id = null, ready_at = null, pickup_by = null WHERE copy_id = $2 and status = $3", HoldWaiting, ID, HoldReady)
+		if err != nil {
+			return fmt.Errorf("failed to requeue hold: %v", err)
+		}
+	}
+	if status == CopyAvailable {
+		return releaseCopy(tx, bookCopy.BookID, ID, s.loanPolicy.HoldPickupPeriod)
+	}
+	_, err = tx.Exec("UPDATE book_copies SET status = $1 WHERE id = $2", status, ID)
+	if err != nil {
+		return fmt.Errorf("failed to update copy status: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLCopyStore) ListCopiesByBookID(bookID int64) ([]BookCopy, error) {
+	const query = `SELECT * FROM book_copies WHERE book_id = $1 ORDER BY id ASC`
+	var copies []BookCopy
+	err := s.db.Select(&copies, query, bookID)
+	return copies, err
+}
+
+// newBarcode generates a barcode for copies added without one
+func newBarcode(bookID int64) (string, error) {
+	b := make([]byte, 4)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d-%s", bookID, strings.ToUpper(hex.EncodeToString(b))), nil
+}
+
+// SQLFineStore implements FineStore interface
+type SQLFineStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLFineStore(db *sqlx.DB) *SQLFineStore {
+	return &SQLFineStore{db: db}
+}
+
+const fineColumns = `id, user_id, coalesce(borrow_history_id, 0) as borrow_history_id, kind, amount, note, coalesce(created_by, 0) as created_by, created_at`
+
+func (s *SQLFineStore) ListFinesByUserID(userID, lastID, limit int64) ([]Fine, error) {
+	args := []interface{}{userID, lastID, limit}
+	query := `SELECT ` + fineColumns + ` FROM fines WHERE user_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3`
+	if lastID <= 0 {
+		args = []interface{}{userID, limit}
+		query = `SELECT ` + fineColumns + ` FROM fines WHERE user_id = $1 ORDER BY id DESC LIMIT $2`
+	}
+	var fines []Fine
+	err := s.db.Select(&fines, query, args...)
+	return fines, err
+}
+
+func (s *SQLFineStore) GetFineBalance(userID int64) (int64, error) {
+	const query = `SELECT coalesce(sum(amount), 0) FROM fines WHERE user_id = $1`
+	var balance int64
+	err := s.db.Get(&balance, query, userID)
+	return balance, err
+}
+
+func (s *SQLFineStore) RecordPayment(userID, amount int64, note string, createdBy int64) (Fine, error) {
+	return s.credit(Fine{UserID: userID, Kind: FinePayment, Amount: amount, Note: note, CreatedBy: createdBy})
+}
+
+func (s *SQLFineStore) WaiveFine(userID, borrowHistoryID, amount int64, note string, createdBy int64) (Fine, error) {
+	return s.credit(Fine{UserID: userID, BorrowHistoryID: borrowHistoryID, Kind: FineWaiver, Amount: amount, Note: note, CreatedBy: createdBy})
+}
+
+// credit records a payment or waiver of fine.Amount against the user's balance
+func (s *SQLFineStore) credit(fine Fine) (entry Fine, err error) {
+	if fine.Amount <= 0 {
+		return entry, fmt.Errorf("amount must be positive")
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	// lock the user so concurrent payments can't both pass the balance check
+	_, err = tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", fine.UserID)
+	if err != nil {
+		return entry, fmt.Errorf("failed to lock user: %v", err)
+	}
+	var balance int64
+	err = tx.Get(&balance, "SELECT coalesce(sum(amount), 0) FROM fines WHERE user_id = $1", fine.UserID)
+	if err != nil {
+		return entry, fmt.Errorf("failed to get fine balance: %v", err)
+	}
+	if fine.Amount > balance {
+		return entry, ErrExceedsBalance
+	}
+	err = tx.Get(&entry, `INSERT INTO fines (user_id, borrow_history_id, kind, amount, note, created_by)
+	VALUES ($1, nullif($2, 0), $3, $4, $5, nullif($6, 0)) RETURNING `+fineColumns,
+		fine.UserID, fine.BorrowHistoryID, fine.Kind, -fine.Amount, fine.Note, fine.CreatedBy)
+	if err != nil {
+		return entry, fmt.Errorf("failed to insert fine: %v", err)
+	}
+	return entry, nil
+}
+
+// SQLAuditStore implements AuditStore interface
+type SQLAuditStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLAuditStore(db *sqlx.DB) *SQLAuditStore {
+	return &SQLAuditStore{db: db}
+}
+
+func (s *SQLAuditStore) RecordAudit(entry AuditEntry) error {
+	const query = `INSERT INTO audit_log(actor_id, actor, action, entity, entity_id, changes, ip, request_id)
+	VALUES (:actor_id, :actor, :action, :entity, :entity_id, :changes, :ip, :request_id)`
+	_, err := s.db.NamedExec(query, entry)
+	return err
+}
+
+func (s *SQLAuditStore) ListAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	var conds []string
+	var args []interface{}
+	if filter.ActorID != 0 {
+		conds = append(conds, `actor_id = ?`)
+		args = append(args, filter.ActorID)
+	}
+	if filter.Entity != "" {
+		conds = append(conds, `entity = ?`)
+		args = append(args, filter.Entity)
+	}
+	if filter.EntityID != 0 {
+		conds = append(conds, `entity_id = ?`)
+		args = append(args, filter.EntityID)
+	}
+	if !filter.From.IsZero() {
+		conds = append(conds, `created_at >= ?`)
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conds = append(conds, `created_at < ?`)
+		args = append(args, filter.To)
+	}
+	if filter.BeforeID != 0 {
+		conds = append(conds, `id < ?`)
+		args = append(args, filter.BeforeID)
+	}
+	query := `SELECT id, actor_id, actor, action, entity, entity_id, changes, ip, request_id, created_at
+	FROM audit_log` + whereClause(conds) + ` ORDER BY id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+	entries := []AuditEntry{}
+	err := s.db.Select(&entries, s.db.Rebind(query), args...)
+	return entries, err
+}
+
+// SQLCategoryStore implements CategoryStore interface
+type SQLCategoryStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLCategoryStore(db *sqlx.DB) *SQLCategoryStore {
+	return &SQLCategoryStore{db: db}
+}
+
+// categoryTreeQuery selects every category with its path, filter it with a WHERE clause on tree
+const categoryTreeQuery = `WITH RECURSIVE tree AS (
+		SELECT id, parent_id, slug, name, created_at, slug AS path FROM categories WHERE parent_id IS NULL
+		UNION ALL
+		SELECT cat.id, cat.parent_id, cat.slug, cat.name, cat.created_at, tree.path || '/' || cat.slug
+		FROM categories cat JOIN tree ON cat.parent_id = tree.id
+	) SELECT tree.*, (SELECT count(*) FROM book_categories bc JOIN books b ON b.id = bc.book_id
+		WHERE bc.category_id = tree.id AND b.deleted_at IS NULL) AS book_count FROM tree `
+
+func (s *SQLCategoryStore) AddCategory(category Category) (int64, error) {
+	const query = `INSERT INTO categories (parent_id, slug, name) VALUES (:parent_id, :slug, :name) RETURNING id`
+	namedStmt, err := s.db.PrepareNamed(query)
+	if err != nil {
+		return 0, err
+	}
+	defer namedStmt.Close()
+	var id int64
+	err = namedStmt.Get(&id, category)
+	if isForeignKeyViolation(err) {
+		return 0, ErrUnknownCategory
+	}
+	return id, err
+}
+
+func (s *SQLCategoryStore) GetCategory(ID int64) (Category, error) {
+	const query = categoryTreeQuery + `WHERE tree.id = $1`
+	var category Category
+	err := s.db.Get(&category, query, ID)
+	return category, err
+}
+
+// UpdateCategory renames or moves a category, the slug change reaches the
+// type of its books
+func (s *SQLCategoryStore) UpdateCategory(category Category) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	if category.ParentID != nil {
+		// the lock keeps concurrent moves from building a cycle together
+		if _, err = tx.Exec(`LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+		var inSubtree bool
+		err = tx.Get(&inSubtree, `WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE id = $1
+			UNION ALL
+			SELECT cat.id FROM categories cat JOIN subtree ON cat.parent_id = subtree.id
+		) SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`, category.ID, *category.ParentID)
+		if err != nil {
+			return err
+		}
+		if inSubtree {
+			return ErrCategoryCycle
+		}
+	}
+	res, err := tx.NamedExec(`UPDATE categories SET parent_id = :parent_id, slug = :slug, name = :name WHERE id = :id`, category)
+	if isForeignKeyViolation(err) {
+		return ErrUnknownCategory
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLCategoryStore) RemoveCategory(ID int64) error {
+	const query = `DELETE FROM categories WHERE id = $1`
+	res, err := s.db.Exec(query, ID)
+	if isForeignKeyViolation(err) {
+		return ErrCategoryInUse
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListCategories lists the whole tree, every category after its parent
+func (s *SQLCategoryStore) ListCategories() ([]Category, error) {
+	const query = categoryTreeQuery + `ORDER BY tree.path`
+	var categories []Category
+	err := s.db.Select(&categories, query)
+	return categories, err
+}
+
+// loginAttempts are the failed logins of a key
+type loginAttempts struct {
+	failures      int
+	lastFailureAt time.Time
+	blockedUntil  time.Time
+}
+
+// MemoryLoginAttemptStore implements LoginAttemptStore interface for a single node
+type MemoryLoginAttemptStore struct {
+	policy   LoginPolicy
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+func NewMemoryLoginAttemptStore(policy LoginPolicy) *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{policy: policy, attempts: make(map[string]*loginAttempts)}
+}
+
+func (s *MemoryLoginAttemptStore) RetryAfter(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return 0, nil
+	}
+	if wait := time.Until(attempts.blockedUntil); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryLoginAttemptStore) RecordFailure(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	attempts, ok := s.attempts[key]
+	if !ok || now.Sub(attempts.lastFailureAt) > s.policy.FailureWindow {
+		attempts = &loginAttempts{}
+		s.attempts[key] = attempts
+	}
+	attempts.failures++
+	attempts.lastFailureAt = now
+	delay := s.policy.Delay(attempts.failures)
+	attempts.blockedUntil = now.Add(delay)
+	return delay, nil
+}
+
+func (s *MemoryLoginAttemptStore) ResetAttempts(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) PruneAttempts() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var pruned int64
+	for key, attempts := range s.attempts {
+		if now.After(attempts.blockedUntil) && now.Sub(attempts.lastFailureAt) > s.policy.FailureWindow {
+			delete(s.attempts, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// SQLLoginAttemptStore implements LoginAttemptStore interface, it goes by the
+// clock of the database so nodes agree on when a key is blocked
+type SQLLoginAttemptStore struct {
+	db     *sqlx.DB
+	policy LoginPolicy
+}
+
+func NewSQLLoginAttemptStore(db *sqlx.DB, policy LoginPolicy) *SQLLoginAttemptStore {
+	return &SQLLoginAttemptStore{db: db, policy: policy}
+}
+
+func (s *SQLLoginAttemptStore) RetryAfter(key string) (time.Duration, error) {
+	const query = `SELECT greatest(extract(epoch FROM blocked_until - current_timestamp), 0) FROM login_attempts WHERE key = $1`
+	var seconds float64
+	err := s.db.Get(&seconds, query, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return time.Duration(seconds * float64(time.Second)), err
+}
+
+func (s *SQLLoginAttemptStore) RecordFailure(key string) (delay time.Duration, err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	var failures int
+	err = tx.Get(&failures, `INSERT INTO login_attempts (key, failures, last_failure_at, blocked_until)
+	VALUES ($1, 1, current_timestamp, current_timestamp)
+	ON CONFLICT (key) DO UPDATE SET last_failure_at = current_timestamp, failures = CASE
+		WHEN login_attempts.last_failure_at < current_timestamp - make_interval(secs => $2) THEN 1
+		ELSE login_attempts.failures + 1 END
+	RETURNING failures`, key, s.policy.FailureWindow.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	delay = s.policy.Delay(failures)
+	_, err = tx.Exec(`UPDATE login_attempts SET blocked_until = current_timestamp + make_interval(secs => $1) WHERE key = $2`, delay.Seconds(), key)
+	return delay, err
+}
+
+func (s *SQLLoginAttemptStore) ResetAttempts(key string) error {
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
+
+func (s *SQLLoginAttemptStore) PruneAttempts() (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM login_attempts WHERE blocked_until < current_timestamp
+	AND last_failure_at < current_timestamp - make_interval(secs => $1)`, s.policy.FailureWindow.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SQLTOTPStore implements TOTPStore interface
+type SQLTOTPStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLTOTPStore(db *sqlx.DB) *SQLTOTPStore {
+	return &SQLTOTPStore{db: db}
+}
+
+func (s *SQLTOTPStore) GetTOTP(userID int64) (TOTP, error) {
+	var totp TOTP
+	err := s.db.Get(&totp, `SELECT user_id, secret, confirmed_at, last_step FROM user_totp WHERE user_id = $1`, userID)
+	return totp, err
+}
+
+func (s *SQLTOTPStore) StartTOTP(userID int64, secret string) error {
+	res, err := s.db.Exec(`INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, last_step = NULL, created_at = current_timestamp
+	WHERE user_totp.confirmed_at IS NULL`, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+func (s *SQLTOTPStore) ConfirmTOTP(userID, step int64, recoveryCodeHashes []string) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	res, err := tx.Exec(`UPDATE user_totp SET confirmed_at = current_timestamp, last_step = $2
+	WHERE user_id = $1 AND confirmed_at IS NULL`, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTOTPEnabled
+	}
+	return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+}
+
+func (s *SQLTOTPStore) UseTOTPStep(userID, step int64) error {
+	res, err := s.db.Exec(`UPDATE user_totp SET last_step = $2
+	WHERE user_id = $1 AND (last_step IS NULL OR last_step < $2)`, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode compares code with each unused code of the user, the codes
+// are salted so they can't be looked up by hash
+func (s *SQLTOTPStore) UseRecoveryCode(userID int64, code string) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	var unused []struct {
+		ID       int64  `db:"id"`
+		CodeHash string `db:"code_hash"`
+	}
+	err = tx.Select(&unused, `SELECT id, code_hash FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL FOR UPDATE`, userID)
+	if err != nil {
+		return err
+	}
+	for _, recoveryCode := range unused {
+		if recoveryCodeMatches(recoveryCode.CodeHash, code) {
+			_, err = tx.Exec(`UPDATE recovery_codes SET used_at = current_timestamp WHERE id = $1`, recoveryCode.ID)
+			return err
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (s *SQLTOTPStore) ReplaceRecoveryCodes(userID int64, codeHashes []string) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	return replaceRecoveryCodes(tx, userID, codeHashes)
+}
+
+func replaceRecoveryCodes(tx *sqlx.Tx, userID int64, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])`, userID, pq.Array(codeHashes))
+	return err
+}
+
+func (s *SQLTOTPStore) DisableTOTP(userID int64) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	res, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	return err
+}
+
+// SQLRoleStore implements RoleStore interface
+type SQLRoleStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLRoleStore(db *sqlx.DB) *SQLRoleStore {
+	return &SQLRoleStore{db: db}
+}
+
+const roleColumns = `r.name, r.description, r.builtin, r.require_totp,
+	array(SELECT rp.permission FROM role_permissions rp WHERE rp.role = r.name ORDER BY rp.permission) AS permissions,
+	(SELECT count(*) FROM users u WHERE u.type = r.name AND u.deleted_at IS NULL) AS user_count`
+
+func (s *SQLRoleStore) AddRole(role Role) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	_, err = tx.Exec(`INSERT INTO roles (name, description, require_totp) VALUES ($1, $2, $3)`, role.Name, role.Description, role.RequireTOTP)
+	if err != nil {
+		return err
+	}
+	return setRolePermissions(tx, role)
+}
+
+func (s *SQLRoleStore) GetRole(name string) (Role, error) {
+	var role Role
+	err := s.db.Get(&role, `SELECT `+roleColumns+` FROM roles r WHERE r.name = $1`, name)
+	return role, err
+}
+
+func (s *SQLRoleStore) UpdateRole(role Role) (err error) {
+	if role.Name == Admin {
+		// whoever can change roles could otherwise take their own permissions away
+		current, err := s.GetRole(Admin)
+		if err != nil {
+			return err
+		}
+		if !samePermissions(current.Permissions, role.Permissions) {
+			return ErrAdminRole
+		}
+	}
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	res, err := tx.Exec(`UPDATE roles SET description = $1, require_totp = $2 WHERE name = $3`, role.Description, role.RequireTOTP, role.Name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err = tx.Exec(`DELETE FROM role_permissions WHERE role = $1`, role.Name); err != nil {
+		return err
+	}
+	return setRolePermissions(tx, role)
+}
+
+func setRolePermissions(tx *sqlx.Tx, role Role) error {
+	_, err := tx.Exec(`INSERT INTO role_permissions (role, permission) SELECT $1, unnest($2::text[])`, role.Name, role.Permissions)
+	return err
+}
+
+// RemoveRole removes a role no user has, the users in the trash included
+func (s *SQLRoleStore) RemoveRole(name string) error {
+	var builtin bool
+	err := s.db.Get(&builtin, `SELECT builtin FROM roles WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if builtin {
+		return ErrBuiltinRole
+	}
+	res, err := s.db.Exec(`DELETE FROM roles WHERE name = $1 AND NOT builtin`, name)
+	if isForeignKeyViolation(err) {
+		return ErrRoleInUse
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListRoles lists the built-in roles first
+func (s *SQLRoleStore) ListRoles() ([]Role, error) {
+	var roles []Role
+	err := s.db.Select(&roles, `SELECT `+roleColumns+` FROM roles r ORDER BY r.builtin DESC, r.name`)
+	return roles, err
+}
+
+// SQLAuthorStore implements AuthorStore interface
+type SQLAuthorStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLAuthorStore(db *sqlx.DB) *SQLAuthorStore {
+	return &SQLAuthorStore{db: db}
+}
+
+// ListAuthors lists authors by id, optionally only those whose name contains name
+func (s *SQLAuthorStore) ListAuthors(lastID, limit int64, name string) ([]Author, error) {
+	const query = `SELECT a.id, a.name, a.created_at, (SELECT count(*) FROM book_authors ba JOIN books b ON b.id = ba.book_id
+		WHERE ba.author_id = a.id AND b.deleted_at IS NULL) AS book_count
+	FROM authors a WHERE a.id > $1 AND ($2 = '' OR lower(a.name) LIKE '%' || $3 || '%' ESCAPE '\') ORDER BY a.id ASC LIMIT $4`
+	var authors []Author
+	err := s.db.Select(&authors, query, lastID, name, escapeLike(strings.ToLower(name)), limit)
+	return authors, err
+}
+
+// MergeAuthors credits the books of the source authors to the target author,
+// then removes the source authors. The display names of the books are updated.
+func (s *SQLAuthorStore) MergeAuthors(targetID int64, sourceIDs []int64) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	var found int64
+	err = tx.Get(&found, `SELECT count(*) FROM authors WHERE id = $1 OR id = ANY($2)`, targetID, pq.Array(sourceIDs))
+	if err != nil {
+		return err
+	}
+	if found != int64(len(sourceIDs))+1 {
+		return sql.ErrNoRows
+	}
+	var bookIDs []int64
+	err = tx.Select(&bookIDs, `SELECT DISTINCT book_id FROM book_authors WHERE author_id = ANY($1)`, pq.Array(sourceIDs))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO book_authors (book_id, author_id, role, position)
+	SELECT book_id, $1, role, position FROM book_authors WHERE author_id = ANY($2)
+	ON CONFLICT DO NOTHING`, targetID, pq.Array(sourceIDs))
+	if err != nil {
+		return fmt.Errorf("failed to move credits: %w", err)
+	}
+	// removing the source authors cascades to their credits
+	_, err = tx.Exec(`DELETE FROM authors WHERE id = ANY($1)`, pq.Array(sourceIDs))
+	if err != nil {
+		return fmt.Errorf("failed to remove merged authors: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE books b SET author = coalesce(
+		(SELECT string_agg(a.name, $2 ORDER BY ba.position) FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+			WHERE ba.book_id = b.id AND ba.role = 'author'),
+		(SELECT string_agg(a.name, $2 ORDER BY ba.position) FROM book_authors ba JOIN authors a ON a.id = ba.author_id
+			WHERE ba.book_id = b.id), '')
+	WHERE b.id = ANY($1)`, pq.Array(bookIDs), bookAuthorSeparator)
+	if isUniqueViolation(err) {
+		return ErrDuplicateBook
+	}
+	return err
+}
+
+// SQLHoldStore implements HoldStore interface
+type SQLHoldStore struct {
+	db         *sqlx.DB
+	loanPolicy LoanPolicy
+}
+
+func NewSQLHoldStore(db *sqlx.DB, loanPolicy LoanPolicy) *SQLHoldStore {
+	return &SQLHoldStore{db: db, loanPolicy: loanPolicy}
+}
+
+// holdQuery selects Hold rows, append the WHERE clause to it
+const holdQuery = `SELECT h.id, h.book_id, b.title, h.user_id, u.username, coalesce(h.copy_id, 0) as copy_id, h.status,
+	CASE WHEN h.status = 'waiting' THEN (SELECT count(*) FROM holds q WHERE q.book_id = h.book_id AND q.status = 'waiting' AND q.id <= h.id) ELSE 0 END as queue_position,
+	h.created_at, h.ready_at, h.pickup_by, h.closed_at
+	FROM holds h
+	join books b on h.book_id = b.id
+	join users u on h.user_id = u.id `
+
+func (s *SQLHoldStore) PlaceHold(userID, bookID int64) (hold Hold, err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	// lock the book so a copy returned concurrently can't slip past the new hold
+	err = tx.Get(&bookID, "SELECT id FROM books WHERE id = $1 and deleted_at IS NULL FOR UPDATE", bookID)
+	if err != nil {
+		return hold, fmt.Errorf("failed to get book: %w", err)
+	}
+	err = tx.Get(&userID, "SELECT id FROM users WHERE id = $1 and deleted_at IS NULL FOR SHARE", userID)
+	if err != nil {
+		return hold, fmt.Errorf("failed to get user: %w", err)
+	}
+	var available int64
+	err = tx.Get(&available, "SELECT count(*) FROM book_copies WHERE book_id = $1 and status = $2", bookID, CopyAvailable)
+	if err != nil {
+		return hold, fmt.Errorf("failed to count available copies: %v", err)
+	}
+	if available > 0 {
+		return hold, ErrCopiesAvailable
+	}
+	var borrowing int64
+	err = tx.Get(&borrowing, "SELECT count(*) FROM borrow_history WHERE user_id = $1 and book_id = $2 and returned = false", userID, bookID)
+	if err != nil {
+		return hold, fmt.Errorf("failed to check if user is currently borrowing the book: %v", err)
+	}
+	if borrowing > 0 {
+		return hold, ErrAlreadyBorrowing
+	}
+	var id int64
+	err = tx.Get(&id, "INSERT INTO holds (book_id, user_id) VALUES ($1, $2) RETURNING id", bookID, userID)
+	if isUniqueViolation(err) {
+		return hold, ErrHoldExists
+	}
+	if err != nil {
+		return hold, fmt.Errorf("failed to insert hold: %v", err)
+	}
+	err = tx.Get(&hold, holdQuery+`WHERE h.id = $1`, id)
+	return hold, err
+}
+
+func (s *SQLHoldStore) GetHold(ID int64) (Hold, error) {
+	var hold Hold
+	err := s.db.Get(&hold, holdQuery+`WHERE h.id = $1`, ID)
+	return hold, err
+}
+
+func (s *SQLHoldStore) CancelHold(ID int64) (err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	return closeHold(tx, ID, HoldCancelled, s.loanPolicy.HoldPickupPeriod)
+}
+
+func (s *SQLHoldStore) ListHoldsByUserID(userID int64) ([]Hold, error) {
+	var holds []Hold
+	err := s.db.Select(&holds, holdQuery+`WHERE h.user_id = $1 ORDER BY h.id DESC`, userID)
+	return holds, err
+}
+
+func (s *SQLHoldStore) ListHolds(bookID, lastID, limit int64) ([]Hold, error) {
+	const active = `h.status IN ('waiting', 'ready') AND h.id > $1 `
+	var holds []Hold
+	if bookID == 0 {
+		err := s.db.Select(&holds, holdQuery+`WHERE `+active+`ORDER BY h.id ASC LIMIT $2`, lastID, limit)
+		return holds, err
+	}
+	err := s.db.Select(&holds, holdQuery+`WHERE `+active+`AND h.book_id = $2 ORDER BY h.id ASC LIMIT $3`, lastID, bookID, limit)
+	return holds, err
+}
+
+func (s *SQLHoldStore) ExpireHolds() (expired int64, err error) {
+	tx := s.db.MustBegin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		tx.Commit()
+	}()
+	var ids []int64
+	err = tx.Select(&ids, "SELECT id FROM holds WHERE status = $1 and pickup_by < current_timestamp ORDER BY id FOR UPDATE SKIP LOCKED", HoldReady)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list expired holds: %v", err)
+	}
+	for _, id := range ids {
+		err = closeHold(tx, id, HoldExpired, s.loanPolicy.HoldPickupPeriod)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+// closeHold moves an active hold to status and passes its copy, if any, to the next hold
+func closeHold(tx *sqlx.Tx, ID int64, status string, pickupPeriod time.Duration) error {
+	var hold struct {
+		BookID int64         `db:"book_id"`
+		CopyID sql.NullInt64 `db:"copy_id"`
+	}
+	err := tx.Get(&hold, "UPDATE holds SET status = $1, closed_at = current_timestamp WHERE id = $2 and status IN ($3, $4) RETURNING book_id, copy_id", status, ID, HoldWaiting, HoldReady)
+	if err == sql.ErrNoRows {
+		return ErrHoldNotActive
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close hold: %v", err)
+	}
+	if !hold.CopyID.Valid {
+		return nil
+	}
+	return releaseCopy(tx, hold.BookID, hold.CopyID.Int64, pickupPeriod)
+}
+
+// cancelHolds cancels the active holds of a book or a user, column is book_id
+// or user_id. Waiting holds go first so the copies of ready ones aren't set
+// aside for holds about to be cancelled.
+func cancelHolds(tx *sqlx.Tx, column string, ID int64, pickupPeriod time.Duration) error {
+	var holdIDs []int64
+	err := tx.Select(&holdIDs, "SELECT id FROM holds WHERE "+column+" = $1 and status IN ($2, $3) ORDER BY status = $3, id", ID, HoldWaiting, HoldReady)
+	if err != nil {
+		return fmt.Errorf("failed to get holds: %v", err)
+	}
+	for _, holdID := range holdIDs {
+		if err := closeHold(tx, holdID, HoldCancelled, pickupPeriod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a postgres unique_violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
 }
 
 type ImageStore interface {
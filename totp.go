@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters of RFC 6238 as authenticator apps expect them by default
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	totpSkew       = 1 // steps a code may be off, for clocks that drift
+	totpSecretSize = 20
+)
+
+// Recovery codes carry about 49 bits, too few for a fast hash like HashToken,
+// so they are hashed with bcrypt. The cost is lower than passwordHashCost as a
+// recovery code is checked against each of the ten codes of the user.
+const (
+	recoveryCodeCount    = 10
+	recoveryCodeSize     = 10 // characters, written as two groups of five
+	recoveryCodeHashCost = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random secret in the base32 form authenticator apps take
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode is the code of the secret for a time step, HOTP of RFC 4226
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// verifyTOTP returns the time step code is valid for at now, give or take
+// totpSkew steps. Callers keep the step so a code can't be used twice.
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth URI authenticator apps scan from a QR code
+func totpURI(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// newRecoveryCodes returns codes to hand to the user along with the hashes to store
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789" // no look-alikes like 0, o, 1 and l
+	// bytes past the last whole multiple of the alphabet are skipped so every character is as likely
+	const limit = 256 / len(alphabet) * len(alphabet)
+	random := make([]byte, 1)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 0, recoveryCodeSize)
+		for len(b) < recoveryCodeSize {
+			if _, err := rand.Read(random); err != nil {
+				return nil, nil, err
+			}
+			if int(random[0]) < limit {
+				b = append(b, alphabet[int(random[0])%len(alphabet)])
+			}
+		}
+		code := string(b[:recoveryCodeSize/2]) + "-" + string(b[recoveryCodeSize/2:])
+		hash, err := hashRecoveryCode(code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the salted hash of a recovery code to store
+func hashRecoveryCode(code string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), recoveryCodeHashCost)
+	return string(hash), err
+}
+
+// recoveryCodeMatches checks code against a hash of hashRecoveryCode
+func recoveryCodeMatches(hash, code string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(normalizeRecoveryCode(code))) == nil
+}
+
+// normalizeRecoveryCode lets users type a recovery code without the dash or in capitals
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the test vectors in appendix B of RFC 6238
+const rfc6238Secret = "12345678901234567890"
+
+func TestTOTPCode(t *testing.T) {
+	// the 8 digit codes of the RFC truncated to totpDigits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, tt := range tests {
+		step := tt.unix / int64(totpPeriod/time.Second)
+		if got := totpCode([]byte(rfc6238Secret), step); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfc6238Secret))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	tests := []struct {
+		name   string
+		code   string
+		wantOK bool
+		step   int64
+	}{
+		{"current step", totpCode([]byte(rfc6238Secret), current), true, current},
+		{"previous step", totpCode([]byte(rfc6238Secret), current-totpSkew), true, current - totpSkew},
+		{"next step", totpCode([]byte(rfc6238Secret), current+totpSkew), true, current + totpSkew},
+		{"too old", totpCode([]byte(rfc6238Secret), current-totpSkew-1), false, 0},
+		{"too new", totpCode([]byte(rfc6238Secret), current+totpSkew+1), false, 0},
+		{"spaced", " 050 471 ", true, current},
+		{"wrong code", "000000", false, 0},
+		{"too short", "50471", false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(secret, tt.code, now)
+		if ok != tt.wantOK || step != tt.step {
+			t.Errorf("%s: verifyTOTP(%q) = %d, %v, want %d, %v", tt.name, tt.code, step, ok, tt.step, tt.wantOK)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", "050471", now); ok {
+		t.Error("verifyTOTP accepted an invalid secret")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"abcde-fghjk", "abcdefghjk"},
+		{"ABCDE-FGHJK", "abcdefghjk"},
+		{"abcdefghjk", "abcdefghjk"},
+		{" abcde fghjk ", "abcdefghjk"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	format := regexp.MustCompile(`^[a-z2-9]{5}-[a-z2-9]{5}$`)
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q is not of the form xxxxx-xxxxx", code)
+		}
+		if !recoveryCodeMatches(hashes[i], code) {
+			t.Errorf("code %q doesn't match its hash", code)
+		}
+	}
+	if !recoveryCodeMatches(hashes[0], "  "+codes[0][:5]+codes[0][6:]+" ") {
+		t.Error("code typed without the dash doesn't match its hash")
+	}
+	if recoveryCodeMatches(hashes[0], codes[1]) {
+		t.Error("code matches the hash of another code")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -73,6 +76,10 @@ func (h *BaseHandler) JSONStatusConflict(w http.ResponseWriter, msg string) {
 	h.JSON(w, http.StatusConflict, NewBaseResponse(msg))
 }
 
+func (h *BaseHandler) JSONUnprocessableEntity(w http.ResponseWriter, msg string) {
+	h.JSON(w, http.StatusUnprocessableEntity, NewBaseResponse(msg))
+}
+
 func (h *BaseHandler) JSONInternalServerError(w http.ResponseWriter, msg string) {
 	h.JSON(w, http.StatusInternalServerError, NewBaseResponse(msg))
 }
@@ -81,7 +88,13 @@ func (h *BaseHandler) JSONGenericInternalServerError(w http.ResponseWriter) {
 	h.JSON(w, http.StatusInternalServerError, NewBaseResponse("Something went wrong, try again later"))
 }
 
-func (h *BaseHandler) JSONTooManyRequests(w http.ResponseWriter) {
+// JSONTooManyRequests tells the client to try again in retryAfter, rounded up to a second
+func (h *BaseHandler) JSONTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
 	h.JSON(w, http.StatusTooManyRequests, NewBaseResponse("Too many requests"))
 }
 
@@ -101,7 +114,8 @@ func SetCors(r *mux.Router) {
 	r.Use(cors.New(cors.Options{
 		AllowedOrigins:     []string{"https://*", "http://*"},
 		AllowedMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowedHeaders:     []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization", "Sentry-Trace", "Baggage", "x-elastic-client-meta", "x-swiftype-client", "x-swiftype-client-version", "Cookie"},
+		AllowedHeaders:     []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization", "Sentry-Trace", "Baggage", "x-elastic-client-meta", "x-swiftype-client", "x-swiftype-client-version", "Cookie", requestIDHeader},
+		ExposedHeaders:     []string{"X-Next-Cursor", requestIDHeader, "Retry-After"},
 		AllowCredentials:   true,
 		OptionsPassthrough: false,
 		Debug:              true,
@@ -129,16 +143,58 @@ func getMaxRequestBodySize() int64 {
 	return maxRequestSize
 }
 
-func Serve(router *mux.Router) {
+// getTOTPIssuer is the name authenticator apps list TOTP codes under
+func getTOTPIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Library Management System"
+}
+
+// shutdownTimeout is how long requests in flight get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// Serve serves until ctx is done, then shuts the server down gracefully
+func Serve(ctx context.Context, router *mux.Router) {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	log.Printf("http://0.0.0.0:%s", port)
 
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), http.MaxBytesHandler(router, getMaxRequestBodySize()))
-	if err != nil {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: http.MaxBytesHandler(router, getMaxRequestBodySize()),
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Printf("shutting down, waiting up to %s for requests in flight", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		msg := fmt.Sprintf("calling ListenAndServe: %s", err)
 		log.Fatal(msg)
 	}
+	<-stopped
+}
+
+// runPeriodically calls fn every interval until ctx is done
+func runPeriodically(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
 }